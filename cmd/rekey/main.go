@@ -0,0 +1,104 @@
+// Command rekey re-encrypts stored server and credential secrets under fresh
+// data keys wrapped by the active key provider, bound to the row and column
+// they belong to. Run it after rotating the active key or switching
+// KMS_PROVIDER; once it reports no remaining rows, retired keys and the
+// legacy ENCRYPTION_KEY can be removed and ENCRYPTION_REQUIRE_BINDING can be
+// enabled.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+
+	"github.com/joho/godotenv"
+	"gorm.io/gorm"
+)
+
+func main() {
+	batchSize := flag.Int("batch", 100, "rows re-encrypted per transaction")
+	dryRun := flag.Bool("dry-run", false, "count rows that need re-encryption without changing them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+
+	db.Init()
+	crypto.Init()
+
+	log.Printf("Re-encrypting stored secrets under %s", crypto.ActiveKeyID())
+
+	var updated, failed int
+	for _, table := range models.SealedTables {
+		n, f, err := rekeyTable(table, *batchSize, *dryRun)
+		if err != nil {
+			log.Fatalf("Re-encryption of %s failed: %v", table, err)
+		}
+		updated += n
+		failed += f
+	}
+
+	if *dryRun {
+		log.Printf("%d rows need re-encryption, %d values could not be decrypted", updated, failed)
+		return
+	}
+	log.Printf("Re-encrypted %d rows, %d values could not be decrypted", updated, failed)
+}
+
+// rekeyTable re-encrypts the secrets of every row in table, including
+// soft-deleted rows, and returns how many rows changed and how many values
+// could not be decrypted.
+func rekeyTable(table string, batchSize int, dryRun bool) (updated, failed int, err error) {
+	var rows []struct {
+		ID                  uint
+		UserID              uint
+		EncryptedSecret     string
+		EncryptedPassphrase string
+	}
+	// Table() skips the soft-delete scope; deleted rows still hold secrets
+	result := db.DB.Table(table).Order("id").FindInBatches(&rows, batchSize, func(_ *gorm.DB, _ int) error {
+		return db.DB.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				changes := map[string]interface{}{}
+
+				for column, value := range map[string]string{
+					"encrypted_secret":     row.EncryptedSecret,
+					"encrypted_passphrase": row.EncryptedPassphrase,
+				} {
+					if !crypto.NeedsRekey(value) {
+						continue
+					}
+					binding := crypto.Binding{UserID: row.UserID, RecordID: row.ID, Field: table + "." + column}
+					plaintext, err := crypto.Decrypt(value, binding)
+					if err != nil {
+						log.Printf("%s %d: cannot decrypt %s: %v", table, row.ID, column, err)
+						failed++
+						continue
+					}
+					sealed, err := crypto.Encrypt(plaintext, binding)
+					if err != nil {
+						return err
+					}
+					changes[column] = sealed
+				}
+
+				if len(changes) == 0 {
+					continue
+				}
+				updated++
+				if dryRun {
+					continue
+				}
+				if err := tx.Table(table).Where("id = ?", row.ID).UpdateColumns(changes).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	return updated, failed, result.Error
+}
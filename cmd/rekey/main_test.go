@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+func useKey(t *testing.T, active string) {
+	t.Setenv("ENCRYPTION_KEYS", "k1:first secret,k2:second secret")
+	t.Setenv("ENCRYPTION_KEY_ID", active)
+	crypto.Init()
+}
+
+func TestRekeyTable(t *testing.T) {
+	dbtest.Open(t)
+	useKey(t, "k1")
+
+	servers := []models.Server{
+		{UserID: 1, Name: "live", Host: "10.0.0.1", Port: 22, Username: "root", AuthType: "password"},
+		{UserID: 1, Name: "deleted", Host: "10.0.0.2", Port: 22, Username: "root", AuthType: "password"},
+	}
+	for i := range servers {
+		dbtest.Create(t, &servers[i])
+		binding := crypto.Binding{UserID: 1, RecordID: servers[i].ID, Field: crypto.FieldServerSecret}
+		sealed, err := crypto.Encrypt(servers[i].Name+" password", binding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.DB.Model(&servers[i]).UpdateColumn("encrypted_secret", sealed)
+	}
+	db.DB.Delete(&servers[1])
+
+	useKey(t, "k2")
+	if updated, failed, err := rekeyTable("servers", 1, true); err != nil || updated != 2 || failed != 0 {
+		t.Fatalf("dry run = %d, %d, %v; want 2 rows to update", updated, failed, err)
+	}
+	if updated, failed, err := rekeyTable("servers", 1, false); err != nil || updated != 2 || failed != 0 {
+		t.Fatalf("rekey = %d, %d, %v; want 2 rows updated", updated, failed, err)
+	}
+	if updated, _, err := rekeyTable("servers", 1, false); err != nil || updated != 0 {
+		t.Fatalf("second rekey = %d, %v; want nothing left to update", updated, err)
+	}
+
+	for _, server := range servers {
+		var secret string
+		db.DB.Table("servers").Where("id = ?", server.ID).Select("encrypted_secret").Scan(&secret)
+		if crypto.NeedsRekey(secret) {
+			t.Errorf("server %s still needs rekeying", server.Name)
+		}
+		binding := crypto.Binding{UserID: 1, RecordID: server.ID, Field: crypto.FieldServerSecret}
+		if got, err := crypto.Decrypt(secret, binding); err != nil || got != server.Name+" password" {
+			t.Errorf("server %s: Decrypt() = %q, %v", server.Name, got, err)
+		}
+	}
+}
@@ -10,8 +10,13 @@ import (
 	"web-ssh-backend/internal/auth"
 	"web-ssh-backend/internal/crypto"
 	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/egress"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/proxy"
+	"web-ssh-backend/internal/recording"
 	"web-ssh-backend/internal/sftp"
 	"web-ssh-backend/internal/ssh"
+	"web-ssh-backend/internal/sshconn"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -29,8 +34,14 @@ func main() {
 
 	// Initialize subsystems
 	db.Init()
+	egress.Init()
 	auth.Init()
 	crypto.Init()
+	recording.Init()
+	ssh.Init()
+	sshconn.Init()
+	passvault.Init()
+	proxy.Init()
 
 	r := mux.NewRouter()
 
@@ -41,19 +52,66 @@ func main() {
 	// API Routes (Protected)
 	apiRouter := r.PathPrefix("/api").Subrouter()
 	apiRouter.Use(auth.AuthMiddleware)
+	apiRouter.Use(passvault.Middleware)
 	apiRouter.HandleFunc("/servers", api.GetServers).Methods("GET")
 	apiRouter.HandleFunc("/servers", api.CreateServer).Methods("POST")
 	apiRouter.HandleFunc("/servers", api.UpdateServer).Methods("PUT")
 	apiRouter.HandleFunc("/servers", api.DeleteServer).Methods("DELETE")
+	apiRouter.HandleFunc("/servers/hostkey", api.GetHostKey).Methods("GET")
+	apiRouter.HandleFunc("/servers/hostkey", api.PinHostKey).Methods("PUT")
+	apiRouter.HandleFunc("/servers/hostkey/accept", api.AcceptHostKey).Methods("POST")
+	apiRouter.HandleFunc("/servers/shared", api.GetSharedServers).Methods("GET")
+	apiRouter.HandleFunc("/servers/grants", api.GetServerGrants).Methods("GET")
+	apiRouter.HandleFunc("/servers/grants", api.CreateServerGrant).Methods("POST")
+	apiRouter.HandleFunc("/servers/grants", api.DeleteServerGrant).Methods("DELETE")
+	apiRouter.HandleFunc("/credentials", api.GetCredentials).Methods("GET")
+	apiRouter.HandleFunc("/credentials", api.CreateCredential).Methods("POST")
+	apiRouter.HandleFunc("/credentials", api.UpdateCredential).Methods("PUT")
+	apiRouter.HandleFunc("/credentials", api.DeleteCredential).Methods("DELETE")
+	apiRouter.HandleFunc("/credentials/usage", api.GetCredentialUsage).Methods("GET")
+	apiRouter.HandleFunc("/credentials/shared", api.GetSharedCredentials).Methods("GET")
+	apiRouter.HandleFunc("/credentials/grants", api.GetCredentialGrants).Methods("GET")
+	apiRouter.HandleFunc("/credentials/grants", api.CreateCredentialGrant).Methods("POST")
+	apiRouter.HandleFunc("/credentials/grants", api.DeleteCredentialGrant).Methods("DELETE")
+	apiRouter.HandleFunc("/keys/generate", api.GenerateKey).Methods("POST")
+	apiRouter.HandleFunc("/keys/deploy", api.DeployKey).Methods("POST")
+	apiRouter.HandleFunc("/ca", api.GetCAs).Methods("GET")
+	apiRouter.HandleFunc("/ca", api.CreateCA).Methods("POST")
+	apiRouter.HandleFunc("/ca", api.UpdateCA).Methods("PUT")
+	apiRouter.HandleFunc("/ca", api.DeleteCA).Methods("DELETE")
+	apiRouter.HandleFunc("/audit", api.GetAuditEvents).Methods("GET")
 	apiRouter.HandleFunc("/me", api.GetCurrentUser).Methods("GET")
+	apiRouter.HandleFunc("/ws-ticket", api.CreateWSTicket).Methods("POST")
+	apiRouter.HandleFunc("/sessions", ssh.HandleListSessions).Methods("GET")
+	apiRouter.HandleFunc("/sessions/shared", ssh.HandleListSharedSessions).Methods("GET")
+	apiRouter.HandleFunc("/sessions/share", ssh.HandleShareSession).Methods("POST")
+	apiRouter.HandleFunc("/sessions/share", ssh.HandleUnshareSession).Methods("DELETE")
+	apiRouter.HandleFunc("/sessions/policy", ssh.HandleSetSessionPolicy).Methods("PUT")
+	apiRouter.HandleFunc("/pool", api.GetPoolStats).Methods("GET")
+
+	apiRouter.HandleFunc("/vault", api.GetVaultStatus).Methods("GET")
+	apiRouter.HandleFunc("/vault/enable", api.EnableVault).Methods("POST")
+	apiRouter.HandleFunc("/vault/unlock", api.UnlockVault).Methods("POST")
+	apiRouter.HandleFunc("/vault/lock", api.LockVault).Methods("POST")
+	apiRouter.HandleFunc("/vault/disable", api.DisableVault).Methods("POST")
 
 	apiRouter.HandleFunc("/folders", api.GetFolders).Methods("GET")
 	apiRouter.HandleFunc("/folders", api.CreateFolder).Methods("POST")
+	apiRouter.HandleFunc("/folders", api.UpdateFolder).Methods("PUT")
 	apiRouter.HandleFunc("/folders", api.DeleteFolder).Methods("DELETE")
 
-	// WebSocket Route (Protected by Token in Query Param)
+	apiRouter.HandleFunc("/recordings", api.GetRecordings).Methods("GET")
+	apiRouter.HandleFunc("/recordings/download", api.DownloadRecording).Methods("GET")
+	apiRouter.HandleFunc("/recordings/stream", api.StreamRecording).Methods("GET")
+
+	// WebSocket Routes (Protected by one-time ticket from /api/ws-ticket)
 	r.HandleFunc("/ws/ssh", ssh.HandleSSHWebSocket)
 	r.HandleFunc("/ws/sftp", sftp.HandleSFTPWebSocket)
+	r.HandleFunc("/ws/tunnel", proxy.HandleTunnelWebSocket)
+
+	// Reverse proxy to remote services (Protected by a "proxy" ticket, then a
+	// cookie)
+	r.PathPrefix("/proxy/{server_id:[0-9]+}/{port:[0-9]+}").HandlerFunc(proxy.Handle)
 
 	// SFTP API Routes (Protected)
 	apiRouter.HandleFunc("/sftp/download", sftp.HandleDownload).Methods("GET")
@@ -75,7 +133,7 @@ func main() {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   origins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", passvault.TokenHeader},
 		AllowCredentials: true,
 	})
 
@@ -0,0 +1,279 @@
+// Command tunnel forwards local TCP ports through the gateway's /ws/tunnel
+// endpoint to host:port as seen from a saved server, like ssh -L and -D.
+// Every forwarded connection shares one WebSocket, which is reopened with a
+// fresh ticket when it drops.
+//
+//	WEB_SSH_TOKEN=<jwt> tunnel -url https://gateway.example.com -server 3 \
+//	    -L 5432:localhost:5432 -D 1080
+//
+// WEB_SSH_UNLOCK_TOKEN, if set, unlocks the server owner's credential vault.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"web-ssh-backend/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sent with API requests; matches passvault.TokenHeader.
+const unlockTokenHeader = "X-Unlock-Token"
+
+type forwards []string
+
+func (f *forwards) String() string     { return strings.Join(*f, ",") }
+func (f *forwards) Set(v string) error { *f = append(*f, v); return nil }
+
+func main() {
+	var local forwards
+	gateway := flag.String("url", os.Getenv("WEB_SSH_URL"), "gateway base URL (default $WEB_SSH_URL)")
+	serverID := flag.Uint("server", 0, "ID of the server to tunnel through")
+	flag.Var(&local, "L", "forward `[bind:]port:host:hostport`; repeatable")
+	socks := flag.String("D", "", "serve SOCKS5 on `[bind:]port`")
+	flag.Parse()
+
+	if *gateway == "" || *serverID == 0 || (len(local) == 0 && *socks == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	token := os.Getenv("WEB_SSH_TOKEN")
+	if token == "" {
+		log.Fatal("WEB_SSH_TOKEN must be set to an API token")
+	}
+
+	c := &client{
+		base:        strings.TrimSuffix(*gateway, "/"),
+		serverID:    *serverID,
+		token:       token,
+		unlockToken: os.Getenv("WEB_SSH_UNLOCK_TOKEN"),
+	}
+
+	// Connect up front so bad settings fail before anything listens
+	if _, err := c.mux(); err != nil {
+		log.Fatalf("Failed to open tunnel: %v", err)
+	}
+
+	errs := make(chan error)
+	for _, spec := range local {
+		bind, target, err := parseForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", bind)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Forwarding %s to %s", ln.Addr(), target)
+		go func() {
+			errs <- serve(ln, func(conn net.Conn) {
+				c.forward(conn, target)
+			})
+		}()
+	}
+	if *socks != "" {
+		ln, err := net.Listen("tcp", listenAddr(*socks))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("SOCKS5 proxy on %s", ln.Addr())
+		go func() {
+			errs <- serve(ln, c.serveSOCKS)
+		}()
+	}
+
+	log.Fatal(<-errs)
+}
+
+// parseForward splits an -L spec into the local listen address and the
+// remote target. IPv6 addresses go in brackets.
+func parseForward(spec string) (bind, target string, err error) {
+	parts := splitSpec(spec)
+	n := len(parts)
+	if n < 3 || n > 4 {
+		return "", "", fmt.Errorf("invalid -L %q: want [bind:]port:host:hostport", spec)
+	}
+	if _, err := strconv.ParseUint(parts[n-1], 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid -L %q: bad remote port", spec)
+	}
+	target = net.JoinHostPort(strings.Trim(parts[n-2], "[]"), parts[n-1])
+	if n == 4 {
+		return net.JoinHostPort(strings.Trim(parts[0], "[]"), parts[1]), target, nil
+	}
+	return listenAddr(parts[0]), target, nil
+}
+
+// splitSpec splits spec on colons outside brackets.
+func splitSpec(spec string) []string {
+	var parts []string
+	start, depth := 0, 0
+	for i, r := range spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, spec[start:])
+}
+
+// listenAddr turns "port" or "bind:port" into a listen address, binding
+// to loopback unless told otherwise like ssh does.
+func listenAddr(spec string) string {
+	if !strings.Contains(spec, ":") {
+		return net.JoinHostPort("127.0.0.1", spec)
+	}
+	return spec
+}
+
+func serve(ln net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+// client holds the shared WebSocket to the gateway.
+type client struct {
+	base        string
+	serverID    uint
+	token       string
+	unlockToken string
+
+	mu      sync.Mutex
+	current *tunnel.Mux
+}
+
+// forward relays conn to target over the tunnel.
+func (c *client) forward(conn net.Conn, target string) {
+	stream, err := c.open(target)
+	if err != nil {
+		log.Printf("%s: %v", target, err)
+		conn.Close()
+		return
+	}
+	tunnel.Relay(conn, stream)
+}
+
+// open starts a stream to target, reconnecting once if the WebSocket has
+// dropped since it was last used.
+func (c *client) open(target string) (*tunnel.Stream, error) {
+	m, err := c.mux()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := m.Open(target)
+	if !errors.Is(err, tunnel.ErrMuxClosed) {
+		return stream, err
+	}
+	if m, err = c.mux(); err != nil {
+		return nil, err
+	}
+	return m.Open(target)
+}
+
+// mux returns the live WebSocket, opening a new one if needed.
+func (c *client) mux() (*tunnel.Mux, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		select {
+		case <-c.current.Done():
+		default:
+			return c.current, nil
+		}
+	}
+
+	ticket, err := c.ticket()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(c.base + "/ws/tunnel")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.RawQuery = url.Values{"ticket": {ticket}, "mode": {"mux"}}.Encode()
+
+	ws, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, err
+	}
+
+	m := tunnel.NewMux(ws)
+	go func() {
+		err := m.Serve(nil)
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Text != "" {
+			log.Printf("Tunnel closed: %s", closeErr.Text)
+		}
+	}()
+	c.current = m
+	return m, nil
+}
+
+// ticket fetches a one-time "tunnel" ticket from /api/ws-ticket.
+func (c *client) ticket() (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"server_id": c.serverID,
+		"channel":   "tunnel",
+	})
+	req, err := http.NewRequest("POST", c.base+"/api/ws-ticket", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	if c.unlockToken != "" {
+		req.Header.Set(unlockTokenHeader, c.unlockToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("ticket request failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Ticket, nil
+}
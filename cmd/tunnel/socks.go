@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-ssh-backend/internal/tunnel"
+)
+
+// SOCKS5 (RFC 1928) constants for the subset served: no authentication and
+// the CONNECT command only.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksConnectionRefused  = 0x05
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+	socksHandshakeTimeout   = 30 * time.Second
+)
+
+var errSOCKSRequest = errors.New("malformed SOCKS request")
+
+// serveSOCKS negotiates a SOCKS5 CONNECT on conn and relays it over the
+// tunnel. Names are resolved on the remote side.
+func (c *client) serveSOCKS(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socksHandshake(conn)
+	if err != nil {
+		log.Printf("SOCKS: %v", err)
+		conn.Close()
+		return
+	}
+
+	stream, err := c.open(target)
+	if err != nil {
+		log.Printf("%s: %v", target, err)
+		socksReply(conn, socksReplyCode(err))
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	tunnel.Relay(conn, stream)
+}
+
+// socksHandshake reads the greeting and request and returns the target.
+// Unsupported requests are answered before returning an error.
+func socksHandshake(conn net.Conn) (string, error) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSOCKSRequest
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, socksNoAuth) < 0 {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("client requires SOCKS authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", errSOCKSRequest
+	}
+	if req[1] != socksConnect {
+		socksReply(conn, socksCommandUnsupported)
+		return "", errors.New("only SOCKS CONNECT is supported")
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if req[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddressUnsupported)
+		return "", errSOCKSRequest
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply answers a request; the bound address is left unspecified
+// since it is on the remote side.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode maps a failure to open a stream to a reply code. Errors
+// from the far end arrive as text, so only a refusal is told apart.
+func socksReplyCode(err error) byte {
+	if strings.Contains(err.Error(), "connect failed") {
+		return socksConnectionRefused
+	}
+	return socksGeneralFailure
+}
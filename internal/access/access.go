@@ -0,0 +1,135 @@
+package access
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrServerNotFound     = errors.New("server not found")
+	ErrForbidden          = errors.New("access to server denied")
+	ErrCredentialNotFound = errors.New("credential not found")
+)
+
+// ResolveServer loads a server on behalf of userID. The caller must either
+// own the server or have been granted access to it by the owner.
+func ResolveServer(userID, serverID uint) (*models.Server, error) {
+	if serverID == 0 {
+		return nil, ErrServerNotFound
+	}
+
+	var server models.Server
+	if err := db.DB.First(&server, serverID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrServerNotFound
+		}
+		return nil, err
+	}
+
+	if server.UserID == userID {
+		return &server, nil
+	}
+
+	var count int64
+	if err := db.DB.Model(&models.ServerGrant{}).
+		Where("server_id = ? AND user_id = ?", server.ID, userID).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrForbidden
+	}
+
+	return &server, nil
+}
+
+// ResolveCredential loads a credential userID may log in with: one they own
+// or one its owner has granted them. Grants of password credentials don't
+// count, since any server a grantee points one at receives the password.
+// Credentials the user can't use are reported as not found.
+func ResolveCredential(userID, credentialID uint) (*models.Credential, error) {
+	var cred models.Credential
+	if err := db.DB.First(&cred, credentialID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCredentialNotFound
+		}
+		return nil, err
+	}
+
+	if cred.UserID == userID {
+		return &cred, nil
+	}
+	if cred.Type == "password" {
+		return nil, ErrCredentialNotFound
+	}
+
+	var count int64
+	if err := db.DB.Model(&models.CredentialGrant{}).
+		Where("credential_id = ? AND user_id = ?", cred.ID, userID).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrCredentialNotFound
+	}
+
+	return &cred, nil
+}
+
+// ServerFromTicket redeems the WebSocket ticket in r's query string for
+// channel and resolves the server it was issued for. If the request also
+// names a server_id it must match the ticket.
+func ServerFromTicket(r *http.Request, channel string) (*models.Server, auth.Ticket, error) {
+	ticket, err := auth.RedeemTicket(r.URL.Query().Get("ticket"), channel)
+	if err != nil {
+		return nil, auth.Ticket{}, err
+	}
+
+	server, err := ServerForTicket(r, ticket)
+	if err != nil {
+		return nil, auth.Ticket{}, err
+	}
+	return server, ticket, nil
+}
+
+// ServerForTicket resolves the server an already redeemed ticket was issued
+// for, checking it against any server_id in r's query string.
+func ServerForTicket(r *http.Request, ticket auth.Ticket) (*models.Server, error) {
+	if serverIDStr := r.URL.Query().Get("server_id"); serverIDStr != "" {
+		serverID, err := strconv.Atoi(serverIDStr)
+		if err != nil || uint(serverID) != ticket.ServerID {
+			return nil, ErrForbidden
+		}
+	}
+
+	// Re-check access: a grant may have been revoked since the ticket was
+	// issued
+	return ResolveServer(ticket.UserID, ticket.ServerID)
+}
+
+// StatusCode maps an error returned by ResolveServer or ServerFromTicket to
+// an HTTP status.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrInvalidTicket):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrServerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteError writes err to w using the status from StatusCode.
+func WriteError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), StatusCode(err))
+}
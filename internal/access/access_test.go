@@ -0,0 +1,157 @@
+package access
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+const (
+	owner    = 1
+	grantee  = 2
+	stranger = 3
+	revoked  = 4 // Had a grant that was deleted
+)
+
+// setup stores a server owned by owner, shared with grantee, and returns
+// its ID.
+func setup(t *testing.T) uint {
+	dbtest.Open(t)
+	server := models.Server{UserID: owner, Name: "web", Host: "127.0.0.1", Port: 22, Username: "root", AuthType: "agent"}
+	dbtest.Create(t, &server)
+	dbtest.Create(t, &models.ServerGrant{ServerID: server.ID, UserID: grantee, GrantedBy: owner})
+	grant := models.ServerGrant{ServerID: server.ID, UserID: revoked, GrantedBy: owner}
+	dbtest.Create(t, &grant)
+	if err := db.DB.Delete(&grant).Error; err != nil {
+		t.Fatal(err)
+	}
+	return server.ID
+}
+
+func TestResolveServer(t *testing.T) {
+	serverID := setup(t)
+
+	tests := []struct {
+		name     string
+		userID   uint
+		serverID uint
+		want     error
+	}{
+		{"owner", owner, serverID, nil},
+		{"grantee", grantee, serverID, nil},
+		{"stranger", stranger, serverID, ErrForbidden},
+		{"deleted grant", revoked, serverID, ErrForbidden},
+		{"missing server", owner, serverID + 100, ErrServerNotFound},
+		{"no server", owner, 0, ErrServerNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := ResolveServer(tt.userID, tt.serverID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && server.ID != tt.serverID {
+				t.Fatalf("resolved server %d, want %d", server.ID, tt.serverID)
+			}
+		})
+	}
+}
+
+func TestResolveCredential(t *testing.T) {
+	dbtest.Open(t)
+	cred := models.Credential{UserID: owner, Name: "deploy", Type: "key", EncryptedSecret: "sealed"}
+	dbtest.Create(t, &cred)
+	dbtest.Create(t, &models.CredentialGrant{CredentialID: cred.ID, UserID: grantee, GrantedBy: owner})
+	password := models.Credential{UserID: owner, Name: "root", Type: "password", EncryptedSecret: "sealed"}
+	dbtest.Create(t, &password)
+	dbtest.Create(t, &models.CredentialGrant{CredentialID: password.ID, UserID: grantee, GrantedBy: owner})
+	grant := models.CredentialGrant{CredentialID: cred.ID, UserID: revoked, GrantedBy: owner}
+	dbtest.Create(t, &grant)
+	if err := db.DB.Delete(&grant).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		userID       uint
+		credentialID uint
+		want         error
+	}{
+		{"owner", owner, cred.ID, nil},
+		{"grantee", grantee, cred.ID, nil},
+		{"stranger", stranger, cred.ID, ErrCredentialNotFound},
+		{"deleted grant", revoked, cred.ID, ErrCredentialNotFound},
+		{"password owner", owner, password.ID, nil},
+		{"password grantee", grantee, password.ID, ErrCredentialNotFound},
+		{"missing credential", owner, cred.ID + 100, ErrCredentialNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveCredential(tt.userID, tt.credentialID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && got.ID != tt.credentialID {
+				t.Fatalf("resolved credential %d, want %d", got.ID, tt.credentialID)
+			}
+		})
+	}
+}
+
+func TestServerFromTicket(t *testing.T) {
+	serverID := setup(t)
+
+	tests := []struct {
+		name    string
+		userID  uint
+		channel string // Channel the ticket is redeemed on
+		query   string // Extra query parameters
+		revoke  bool   // Delete the user's grant after issuing
+		want    int
+	}{
+		{"owner", owner, auth.ChannelSFTP, "", false, http.StatusOK},
+		{"grantee", grantee, auth.ChannelSFTP, "", false, http.StatusOK},
+		{"stranger", stranger, auth.ChannelSFTP, "", false, http.StatusForbidden},
+		{"grant deleted after issue", grantee, auth.ChannelSFTP, "", true, http.StatusForbidden},
+		{"other channel", owner, auth.ChannelSSH, "", false, http.StatusUnauthorized},
+		{"mismatched server_id", owner, auth.ChannelSFTP, "&server_id=999", false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := auth.IssueTicket(tt.userID, serverID, auth.ChannelSFTP, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				db.DB.Where("user_id = ?", tt.userID).Delete(&models.ServerGrant{})
+				t.Cleanup(func() {
+					dbtest.Create(t, &models.ServerGrant{ServerID: serverID, UserID: tt.userID, GrantedBy: owner})
+				})
+			}
+
+			r := httptest.NewRequest("GET", "/ws/sftp?ticket="+value+tt.query, nil)
+			_, ticket, err := ServerFromTicket(r, tt.channel)
+			got := http.StatusOK
+			if err != nil {
+				got = StatusCode(err)
+			}
+			if got != tt.want {
+				t.Fatalf("status = %d (%v), want %d", got, err, tt.want)
+			}
+			if err == nil && ticket.UserID != tt.userID {
+				t.Fatalf("ticket user = %d, want %d", ticket.UserID, tt.userID)
+			}
+
+			// Tickets are single-use whatever the outcome
+			if _, _, err := ServerFromTicket(r, tt.channel); !errors.Is(err, auth.ErrInvalidTicket) {
+				t.Fatalf("second redemption: err = %v, want ErrInvalidTicket", err)
+			}
+		})
+	}
+}
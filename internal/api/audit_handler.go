@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+)
+
+// GetAuditEvents lists, newest first, the audit events of the caller and of
+// anyone acting on the caller's servers. Filter with server_id and action;
+// limit defaults to 100.
+func GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	owned := db.DB.Model(&models.Server{}).Select("id").Where("user_id = ?", uint(userID))
+	query := db.DB.Where("(user_id = ? OR server_id IN (?))", uint(userID), owned)
+	if serverID := r.URL.Query().Get("server_id"); serverID != "" {
+		query = query.Where("server_id = ?", serverID)
+	}
+	if action := r.URL.Query().Get("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+
+	events := []models.AuditEvent{}
+	if err := query.Order("created_at DESC").Limit(limit).Find(&events).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
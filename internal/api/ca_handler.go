@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/keys"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshca"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// validateCertTTL checks a certificate lifetime in seconds, with 0 meaning
+// the default.
+func validateCertTTL(seconds int) (int, error) {
+	if seconds == 0 {
+		return int(sshca.DefaultTTL / time.Second), nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl < sshca.MinTTL || ttl > sshca.MaxTTL {
+		return 0, fmt.Errorf("cert_ttl must be between %d and %d seconds", int(sshca.MinTTL/time.Second), int(sshca.MaxTTL/time.Second))
+	}
+	return seconds, nil
+}
+
+// sealCASecrets encrypts the private key and passphrase of the saved CA and
+// stores them.
+func sealCASecrets(ctx context.Context, tx *gorm.DB, ca *models.CertificateAuthority, secret, passphrase string) error {
+	encryptedSecret, err := passvault.EncryptSecret(ctx, secret, sshca.Binding(ca, crypto.FieldCASecret))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt CA key: %w", err)
+	}
+
+	var encryptedPassphrase string
+	if passphrase != "" {
+		encryptedPassphrase, err = passvault.EncryptSecret(ctx, passphrase, sshca.Binding(ca, crypto.FieldCAPassphrase))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt passphrase: %w", err)
+		}
+	}
+
+	ca.EncryptedSecret = encryptedSecret
+	ca.EncryptedPassphrase = encryptedPassphrase
+	return tx.Model(ca).UpdateColumns(map[string]interface{}{
+		"encrypted_secret":     encryptedSecret,
+		"encrypted_passphrase": encryptedPassphrase,
+	}).Error
+}
+
+// findOwnedCA loads certificate authority id if userID owns it. On failure
+// it writes the error response and returns false.
+func findOwnedCA(w http.ResponseWriter, userID uint, id interface{}) (*models.CertificateAuthority, bool) {
+	var ca models.CertificateAuthority
+	if err := db.DB.Where("id = ? AND user_id = ?", id, userID).First(&ca).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Certificate authority not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &ca, true
+}
+
+func GetCAs(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var cas []models.CertificateAuthority
+	if err := db.DB.Where("user_id = ?", uint(userID)).Order("name").Find(&cas).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cas)
+}
+
+// CreateCA generates a CA key, or imports one when private_key is given.
+// The public key in the response goes in TrustedUserCAKeys on servers.
+func CreateCA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		Name       string `json:"name"`
+		Type       string `json:"type"`        // Generated keys: "ed25519" (default) or "rsa"
+		Bits       int    `json:"bits"`        // RSA only: 2048, 3072 (default) or 4096
+		PrivateKey string `json:"private_key"` // Import an existing CA key instead
+		Passphrase string `json:"passphrase"`  // For an encrypted imported key
+		CertTTL    int    `json:"cert_ttl"`    // Seconds; defaults to 300
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	certTTL, err := validateCertTTL(req.CertTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	privateKey, passphrase := req.PrivateKey, req.Passphrase
+	if privateKey == "" {
+		if privateKey, _, err = generateKey(req.Type, req.Bits, req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		passphrase = ""
+	}
+
+	signer, err := keys.ParseSigner([]byte(privateKey), []byte(passphrase))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid private key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := signer.PublicKey().(*ssh.Certificate); ok {
+		http.Error(w, "A CA key cannot be a certificate", http.StatusBadRequest)
+		return
+	}
+
+	ca := models.CertificateAuthority{
+		UserID:      uint(userID),
+		Name:        req.Name,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		CertTTL:     certTTL,
+	}
+
+	// Secrets are bound to the CA ID, so they are sealed once the row exists
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&ca).Error; err != nil {
+			return err
+		}
+		return sealCASecrets(r.Context(), tx, &ca, privateKey, passphrase)
+	}); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ca)
+}
+
+// UpdateCA renames a CA or changes the lifetime of the certificates it
+// issues. The key itself can't be replaced; create a new CA to rotate.
+func UpdateCA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	ca, ok := findOwnedCA(w, uint(userID), r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		CertTTL int    `json:"cert_ttl"` // Omit to keep
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != "" {
+		ca.Name = req.Name
+	}
+	if req.CertTTL != 0 {
+		certTTL, err := validateCertTTL(req.CertTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.CertTTL = certTTL
+	}
+
+	if err := db.DB.Model(ca).Updates(map[string]interface{}{
+		"name":     ca.Name,
+		"cert_ttl": ca.CertTTL,
+	}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ca)
+}
+
+// DeleteCA deletes a CA no server uses. Certificates it already issued stay
+// valid until they expire.
+func DeleteCA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	ca, ok := findOwnedCA(w, uint(userID), r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	var inUse int64
+	if err := db.DB.Model(&models.Server{}).Where("ca_id = ?", ca.ID).Count(&inUse).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if inUse > 0 {
+		http.Error(w, fmt.Sprintf("Certificate authority is used by %d servers", inUse), http.StatusConflict)
+		return
+	}
+
+	if err := db.DB.Delete(ca).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
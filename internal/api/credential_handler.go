@@ -0,0 +1,355 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/keys"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// validateCredential checks a credential's secret material and returns the
+// public key it authenticates with, if any.
+func validateCredential(credType, secret, passphrase, certificate string) (string, error) {
+	var signer ssh.Signer
+	var err error
+	switch credType {
+	case "password":
+		return "", nil
+	case "key":
+		if signer, err = keys.ParseSigner([]byte(secret), []byte(passphrase)); err != nil {
+			return "", fmt.Errorf("invalid private key: %v", err)
+		}
+	case "certificate":
+		if signer, err = keys.ParseCertSigner([]byte(secret), []byte(passphrase), []byte(certificate)); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("invalid credential type %q", credType)
+	}
+
+	pub := signer.PublicKey()
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), nil
+}
+
+// credentialBinding ties an encrypted column to cred.
+func credentialBinding(cred *models.Credential, field string) crypto.Binding {
+	return crypto.Binding{UserID: cred.UserID, RecordID: cred.ID, Field: field}
+}
+
+// sealCredentialSecrets encrypts secret and passphrase for the saved
+// credential and stores them. An empty passphrase clears the stored one.
+func sealCredentialSecrets(ctx context.Context, tx *gorm.DB, cred *models.Credential, secret, passphrase string) error {
+	encryptedSecret, err := passvault.EncryptSecret(ctx, secret, credentialBinding(cred, crypto.FieldCredentialSecret))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+
+	var encryptedPassphrase string
+	if passphrase != "" {
+		encryptedPassphrase, err = passvault.EncryptSecret(ctx, passphrase, credentialBinding(cred, crypto.FieldCredentialPassphrase))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt passphrase: %w", err)
+		}
+	}
+
+	cred.EncryptedSecret = encryptedSecret
+	cred.EncryptedPassphrase = encryptedPassphrase
+	cred.HasPassphrase = encryptedPassphrase != ""
+	return tx.Model(cred).UpdateColumns(map[string]interface{}{
+		"encrypted_secret":     encryptedSecret,
+		"encrypted_passphrase": encryptedPassphrase,
+	}).Error
+}
+
+// createCredential inserts cred with its secret and passphrase. Secrets are
+// bound to the credential ID, so they are sealed once the row exists.
+func createCredential(ctx context.Context, cred *models.Credential, secret, passphrase string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(cred).Error; err != nil {
+			return err
+		}
+		return sealCredentialSecrets(ctx, tx, cred, secret, passphrase)
+	})
+}
+
+// findOwnedCredential loads credential id if userID owns it. On failure it
+// writes the error response and returns false.
+func findOwnedCredential(w http.ResponseWriter, userID uint, id interface{}) (*models.Credential, bool) {
+	var cred models.Credential
+	if err := db.DB.Where("id = ? AND user_id = ?", id, userID).First(&cred).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Credential not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	cred.HasPassphrase = cred.EncryptedPassphrase != ""
+	return &cred, true
+}
+
+func GetCredentials(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var creds []models.Credential
+	if err := db.DB.Where("user_id = ?", uint(userID)).Order("name").Find(&creds).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range creds {
+		creds[i].HasPassphrase = creds[i].EncryptedPassphrase != ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creds)
+}
+
+func CreateCredential(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		Name        string `json:"name"`
+		Type        string `json:"type"`        // "password", "key" or "certificate"
+		Secret      string `json:"secret"`      // Password or private key
+		Passphrase  string `json:"passphrase"`  // For encrypted private keys
+		Certificate string `json:"certificate"` // For "certificate", signed for the key
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	publicKey, err := validateCredential(req.Type, req.Secret, req.Passphrase, req.Certificate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cred := models.Credential{
+		UserID:    uint(userID),
+		Name:      req.Name,
+		Type:      req.Type,
+		PublicKey: publicKey,
+	}
+	if req.Type == "certificate" {
+		cred.Certificate = strings.TrimSpace(req.Certificate)
+	}
+	passphrase := req.Passphrase
+	if req.Type == "password" {
+		passphrase = ""
+	}
+
+	if err := createCredential(r.Context(), &cred, req.Secret, passphrase); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cred)
+}
+
+// UpdateCredential renames a credential or replaces its secret material.
+// Every server using it picks up the change on its next connection.
+func UpdateCredential(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	cred, ok := findOwnedCredential(w, uint(userID), r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Type string `json:"type"` // Omit to keep; changing it needs a new secret
+
+		// Omit to keep the current value; a new secret without a
+		// passphrase clears the stored passphrase
+		Secret      string `json:"secret"`
+		Passphrase  string `json:"passphrase"`
+		Certificate string `json:"certificate"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != "" {
+		cred.Name = req.Name
+	}
+	if req.Type != "" && req.Type != cred.Type {
+		if req.Secret == "" {
+			http.Error(w, "A new secret is required to change the credential type", http.StatusBadRequest)
+			return
+		}
+		if req.Type == "password" {
+			var granted int64
+			if err := db.DB.Model(&models.CredentialGrant{}).Where("credential_id = ?", cred.ID).Count(&granted).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if granted > 0 {
+				http.Error(w, fmt.Sprintf("Credential is granted to %d users; password credentials cannot be granted", granted), http.StatusConflict)
+				return
+			}
+			var forwarded int64
+			if err := db.DB.Model(&models.ForwardedKey{}).Where("credential_id = ?", cred.ID).Count(&forwarded).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if forwarded > 0 {
+				http.Error(w, fmt.Sprintf("Credential is forwarded as an agent key to %d servers", forwarded), http.StatusConflict)
+				return
+			}
+		}
+		cred.Type = req.Type
+	}
+
+	if req.Secret == "" && req.Passphrase == "" && req.Certificate == "" {
+		if err := db.DB.Model(cred).Update("name", cred.Name).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cred)
+		return
+	}
+
+	// Validate against the stored secret and passphrase where the request
+	// leaves them unchanged
+	secret, passphrase, certificate := req.Secret, req.Passphrase, req.Certificate
+	var err error
+	if secret == "" {
+		if secret, err = passvault.DecryptSecret(r.Context(), cred.EncryptedSecret, credentialBinding(cred, crypto.FieldCredentialSecret)); err != nil {
+			writeSecretError(w, err, "Failed to decrypt secret")
+			return
+		}
+	}
+	if passphrase == "" && req.Secret == "" && cred.EncryptedPassphrase != "" {
+		if passphrase, err = passvault.DecryptSecret(r.Context(), cred.EncryptedPassphrase, credentialBinding(cred, crypto.FieldCredentialPassphrase)); err != nil {
+			writeSecretError(w, err, "Failed to decrypt passphrase")
+			return
+		}
+	}
+	if certificate == "" {
+		certificate = cred.Certificate
+	}
+
+	publicKey, err := validateCredential(cred.Type, secret, passphrase, certificate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cred.PublicKey = publicKey
+	cred.Certificate = ""
+	if cred.Type == "certificate" {
+		cred.Certificate = strings.TrimSpace(certificate)
+	}
+	if cred.Type == "password" {
+		passphrase = ""
+	}
+
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(cred).Updates(map[string]interface{}{
+			"name":        cred.Name,
+			"type":        cred.Type,
+			"certificate": cred.Certificate,
+			"public_key":  cred.PublicKey,
+		}).Error; err != nil {
+			return err
+		}
+		return sealCredentialSecrets(r.Context(), tx, cred, secret, passphrase)
+	}); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+	sshconn.EvictCredential(cred.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cred)
+}
+
+// DeleteCredential deletes a credential no server uses, either to log in or
+// as a forwarded agent key, along with its grants.
+func DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	cred, ok := findOwnedCredential(w, uint(userID), r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	var inUse int64
+	forwarded := db.DB.Model(&models.ForwardedKey{}).Select("server_id").Where("credential_id = ?", cred.ID)
+	if err := db.DB.Model(&models.Server{}).Where("credential_id = ? OR id IN (?)", cred.ID, forwarded).Count(&inUse).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if inUse > 0 {
+		http.Error(w, fmt.Sprintf("Credential is used by %d servers", inUse), http.StatusConflict)
+		return
+	}
+
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("credential_id = ?", cred.ID).Delete(&models.CredentialGrant{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(cred).Error
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCredentialUsage lists the servers that use a credential, to log in or
+// as a forwarded agent key.
+func GetCredentialUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	cred, ok := findOwnedCredential(w, uint(userID), r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	type usage struct {
+		ID       uint   `json:"id"`
+		Name     string `json:"name"`
+		Host     string `json:"host"`
+		Username string `json:"username"`
+	}
+	servers := []usage{}
+	forwarded := db.DB.Model(&models.ForwardedKey{}).Select("server_id").Where("credential_id = ?", cred.ID)
+	if err := db.DB.Model(&models.Server{}).
+		Select("id, name, host, username").
+		Where("credential_id = ? OR id IN (?)", cred.ID, forwarded).
+		Order("name").
+		Scan(&servers).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
@@ -7,6 +7,8 @@ import (
 
 	"web-ssh-backend/internal/db"
 	"web-ssh-backend/internal/models"
+
+	"gorm.io/gorm"
 )
 
 func GetFolders(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +29,8 @@ func CreateFolder(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(float64)
 
 	var req struct {
-		Name string `json:"name"`
+		Name           string `json:"name"`
+		RecordSessions bool   `json:"record_sessions"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -36,8 +39,9 @@ func CreateFolder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	folder := models.Folder{
-		UserID: uint(userID),
-		Name:   req.Name,
+		UserID:         uint(userID),
+		Name:           req.Name,
+		RecordSessions: req.RecordSessions,
 	}
 
 	if err := db.DB.Create(&folder).Error; err != nil {
@@ -49,6 +53,42 @@ func CreateFolder(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(folder)
 }
 
+func UpdateFolder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+	folderID := r.URL.Query().Get("id")
+
+	var folder models.Folder
+	if err := db.DB.Where("id = ? AND user_id = ?", folderID, uint(userID)).First(&folder).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var req struct {
+		Name           string `json:"name"`
+		RecordSessions bool   `json:"record_sessions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	folder.Name = req.Name
+	folder.RecordSessions = req.RecordSessions
+
+	if err := db.DB.Save(&folder).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
 func DeleteFolder(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(float64)
 	folderIDStr := r.URL.Query().Get("id")
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/sshconn"
+
+	"gorm.io/gorm"
+)
+
+// GetServerGrants lists the users that have been granted access to a server
+// owned by the caller.
+func GetServerGrants(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+	serverID := r.URL.Query().Get("server_id")
+
+	var server models.Server
+	if err := db.DB.Where("id = ? AND user_id = ?", serverID, uint(userID)).First(&server).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Server not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var grants []models.ServerGrant
+	if err := db.DB.Where("server_id = ?", server.ID).Find(&grants).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// CreateServerGrant gives another user, identified by email, access to a
+// server owned by the caller.
+func CreateServerGrant(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		ServerID uint   `json:"server_id"`
+		Email    string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var server models.Server
+	if err := db.DB.Where("id = ? AND user_id = ?", req.ServerID, uint(userID)).First(&server).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Server not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var grantee models.User
+	if err := db.DB.Where("email = ?", req.Email).First(&grantee).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if grantee.ID == server.UserID {
+		http.Error(w, "Cannot grant access to the server owner", http.StatusBadRequest)
+		return
+	}
+
+	grant := models.ServerGrant{
+		ServerID:  server.ID,
+		UserID:    grantee.ID,
+		GrantedBy: uint(userID),
+	}
+
+	if err := db.DB.Where(models.ServerGrant{ServerID: grant.ServerID, UserID: grant.UserID}).FirstOrCreate(&grant).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grant)
+}
+
+// DeleteServerGrant revokes a grant on a server owned by the caller.
+func DeleteServerGrant(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+	grantIDStr := r.URL.Query().Get("id")
+
+	grantID, err := strconv.Atoi(grantIDStr)
+	if err != nil {
+		http.Error(w, "Invalid grant ID", http.StatusBadRequest)
+		return
+	}
+
+	owned := db.DB.Model(&models.Server{}).Select("id").Where("user_id = ?", uint(userID))
+	if err := db.DB.Where("id = ? AND server_id IN (?)", grantID, owned).Delete(&models.ServerGrant{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSharedServers lists servers other users have granted the caller access to.
+func GetSharedServers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	granted := db.DB.Model(&models.ServerGrant{}).Select("server_id").Where("user_id = ?", uint(userID))
+
+	var servers []models.Server
+	if err := db.DB.Where("id IN (?)", granted).Find(&servers).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := loadServerLinks(servers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
+
+// GetCredentialGrants lists the users that have been granted a credential
+// owned by the caller.
+func GetCredentialGrants(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	cred, ok := findOwnedCredential(w, uint(userID), r.URL.Query().Get("credential_id"))
+	if !ok {
+		return
+	}
+
+	var grants []models.CredentialGrant
+	if err := db.DB.Where("credential_id = ?", cred.ID).Find(&grants).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// CreateCredentialGrant lets another user, identified by email, log in with
+// a key or certificate credential owned by the caller from their own
+// servers.
+func CreateCredentialGrant(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		CredentialID uint   `json:"credential_id"`
+		Email        string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cred, ok := findOwnedCredential(w, uint(userID), req.CredentialID)
+	if !ok {
+		return
+	}
+
+	var grantee models.User
+	if err := db.DB.Where("email = ?", req.Email).First(&grantee).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if grantee.ID == cred.UserID {
+		http.Error(w, "Cannot grant a credential to its owner", http.StatusBadRequest)
+		return
+	}
+	if cred.Type == "password" {
+		// Any host the grantee logs in to would receive the password
+		http.Error(w, "Password credentials cannot be granted", http.StatusBadRequest)
+		return
+	}
+
+	grant := models.CredentialGrant{
+		CredentialID: cred.ID,
+		UserID:       grantee.ID,
+		GrantedBy:    uint(userID),
+	}
+
+	if err := db.DB.Where(models.CredentialGrant{CredentialID: grant.CredentialID, UserID: grant.UserID}).FirstOrCreate(&grant).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grant)
+}
+
+// DeleteCredentialGrant revokes a grant on a credential owned by the caller.
+// The grantee's servers that log in with it stop connecting.
+func DeleteCredentialGrant(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+	grantIDStr := r.URL.Query().Get("id")
+
+	grantID, err := strconv.Atoi(grantIDStr)
+	if err != nil {
+		http.Error(w, "Invalid grant ID", http.StatusBadRequest)
+		return
+	}
+
+	var grant models.CredentialGrant
+	owned := db.DB.Model(&models.Credential{}).Select("id").Where("user_id = ?", uint(userID))
+	if err := db.DB.Where("id = ? AND credential_id IN (?)", grantID, owned).First(&grant).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := db.DB.Delete(&grant).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sshconn.EvictCredential(grant.CredentialID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSharedCredentials lists credentials other users have granted the
+// caller. Secret material is never included.
+func GetSharedCredentials(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	granted := db.DB.Model(&models.CredentialGrant{}).Select("credential_id").Where("user_id = ?", uint(userID))
+
+	var creds []models.Credential
+	if err := db.DB.Where("id IN (?)", granted).Order("name").Find(&creds).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range creds {
+		creds[i].HasPassphrase = creds[i].EncryptedPassphrase != ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(creds)
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/hostkey"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/sshconn"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+type hostKeyResponse struct {
+	ServerID           uint   `json:"server_id"`
+	HostKey            string `json:"host_key"`
+	Fingerprint        string `json:"fingerprint"`
+	PendingHostKey     string `json:"pending_host_key,omitempty"`
+	PendingFingerprint string `json:"pending_fingerprint,omitempty"`
+}
+
+func writeHostKey(w http.ResponseWriter, server models.Server) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hostKeyResponse{
+		ServerID:           server.ID,
+		HostKey:            server.HostKey,
+		Fingerprint:        server.HostKeyFingerprint,
+		PendingHostKey:     server.PendingHostKey,
+		PendingFingerprint: server.PendingHostKeyFingerprint,
+	})
+}
+
+func findOwnedServer(w http.ResponseWriter, userID float64, serverID interface{}) (models.Server, bool) {
+	var server models.Server
+	if err := db.DB.Where("id = ? AND user_id = ?", serverID, uint(userID)).First(&server).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Server not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return server, false
+	}
+	return server, true
+}
+
+// GetHostKey returns the pinned host key of a server and, if the server has
+// since presented a different key, the pending key awaiting review.
+func GetHostKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	server, ok := findOwnedServer(w, userID, r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	writeHostKey(w, server)
+}
+
+// AcceptHostKey replaces the pinned host key with the pending one. The
+// caller must echo the fingerprint it reviewed so a key that changed again
+// in the meantime is not accepted blindly.
+func AcceptHostKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		ID          uint   `json:"id"`
+		Fingerprint string `json:"fingerprint"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server, ok := findOwnedServer(w, userID, req.ID)
+	if !ok {
+		return
+	}
+
+	if server.PendingHostKey == "" {
+		http.Error(w, "No pending host key", http.StatusConflict)
+		return
+	}
+	if req.Fingerprint != server.PendingHostKeyFingerprint {
+		http.Error(w, "Fingerprint does not match pending host key", http.StatusConflict)
+		return
+	}
+
+	server.HostKey = server.PendingHostKey
+	server.HostKeyFingerprint = server.PendingHostKeyFingerprint
+	server.PendingHostKey = ""
+	server.PendingHostKeyFingerprint = ""
+
+	if err := db.DB.Save(&server).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sshconn.EvictServer(server.ID)
+
+	writeHostKey(w, server)
+}
+
+// PinHostKey pins a host key supplied by hand, in authorized_keys format.
+// An empty key clears the pin so the next connection captures it again.
+func PinHostKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		ID      uint   `json:"id"`
+		HostKey string `json:"host_key"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server, ok := findOwnedServer(w, userID, req.ID)
+	if !ok {
+		return
+	}
+
+	server.HostKey = ""
+	server.HostKeyFingerprint = ""
+	if req.HostKey != "" {
+		key, err := hostkey.Parse(req.HostKey)
+		if err != nil {
+			http.Error(w, "Invalid host key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		server.HostKey = hostkey.Encode(key)
+		server.HostKeyFingerprint = ssh.FingerprintSHA256(key)
+	}
+	server.PendingHostKey = ""
+	server.PendingHostKeyFingerprint = ""
+
+	if err := db.DB.Save(&server).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sshconn.EvictServer(server.ID)
+
+	writeHostKey(w, server)
+}
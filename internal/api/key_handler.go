@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// generateKey creates a key pair of keyType and returns the private key in
+// OpenSSH format and the public key in authorized_keys format.
+func generateKey(keyType string, bits int, comment string) (string, string, error) {
+	var priv, pub interface{}
+	switch keyType {
+	case "", "ed25519":
+		p, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		pub, priv = p, k
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits != 2048 && bits != 3072 && bits != 4096 {
+			return "", "", fmt.Errorf("unsupported RSA key size %d", bits)
+		}
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return "", "", err
+		}
+		pub, priv = &k.PublicKey, k
+	default:
+		return "", "", fmt.Errorf("unsupported key type %q", keyType)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", "", err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(block)), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))), nil
+}
+
+// GenerateKey creates a key pair server-side and stores it as a "key"
+// credential. Only the public key is returned.
+func GenerateKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		Name string `json:"name"`
+		Type string `json:"type"` // "ed25519" (default) or "rsa"
+		Bits int    `json:"bits"` // RSA only: 2048, 3072 (default) or 4096
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	privateKey, publicKey, err := generateKey(req.Type, req.Bits, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cred := models.Credential{
+		UserID:    uint(userID),
+		Name:      req.Name,
+		Type:      "key",
+		PublicKey: publicKey,
+	}
+	if err := createCredential(r.Context(), &cred, privateKey, ""); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cred)
+}
+
+// DeployKey installs the public half of a key credential on a server that
+// logs in with a password, checks that the key works, and then switches the
+// server to "key" authentication with its own copy of the key. The stored
+// password is dropped, and later changes to the credential don't affect the
+// server.
+func DeployKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		ServerID     uint `json:"server_id"`
+		CredentialID uint `json:"credential_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server, ok := findOwnedServer(w, userID, req.ServerID)
+	if !ok {
+		return
+	}
+	if server.AuthType != "password" {
+		http.Error(w, "Server does not use password authentication", http.StatusBadRequest)
+		return
+	}
+
+	cred, ok := findOwnedCredential(w, uint(userID), req.CredentialID)
+	if !ok {
+		return
+	}
+	if cred.Type != "key" || cred.PublicKey == "" {
+		http.Error(w, "Credential is not a private key", http.StatusBadRequest)
+		return
+	}
+
+	// 1. Install the key using the current password
+	comment := strings.Join(strings.Fields(cred.Name), " ")
+	if err := installAuthorizedKey(r.Context(), &server, cred.PublicKey+" "+comment); err != nil {
+		sshconn.WriteError(w, err, "Failed to install key")
+		return
+	}
+
+	// 2. Log in with the key alone before committing to it
+	key, err := passvault.DecryptSecret(r.Context(), cred.EncryptedSecret, credentialBinding(cred, crypto.FieldCredentialSecret))
+	if err != nil {
+		writeSecretError(w, err, "Failed to decrypt key")
+		return
+	}
+	var passphrase string
+	if cred.EncryptedPassphrase != "" {
+		if passphrase, err = passvault.DecryptSecret(r.Context(), cred.EncryptedPassphrase, credentialBinding(cred, crypto.FieldCredentialPassphrase)); err != nil {
+			writeSecretError(w, err, "Failed to decrypt passphrase")
+			return
+		}
+	}
+	trial := server
+	trial.AuthType = "key"
+	if err := encryptServerSecrets(r.Context(), &trial, key, passphrase); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+	client, err := sshconn.Dial(r.Context(), &trial, nil)
+	if err != nil {
+		sshconn.WriteError(w, err, "Key was installed but login with it failed")
+		return
+	}
+	client.Close()
+
+	// 3. Switch the server over
+	server.AuthType = trial.AuthType
+	server.EncryptedSecret = trial.EncryptedSecret
+	server.EncryptedPassphrase = trial.EncryptedPassphrase
+	if err := db.DB.Model(&server).Updates(map[string]interface{}{
+		"auth_type":            server.AuthType,
+		"encrypted_secret":     server.EncryptedSecret,
+		"encrypted_passphrase": server.EncryptedPassphrase,
+	}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sshconn.EvictServer(server.ID)
+
+	servers := []models.Server{server}
+	if err := loadServerLinks(servers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers[0])
+}
+
+// installAuthorizedKey appends line to ~/.ssh/authorized_keys on server
+// unless the key is already there, creating the directory with mode 0700
+// and the file with mode 0600.
+func installAuthorizedKey(ctx context.Context, server *models.Server, line string) error {
+	client, err := sshconn.Dial(ctx, server, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	home, err := sftpClient.RealPath(".")
+	if err != nil {
+		return err
+	}
+	dir := path.Join(home, ".ssh")
+	file := path.Join(dir, "authorized_keys")
+
+	if _, err := sftpClient.Stat(dir); os.IsNotExist(err) {
+		if err := sftpClient.Mkdir(dir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := sftpClient.Chmod(dir, 0o700); err != nil {
+		return err
+	}
+
+	f, err := sftpClient.OpenFile(file, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	existing, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// Compare keys only; options and comments may differ, and options may
+	// hold quoted spaces
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return err
+	}
+	present := false
+	for rest := existing; len(rest) > 0; {
+		// Invalid lines are skipped; err means no keys are left
+		k, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			present = true
+			break
+		}
+		rest = next
+	}
+
+	if !present {
+		var buf bytes.Buffer
+		if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line + "\n")
+		if _, err := f.Seek(int64(len(existing)), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return sftpClient.Chmod(file, 0o600)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/sshtest"
+)
+
+func TestInstallAuthorizedKey(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	_, deploy, err := generateKey("ed25519", 0, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := generateKey("ed25519", 0, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the comment generateKey adds
+	deployKey := strings.Join(strings.Fields(deploy)[:2], " ")
+	otherKey := strings.Join(strings.Fields(other)[:2], " ")
+	line := deployKey + " deploy key"
+
+	tests := []struct {
+		name     string
+		existing *string // Nil when there is no .ssh directory
+		want     string
+	}{
+		{"no directory", nil, line + "\n"},
+		{"empty file", ptr(""), line + "\n"},
+		{"other keys", ptr(otherKey + " other\n"), otherKey + " other\n" + line + "\n"},
+		{"no final newline", ptr(otherKey + " other"), otherKey + " other\n" + line + "\n"},
+		{"present", ptr(deployKey + " deploy key\n"), deployKey + " deploy key\n"},
+		{"present with another comment", ptr(deployKey + " laptop\n"), deployKey + " laptop\n"},
+		{"present without a comment", ptr(otherKey + "\n" + deployKey + "\n"), otherKey + "\n" + deployKey + "\n"},
+		{
+			"present with quoted options",
+			ptr(`command="echo \"hello world\"",from="10.0.0.1" ` + deployKey + " ci\n"),
+			`command="echo \"hello world\"",from="10.0.0.1" ` + deployKey + " ci\n",
+		},
+		{
+			"commented out",
+			ptr("# " + deployKey + " old\n"),
+			"# " + deployKey + " old\n" + line + "\n",
+		},
+		{
+			"invalid lines",
+			ptr("not a key\n" + otherKey + " other\n"),
+			"not a key\n" + otherKey + " other\n" + line + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := sshtest.Start(t)
+			srv.Home = t.TempDir()
+			server := srv.Record(t, 1, "web")
+			dir := filepath.Join(srv.Home, ".ssh")
+			file := filepath.Join(dir, "authorized_keys")
+			if tt.existing != nil {
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(file, []byte(*tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Installing again changes nothing
+			for i := 0; i < 2; i++ {
+				if err := installAuthorizedKey(context.Background(), server, line); err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.want {
+					t.Fatalf("install %d: authorized_keys = %q, want %q", i+1, got, tt.want)
+				}
+			}
+
+			for path, mode := range map[string]os.FileMode{dir: 0o700, file: 0o600} {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Errorf("%s mode = %v, want %v", filepath.Base(path), info.Mode().Perm(), mode)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployKey(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	user := models.User{GoogleID: "g1", Email: "owner@example.com"}
+	dbtest.Create(t, &user)
+	srv := sshtest.Start(t)
+	srv.Home = t.TempDir()
+	server := srv.Record(t, user.ID, "web")
+
+	// The name becomes the key's comment, on a single line
+	privateKey, publicKey, err := generateKey("ed25519", 0, "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := models.Credential{UserID: user.ID, Name: "ops \"team\"\nlaptop  key", Type: "key", PublicKey: publicKey}
+	dbtest.Create(t, &cred)
+	if err := sealCredentialSecrets(context.Background(), db.DB, &cred, privateKey, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	body := fmt.Sprintf(`{"server_id":%d,"credential_id":%d}`, server.ID, cred.ID)
+	w := httptest.NewRecorder()
+	DeployKey(w, asUser(httptest.NewRequest("POST", "/api/keys/deploy", strings.NewReader(body)), user.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusOK)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.Home, ".ssh", "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cred.PublicKey + ` ops "team" laptop key` + "\n"; string(got) != want {
+		t.Errorf("authorized_keys = %q, want %q", got, want)
+	}
+
+	var stored models.Server
+	if err := db.DB.First(&stored, server.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.AuthType != "key" {
+		t.Errorf("auth_type = %q, want key", stored.AuthType)
+	}
+	secret, err := crypto.Decrypt(stored.EncryptedSecret, crypto.Binding{UserID: user.ID, RecordID: server.ID, Field: crypto.FieldServerSecret})
+	if err != nil || !strings.Contains(secret, "PRIVATE KEY") {
+		t.Errorf("stored secret = %v, want the private key", err)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
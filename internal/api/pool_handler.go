@@ -0,0 +1,17 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"web-ssh-backend/internal/sshconn"
+)
+
+// GetPoolStats reports the SSH connection pool for monitoring: pool-wide
+// counters and the caller's own pooled connections.
+func GetPoolStats(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sshconn.Stats(uint(userID)))
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/recording"
+
+	"gorm.io/gorm"
+)
+
+// visibleRecordings scopes a query to recordings the caller made, plus all
+// recordings of sessions on servers the caller owns.
+func visibleRecordings(userID uint) *gorm.DB {
+	owned := db.DB.Model(&models.Server{}).Select("id").Where("user_id = ?", userID)
+	return db.DB.Where("user_id = ? OR server_id IN (?)", userID, owned)
+}
+
+func GetRecordings(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	query := visibleRecordings(uint(userID))
+	if serverID := r.URL.Query().Get("server_id"); serverID != "" {
+		query = query.Where("server_id = ?", serverID)
+	}
+
+	var recordings []models.SessionRecording
+	if err := query.Order("started_at DESC").Find(&recordings).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// DownloadRecording returns the asciicast file as an attachment.
+func DownloadRecording(w http.ResponseWriter, r *http.Request) {
+	serveRecording(w, r, "attachment")
+}
+
+// StreamRecording serves the asciicast file inline with range support so a
+// player can start before the whole file has been fetched.
+func StreamRecording(w http.ResponseWriter, r *http.Request) {
+	serveRecording(w, r, "inline")
+}
+
+func serveRecording(w http.ResponseWriter, r *http.Request, disposition string) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var rec models.SessionRecording
+	if err := visibleRecordings(uint(userID)).Where("id = ?", r.URL.Query().Get("id")).First(&rec).Error; err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := recording.Open(rec.StorageKey)
+	if err != nil {
+		http.Error(w, "Recording file unavailable", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	name := path.Base(rec.StorageKey)
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, name))
+	http.ServeContent(w, r, name, rec.StartedAt, file)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/recording"
+)
+
+func TestRecordingAccess(t *testing.T) {
+	const (
+		owner    = 1
+		grantee  = 2 // Made the recording on the owner's server
+		stranger = 3
+	)
+	dbtest.Open(t)
+	t.Setenv("RECORDING_STORAGE", "")
+	t.Setenv("RECORDING_DIR", t.TempDir())
+	recording.Init()
+	server := models.Server{UserID: owner, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, &server)
+
+	r, err := recording.Start(grantee, &server, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("hello"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var rec models.SessionRecording
+	if err := db.DB.Last(&rec).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		userID uint
+		want   int
+	}{
+		{"server owner", owner, http.StatusOK},
+		{"recording user", grantee, http.StatusOK},
+		{"stranger", stranger, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, handler := range map[string]http.HandlerFunc{"stream": StreamRecording, "download": DownloadRecording} {
+				w := httptest.NewRecorder()
+				handler(w, asUser(httptest.NewRequest("GET", fmt.Sprintf("/api/recordings/%s?id=%d", name, rec.ID), nil), tt.userID))
+				if w.Code != tt.want {
+					t.Fatalf("%s: status = %d (%s), want %d", name, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+				}
+				if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"hello"`) {
+					t.Errorf("%s: body = %q, want the recording", name, w.Body.String())
+				}
+			}
+
+			w := httptest.NewRecorder()
+			GetRecordings(w, asUser(httptest.NewRequest("GET", "/api/recordings", nil), tt.userID))
+			var list []models.SessionRecording
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			if listed := len(list) == 1 && list[0].ID == rec.ID; listed != (tt.want == http.StatusOK) {
+				t.Errorf("listed recordings = %+v", list)
+			}
+		})
+	}
+}
@@ -1,17 +1,242 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
+	"web-ssh-backend/internal/access"
 	"web-ssh-backend/internal/crypto"
 	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/keys"
 	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/ssh"
+	"web-ssh-backend/internal/sshconn"
 
 	"gorm.io/gorm"
 )
 
+// validateCredentials checks the secret for authType at save time, so that a
+// bad key or passphrase is reported now rather than on the next connect.
+func validateCredentials(authType, secret, passphrase string) error {
+	switch authType {
+	case "password", "agent":
+		return nil
+	case "key":
+		if _, err := keys.ParseSigner([]byte(secret), []byte(passphrase)); err != nil {
+			return fmt.Errorf("invalid private key: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid auth type %q", authType)
+	}
+}
+
+// validateSessionMode checks a server's session mode and the command it
+// runs in "exec" mode.
+func validateSessionMode(mode, command string) error {
+	switch mode {
+	case ssh.ModePTY, ssh.ModeShell:
+		return nil
+	case ssh.ModeExec:
+		if command == "" {
+			return errors.New("a command is required for exec sessions")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid session mode %q", mode)
+	}
+}
+
+// storesSecret reports whether servers using authType keep a secret of
+// their own. Certificates are minted per connection and agent keys stay in
+// the browser.
+func storesSecret(authType string) bool {
+	return authType == "password" || authType == "key"
+}
+
+// validateCredentialRef checks that userID owns or has been granted
+// credential credentialID.
+func validateCredentialRef(userID, credentialID uint) error {
+	if _, err := access.ResolveCredential(userID, credentialID); err != nil {
+		return fmt.Errorf("invalid credential %d: %v", credentialID, err)
+	}
+	return nil
+}
+
+// validateCARef checks that userID owns certificate authority caID, which a
+// server using "certificate" authentication must name.
+func validateCARef(userID uint, caID *uint) error {
+	if caID == nil {
+		return errors.New("ca_id is required for certificate authentication")
+	}
+	var count int64
+	if err := db.DB.Model(&models.CertificateAuthority{}).Where("id = ? AND user_id = ?", *caID, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("invalid certificate authority %d", *caID)
+	}
+	return nil
+}
+
+// maxJumpHosts bounds a server's chain, each hop of which is a nested SSH
+// connection.
+const maxJumpHosts = 8
+
+// validateJumpHosts checks that every hop is a distinct server the user can
+// access, that serverID is not its own jump host and that the chain is at
+// most maxJumpHosts long.
+func validateJumpHosts(userID, serverID uint, hopIDs []uint) error {
+	if len(hopIDs) > maxJumpHosts {
+		return fmt.Errorf("at most %d jump hosts are allowed", maxJumpHosts)
+	}
+	seen := make(map[uint]bool, len(hopIDs))
+	for _, hopID := range hopIDs {
+		if hopID == serverID || seen[hopID] {
+			return fmt.Errorf("invalid jump host %d", hopID)
+		}
+		seen[hopID] = true
+		if _, err := access.ResolveServer(userID, hopID); err != nil {
+			return fmt.Errorf("invalid jump host %d: %v", hopID, err)
+		}
+	}
+	return nil
+}
+
+// replaceJumpHosts stores hopIDs, in dialing order, as the server's chain.
+func replaceJumpHosts(tx *gorm.DB, serverID uint, hopIDs []uint) error {
+	if err := tx.Where("server_id = ?", serverID).Delete(&models.JumpHost{}).Error; err != nil {
+		return err
+	}
+	for i, hopID := range hopIDs {
+		link := models.JumpHost{ServerID: serverID, HopServerID: hopID, Position: i}
+		if err := tx.Create(&link).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAgentKeys checks that userID owns every credential in ids and that
+// each holds a private key. Granted credentials can't be forwarded: the
+// server would get an agent signing with the owner's key for any login.
+func validateAgentKeys(userID uint, ids []uint) error {
+	for _, id := range ids {
+		cred, err := access.ResolveCredential(userID, id)
+		if err != nil || cred.UserID != userID {
+			return fmt.Errorf("invalid agent key %d", id)
+		}
+		if cred.Type != "key" && cred.Type != "certificate" {
+			return fmt.Errorf("agent key %d is not a private key", id)
+		}
+	}
+	return nil
+}
+
+// replaceForwardedKeys stores ids as the keys forwarded to the server.
+func replaceForwardedKeys(tx *gorm.DB, serverID uint, ids []uint) error {
+	if err := tx.Where("server_id = ?", serverID).Delete(&models.ForwardedKey{}).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		link := models.ForwardedKey{ServerID: serverID, CredentialID: id}
+		if err := tx.Create(&link).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverBinding ties an encrypted column to server.
+func serverBinding(server *models.Server, field string) crypto.Binding {
+	return crypto.Binding{UserID: server.UserID, RecordID: server.ID, Field: field}
+}
+
+// sealServerSecrets encrypts secret and passphrase for the saved server and
+// stores them. An empty passphrase clears the stored one.
+func sealServerSecrets(ctx context.Context, tx *gorm.DB, server *models.Server, secret, passphrase string) error {
+	if err := encryptServerSecrets(ctx, server, secret, passphrase); err != nil {
+		return err
+	}
+	return tx.Model(server).UpdateColumns(map[string]interface{}{
+		"encrypted_secret":     server.EncryptedSecret,
+		"encrypted_passphrase": server.EncryptedPassphrase,
+	}).Error
+}
+
+// encryptServerSecrets sets the encrypted secret and passphrase of the saved
+// server without storing them.
+func encryptServerSecrets(ctx context.Context, server *models.Server, secret, passphrase string) error {
+	encryptedSecret, err := passvault.EncryptSecret(ctx, secret, serverBinding(server, crypto.FieldServerSecret))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+
+	var encryptedPassphrase string
+	if passphrase != "" {
+		encryptedPassphrase, err = passvault.EncryptSecret(ctx, passphrase, serverBinding(server, crypto.FieldServerPassphrase))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt passphrase: %w", err)
+		}
+	}
+
+	server.EncryptedSecret = encryptedSecret
+	server.EncryptedPassphrase = encryptedPassphrase
+	return nil
+}
+
+// writeSecretError reports a failure to encrypt or decrypt a server secret,
+// with a structured 423 when the owner's vault is locked.
+func writeSecretError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, passvault.ErrLocked) {
+		passvault.WriteError(w, err)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// loadServerLinks fills in JumpHostIDs and AgentKeyIDs for servers, and
+// flags weak algorithm settings.
+func loadServerLinks(servers []models.Server) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(servers))
+	byID := make(map[uint]*models.Server, len(servers))
+	for i := range servers {
+		ids[i] = servers[i].ID
+		byID[servers[i].ID] = &servers[i]
+		servers[i].JumpHostIDs = []uint{}
+		servers[i].AgentKeyIDs = []uint{}
+		servers[i].WeakAlgorithms = sshconn.WeakAlgorithms(&servers[i])
+	}
+
+	var links []models.JumpHost
+	if err := db.DB.Where("server_id IN ?", ids).Order("position").Find(&links).Error; err != nil {
+		return err
+	}
+	for _, link := range links {
+		server := byID[link.ServerID]
+		server.JumpHostIDs = append(server.JumpHostIDs, link.HopServerID)
+	}
+
+	var forwarded []models.ForwardedKey
+	if err := db.DB.Where("server_id IN ?", ids).Order("id").Find(&forwarded).Error; err != nil {
+		return err
+	}
+	for _, key := range forwarded {
+		server := byID[key.ServerID]
+		server.AgentKeyIDs = append(server.AgentKeyIDs, key.CredentialID)
+	}
+	return nil
+}
+
 func GetServers(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(float64) // JWT claims are float64
 
@@ -21,6 +246,11 @@ func GetServers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := loadServerLinks(servers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(servers)
 }
@@ -36,6 +266,27 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 		AuthType string `json:"auth_type"`
 		Secret   string `json:"secret"` // Password or Key
 		FolderID *uint  `json:"folder_id"`
+
+		Passphrase string `json:"passphrase"` // For encrypted private keys
+
+		RecordSessions bool   `json:"record_sessions"`
+		JumpHostIDs    []uint `json:"jump_host_ids"` // Servers to hop through, in order
+		CredentialID   *uint  `json:"credential_id"` // Use a stored credential instead of an inline secret
+		CAID           *uint  `json:"ca_id"`         // CA signing certificates, for "certificate"
+		ForwardAgent   bool   `json:"forward_agent"`
+		AgentKeyIDs    []uint `json:"agent_key_ids"` // Key credentials to forward
+		TunnelsEnabled bool   `json:"tunnels_enabled"`
+
+		// Algorithm profile, "compatible" if empty, and comma-separated
+		// lists replacing its choices
+		AlgorithmProfile  string `json:"algorithm_profile"`
+		KexAlgorithms     string `json:"kex_algorithms"`
+		Ciphers           string `json:"ciphers"`
+		MACs              string `json:"macs"`
+		HostKeyAlgorithms string `json:"host_key_algorithms"`
+
+		SessionMode string `json:"session_mode"` // "pty" if empty
+		Command     string `json:"command"`      // For "exec"
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -43,27 +294,103 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptedSecret, err := crypto.Encrypt(req.Secret)
-	if err != nil {
-		http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+	if req.CredentialID != nil {
+		if err := validateCredentialRef(uint(userID), *req.CredentialID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.AuthType = "credential"
+	} else if req.AuthType == "certificate" {
+		if err := validateCARef(uint(userID), req.CAID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := validateCredentials(req.AuthType, req.Secret, req.Passphrase); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateJumpHosts(uint(userID), 0, req.JumpHostIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAgentKeys(uint(userID), req.AgentKeyIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	server := models.Server{
-		UserID:          uint(userID),
-		FolderID:        req.FolderID,
-		Name:            req.Name,
-		Host:            req.Host,
-		Port:            req.Port,
-		Username:        req.Username,
-		AuthType:        req.AuthType,
-		EncryptedSecret: encryptedSecret,
+		UserID:         uint(userID),
+		FolderID:       req.FolderID,
+		Name:           req.Name,
+		Host:           req.Host,
+		Port:           req.Port,
+		Username:       req.Username,
+		AuthType:       req.AuthType,
+		RecordSessions: req.RecordSessions,
+		JumpHostIDs:    req.JumpHostIDs,
+		CredentialID:   req.CredentialID,
+		ForwardAgent:   req.ForwardAgent,
+		AgentKeyIDs:    req.AgentKeyIDs,
+		TunnelsEnabled: req.TunnelsEnabled,
+
+		AlgorithmProfile:  req.AlgorithmProfile,
+		KexAlgorithms:     req.KexAlgorithms,
+		Ciphers:           req.Ciphers,
+		MACs:              req.MACs,
+		HostKeyAlgorithms: req.HostKeyAlgorithms,
+
+		SessionMode: req.SessionMode,
+		Command:     req.Command,
+	}
+	if req.AuthType == "certificate" {
+		server.CAID = req.CAID
+	}
+	if server.AlgorithmProfile == "" {
+		server.AlgorithmProfile = sshconn.ProfileCompatible
+	}
+	if _, err := sshconn.ServerAlgorithms(&server); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server.WeakAlgorithms = sshconn.WeakAlgorithms(&server)
+	if server.SessionMode == "" {
+		server.SessionMode = ssh.ModePTY
+	}
+	if err := validateSessionMode(server.SessionMode, server.Command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if err := db.DB.Create(&server).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Secrets are bound to the server ID, so they are sealed once the row
+	// exists
+	passphrase := req.Passphrase
+	if req.AuthType != "key" {
+		passphrase = ""
+	}
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&server).Error; err != nil {
+			return err
+		}
+		if server.CredentialID == nil && storesSecret(server.AuthType) {
+			if err := sealServerSecrets(r.Context(), tx, &server, req.Secret, passphrase); err != nil {
+				return err
+			}
+		}
+		if err := replaceJumpHosts(tx, server.ID, req.JumpHostIDs); err != nil {
+			return err
+		}
+		return replaceForwardedKeys(tx, server.ID, req.AgentKeyIDs)
+	}); err != nil {
+		passvault.WriteError(w, err)
 		return
 	}
+	if server.JumpHostIDs == nil {
+		server.JumpHostIDs = []uint{}
+	}
+	if server.AgentKeyIDs == nil {
+		server.AgentKeyIDs = []uint{}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(server)
@@ -91,6 +418,28 @@ func UpdateServer(w http.ResponseWriter, r *http.Request) {
 		AuthType string `json:"auth_type"`
 		Secret   string `json:"secret"`
 		FolderID *uint  `json:"folder_id"`
+
+		// Passphrase for an encrypted key. Omit to keep the current one;
+		// a new secret without a passphrase clears it.
+		Passphrase string `json:"passphrase"`
+
+		RecordSessions bool    `json:"record_sessions"`
+		JumpHostIDs    *[]uint `json:"jump_host_ids"` // Omit to keep the current chain
+		CredentialID   *uint   `json:"credential_id"` // Null to use the inline secret
+		CAID           *uint   `json:"ca_id"`         // CA signing certificates, for "certificate"
+		ForwardAgent   bool    `json:"forward_agent"`
+		AgentKeyIDs    *[]uint `json:"agent_key_ids"` // Omit to keep the forwarded keys
+		TunnelsEnabled bool    `json:"tunnels_enabled"`
+
+		// Omit to keep the current algorithm settings
+		AlgorithmProfile  *string `json:"algorithm_profile"`
+		KexAlgorithms     *string `json:"kex_algorithms"`
+		Ciphers           *string `json:"ciphers"`
+		MACs              *string `json:"macs"`
+		HostKeyAlgorithms *string `json:"host_key_algorithms"`
+
+		SessionMode *string `json:"session_mode"` // Omit to keep the current mode
+		Command     *string `json:"command"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -98,29 +447,166 @@ func UpdateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate against the stored secret and passphrase where the request
+	// leaves them unchanged
+	if req.CredentialID != nil {
+		if err := validateCredentialRef(uint(userID), *req.CredentialID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.AuthType = "credential"
+	} else if req.AuthType == "certificate" {
+		if err := validateCARef(uint(userID), req.CAID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if req.AuthType != "agent" && (req.Secret != "" || req.Passphrase != "" || req.AuthType != server.AuthType) {
+		if req.Secret == "" && (server.CredentialID != nil || !storesSecret(server.AuthType)) {
+			http.Error(w, "A secret is required when not using a credential", http.StatusBadRequest)
+			return
+		}
+		secret, passphrase := req.Secret, req.Passphrase
+		var err error
+		if secret == "" {
+			if secret, err = passvault.DecryptSecret(r.Context(), server.EncryptedSecret, serverBinding(&server, crypto.FieldServerSecret)); err != nil {
+				writeSecretError(w, err, "Failed to decrypt secret")
+				return
+			}
+		}
+		if passphrase == "" && req.Secret == "" && server.EncryptedPassphrase != "" {
+			if passphrase, err = passvault.DecryptSecret(r.Context(), server.EncryptedPassphrase, serverBinding(&server, crypto.FieldServerPassphrase)); err != nil {
+				writeSecretError(w, err, "Failed to decrypt passphrase")
+				return
+			}
+		}
+		if err := validateCredentials(req.AuthType, secret, passphrase); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.JumpHostIDs != nil {
+		if err := validateJumpHosts(uint(userID), server.ID, *req.JumpHostIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.AgentKeyIDs != nil {
+		if err := validateAgentKeys(uint(userID), *req.AgentKeyIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A different endpoint presents a different key; capture it again on the
+	// next connect
+	if req.Host != server.Host || req.Port != server.Port {
+		server.HostKey = ""
+		server.HostKeyFingerprint = ""
+		server.PendingHostKey = ""
+		server.PendingHostKeyFingerprint = ""
+	}
+
 	server.Name = req.Name
 	server.Host = req.Host
 	server.Port = req.Port
 	server.Username = req.Username
 	server.AuthType = req.AuthType
 	server.FolderID = req.FolderID
+	server.RecordSessions = req.RecordSessions
+	server.ForwardAgent = req.ForwardAgent
+	server.TunnelsEnabled = req.TunnelsEnabled
+	server.CredentialID = req.CredentialID
+	server.CAID = nil
+	if server.AuthType == "certificate" {
+		server.CAID = req.CAID
+	}
+
+	// Algorithm and session settings left out of the request are kept
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{req.AlgorithmProfile, &server.AlgorithmProfile},
+		{req.KexAlgorithms, &server.KexAlgorithms},
+		{req.Ciphers, &server.Ciphers},
+		{req.MACs, &server.MACs},
+		{req.HostKeyAlgorithms, &server.HostKeyAlgorithms},
+		{req.SessionMode, &server.SessionMode},
+		{req.Command, &server.Command},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+	if server.AlgorithmProfile == "" {
+		server.AlgorithmProfile = sshconn.ProfileCompatible
+	}
+	if _, err := sshconn.ServerAlgorithms(&server); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server.SessionMode == "" {
+		server.SessionMode = ssh.ModePTY
+	}
+	if err := validateSessionMode(server.SessionMode, server.Command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if req.Secret != "" {
-		encryptedSecret, err := crypto.Encrypt(req.Secret)
+	if server.CredentialID != nil || !storesSecret(server.AuthType) {
+		// Secrets come from the credential, or aren't stored at all
+		server.EncryptedSecret = ""
+		server.EncryptedPassphrase = ""
+	} else if req.Secret != "" {
+		encryptedSecret, err := passvault.EncryptSecret(r.Context(), req.Secret, serverBinding(&server, crypto.FieldServerSecret))
 		if err != nil {
-			http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+			writeSecretError(w, err, "Failed to encrypt secret")
 			return
 		}
 		server.EncryptedSecret = encryptedSecret
+		server.EncryptedPassphrase = ""
+	}
+
+	if req.Passphrase != "" {
+		encryptedPassphrase, err := passvault.EncryptSecret(r.Context(), req.Passphrase, serverBinding(&server, crypto.FieldServerPassphrase))
+		if err != nil {
+			writeSecretError(w, err, "Failed to encrypt passphrase")
+			return
+		}
+		server.EncryptedPassphrase = encryptedPassphrase
+	}
+	if server.AuthType != "key" {
+		server.EncryptedPassphrase = ""
 	}
 
-	if err := db.DB.Save(&server).Error; err != nil {
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&server).Error; err != nil {
+			return err
+		}
+		if req.JumpHostIDs != nil {
+			if err := replaceJumpHosts(tx, server.ID, *req.JumpHostIDs); err != nil {
+				return err
+			}
+		}
+		if req.AgentKeyIDs != nil {
+			return replaceForwardedKeys(tx, server.ID, *req.AgentKeyIDs)
+		}
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sshconn.EvictServer(server.ID)
+
+	servers := []models.Server{server}
+	if err := loadServerLinks(servers); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(server)
+	json.NewEncoder(w).Encode(servers[0])
 }
 
 func DeleteServer(w http.ResponseWriter, r *http.Request) {
@@ -133,10 +619,22 @@ func DeleteServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.DB.Where("id = ? AND user_id = ?", serverID, uint(userID)).Delete(&models.Server{}).Error; err != nil {
+	// Servers using this one as a jump host keep their link and fail to
+	// connect, rather than silently bypassing the bastion
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND user_id = ?", serverID, uint(userID)).Delete(&models.Server{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		if err := tx.Where("server_id = ?", serverID).Delete(&models.JumpHost{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("server_id = ?", serverID).Delete(&models.ForwardedKey{}).Error
+	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sshconn.EvictServer(uint(serverID))
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+func TestAgentKeysMustBeOwned(t *testing.T) {
+	const (
+		owner   = 1
+		grantee = 2
+	)
+	dbtest.Open(t)
+	key := models.Credential{UserID: owner, Name: "deploy", Type: "key", EncryptedSecret: "sealed"}
+	dbtest.Create(t, &key)
+	dbtest.Create(t, &models.CredentialGrant{CredentialID: key.ID, UserID: grantee, GrantedBy: owner})
+	password := models.Credential{UserID: grantee, Name: "root", Type: "password", EncryptedSecret: "sealed"}
+	dbtest.Create(t, &password)
+
+	tests := []struct {
+		name   string
+		userID uint
+		keyID  uint
+		err    string // Empty when the key may be forwarded
+	}{
+		{"owned key", owner, key.ID, ""},
+		{"granted key", grantee, key.ID, "invalid agent key"},
+		{"password", grantee, password.ID, "is not a private key"},
+		{"missing", owner, key.ID + 100, "invalid agent key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAgentKeys(tt.userID, []uint{tt.keyID})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validateAgentKeys() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("validateAgentKeys() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	// The grantee can't save a server forwarding the owner's key
+	body := fmt.Sprintf(`{"name":"mine","host":"203.0.113.5","port":22,"username":"root","auth_type":"agent","forward_agent":true,"agent_key_ids":[%d]}`, key.ID)
+	r := httptest.NewRequest("POST", "/api/servers", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	CreateServer(w, asUser(r, grantee))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid agent key") {
+		t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusBadRequest)
+	}
+}
+
+func TestValidateJumpHosts(t *testing.T) {
+	const (
+		owner    = 1
+		stranger = 2
+	)
+	dbtest.Open(t)
+	var ids []uint
+	for i := 0; i < maxJumpHosts+2; i++ {
+		server := models.Server{UserID: owner, Name: fmt.Sprintf("hop%d", i), Host: "203.0.113.5", Port: 22, Username: "root", AuthType: "agent"}
+		dbtest.Create(t, &server)
+		ids = append(ids, server.ID)
+	}
+	target, hops := ids[0], ids[1:]
+	other := models.Server{UserID: stranger, Name: "other", Host: "203.0.113.6", Port: 22, Username: "root", AuthType: "agent"}
+	dbtest.Create(t, &other)
+
+	tests := []struct {
+		name string
+		hops []uint
+		err  string // Empty when the chain is valid
+	}{
+		{"none", nil, ""},
+		{"chain", hops[:3], ""},
+		{"longest chain", hops[:maxJumpHosts], ""},
+		{"too long", hops, "at most"},
+		{"itself", []uint{hops[0], target}, "invalid jump host"},
+		{"repeated hop", []uint{hops[0], hops[1], hops[0]}, "invalid jump host"},
+		{"another user's server", []uint{other.ID}, "invalid jump host"},
+		{"missing", []uint{other.ID + 100}, "invalid jump host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJumpHosts(owner, target, tt.hops)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validateJumpHosts() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("validateJumpHosts() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	// Saving a server as its own jump host is refused
+	body := fmt.Sprintf(`{"name":"hop0","host":"203.0.113.5","port":22,"username":"root","auth_type":"agent","jump_host_ids":[%d]}`, target)
+	r := httptest.NewRequest("PUT", fmt.Sprintf("/api/servers?id=%d", target), strings.NewReader(body))
+	w := httptest.NewRecorder()
+	UpdateServer(w, asUser(r, owner))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid jump host") {
+		t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"web-ssh-backend/internal/access"
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/ssh"
+)
+
+// CreateWSTicket issues a short-lived, single-use ticket that authorizes one
+// WebSocket connection to a server the caller can access.
+func CreateWSTicket(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	var req struct {
+		ServerID  uint   `json:"server_id"`
+		Channel   string `json:"channel"`              // "ssh", "sftp", "proxy" or "tunnel"
+		SessionID string `json:"session_id,omitempty"` // Join a terminal session shared with the caller
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.SessionID != "" {
+		serverID, err := ssh.SessionServer(req.SessionID, uint(userID))
+		if err != nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		value, ticket, err := auth.IssueSessionTicket(uint(userID), serverID, req.SessionID)
+		if err != nil {
+			http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+			return
+		}
+		writeTicket(w, value, ticket)
+		return
+	}
+
+	switch req.Channel {
+	case auth.ChannelSSH, auth.ChannelSFTP, auth.ChannelProxy, auth.ChannelTunnel:
+	default:
+		http.Error(w, "Invalid channel", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := access.ResolveServer(uint(userID), req.ServerID); err != nil {
+		access.WriteError(w, err)
+		return
+	}
+
+	// Carry the caller's vault unlock, if any, over to the WebSocket
+	value, ticket, err := auth.IssueTicket(uint(userID), req.ServerID, req.Channel, passvault.TokenFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	writeTicket(w, value, ticket)
+}
+
+func writeTicket(w http.ResponseWriter, value string, ticket auth.Ticket) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     value,
+		"expires_at": ticket.ExpiresAt.Format(time.RFC3339),
+	})
+}
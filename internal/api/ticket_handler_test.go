@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+// asUser authenticates r as userID the way auth.AuthMiddleware does.
+func asUser(r *http.Request, userID uint) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "user_id", float64(userID)))
+}
+
+func TestCreateWSTicketAccess(t *testing.T) {
+	const (
+		owner    = 1
+		grantee  = 2
+		stranger = 3
+		revoked  = 4 // Had a grant that was deleted
+	)
+	dbtest.Open(t)
+	server := models.Server{UserID: owner, Name: "web", Host: "127.0.0.1", Port: 22, Username: "root", AuthType: "agent"}
+	dbtest.Create(t, &server)
+	dbtest.Create(t, &models.ServerGrant{ServerID: server.ID, UserID: grantee, GrantedBy: owner})
+	grant := models.ServerGrant{ServerID: server.ID, UserID: revoked, GrantedBy: owner}
+	dbtest.Create(t, &grant)
+	if err := db.DB.Delete(&grant).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		userID   uint
+		serverID uint
+		channel  string
+		want     int
+	}{
+		{"owner", owner, server.ID, auth.ChannelSSH, http.StatusOK},
+		{"grantee", grantee, server.ID, auth.ChannelSFTP, http.StatusOK},
+		{"stranger", stranger, server.ID, auth.ChannelSSH, http.StatusForbidden},
+		{"deleted grant", revoked, server.ID, auth.ChannelSSH, http.StatusForbidden},
+		{"missing server", owner, server.ID + 100, auth.ChannelSSH, http.StatusNotFound},
+		{"unknown channel", owner, server.ID, "shell", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"server_id":%d,"channel":%q}`, tt.serverID, tt.channel)
+			r := httptest.NewRequest("POST", "/api/ws-ticket", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			CreateWSTicket(w, asUser(r, tt.userID))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
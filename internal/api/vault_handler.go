@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
+)
+
+// GetVaultStatus reports whether the caller uses a vault and whether the
+// request's X-Unlock-Token unlocks it.
+func GetVaultStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	enabled, err := passvault.Enabled(uint(userID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := map[string]interface{}{"enabled": enabled, "unlocked": false}
+	if expiresAt, ok := passvault.Unlocked(r.Context(), uint(userID)); ok {
+		status["unlocked"] = true
+		status["expires_at"] = expiresAt.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// EnableVault moves the caller's server secrets into a vault sealed by the
+// given passphrase, and unlocks it.
+func EnableVault(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	passphrase, ok := decodePassphrase(w, r)
+	if !ok {
+		return
+	}
+
+	token, expiresAt, err := passvault.Enable(uint(userID), passphrase)
+	if err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+	writeUnlock(w, token, expiresAt)
+}
+
+// UnlockVault exchanges the vault passphrase for an unlock token, sent back
+// in the X-Unlock-Token header and in WebSocket ticket requests.
+func UnlockVault(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	passphrase, ok := decodePassphrase(w, r)
+	if !ok {
+		return
+	}
+
+	token, expiresAt, err := passvault.Unlock(uint(userID), passphrase)
+	if err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+	writeUnlock(w, token, expiresAt)
+}
+
+// LockVault revokes all of the caller's unlock tokens. Sessions already
+// connected stay up.
+func LockVault(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	passvault.Lock(uint(userID))
+	// Don't keep reusing connections made with secrets from the vault
+	sshconn.EvictOwner(uint(userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DisableVault moves the caller's server secrets back under the server-side
+// key. It needs the passphrase, not just an unlock token.
+func DisableVault(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(float64)
+
+	passphrase, ok := decodePassphrase(w, r)
+	if !ok {
+		return
+	}
+
+	if err := passvault.Disable(uint(userID), passphrase); err != nil {
+		passvault.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodePassphrase(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if req.Passphrase == "" {
+		http.Error(w, "Passphrase is required", http.StatusBadRequest)
+		return "", false
+	}
+	return req.Passphrase, true
+}
+
+func writeUnlock(w http.ResponseWriter, token string, expiresAt time.Time) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,32 @@
+// Package audit records security-relevant events, such as certificates
+// issued for a connection or connections refused by the egress policy.
+package audit
+
+import (
+	"encoding/json"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+)
+
+// Actions recorded in AuditEvent.Action.
+const (
+	ActionCertificateIssued = "certificate.issued"
+	ActionAgentSign         = "agent.sign"
+	ActionEgressDenied      = "egress.denied"
+)
+
+// Record stores an event taken for userID, optionally against serverID.
+// details is stored as JSON.
+func Record(userID uint, serverID *uint, action string, details interface{}) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	return db.DB.Create(&models.AuditEvent{
+		UserID:   userID,
+		ServerID: serverID,
+		Action:   action,
+		Details:  string(data),
+	}).Error
+}
@@ -178,3 +178,12 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 	})
 }
+
+// UserIDFromContext returns the user ID stored by AuthMiddleware.
+func UserIDFromContext(ctx context.Context) (uint, bool) {
+	userID, ok := ctx.Value("user_id").(float64) // JWT claims are float64
+	if !ok || userID <= 0 {
+		return 0, false
+	}
+	return uint(userID), true
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Channels a ticket can be redeemed on: WebSockets, or a proxy session.
+const (
+	ChannelSSH    = "ssh"
+	ChannelSFTP   = "sftp"
+	ChannelProxy  = "proxy"
+	ChannelTunnel = "tunnel"
+)
+
+// TicketTTL is how long an issued ticket stays redeemable.
+const TicketTTL = 30 * time.Second
+
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// Ticket authorizes a single WebSocket upgrade for one user, server and
+// channel. A ticket with a SessionID joins a terminal session shared by
+// another user.
+type Ticket struct {
+	UserID    uint
+	ServerID  uint
+	SessionID string
+	Channel   string
+	ExpiresAt time.Time
+
+	// UnlockToken unlocks the server owner's credential vault, if they use one
+	UnlockToken string
+}
+
+var (
+	ticketsMu sync.Mutex
+	tickets   = make(map[string]Ticket)
+)
+
+// IssueTicket creates a single-use ticket. The returned value is opaque and
+// safe to pass in a query string. unlockToken, if set, is handed to the
+// connection so it can decrypt credentials kept in a vault.
+func IssueTicket(userID, serverID uint, channel, unlockToken string) (string, Ticket, error) {
+	return issue(Ticket{UserID: userID, ServerID: serverID, Channel: channel, UnlockToken: unlockToken})
+}
+
+// IssueSessionTicket creates a single-use ticket for joining a shared
+// terminal session. The caller is responsible for checking the invitation.
+func IssueSessionTicket(userID, serverID uint, sessionID string) (string, Ticket, error) {
+	return issue(Ticket{UserID: userID, ServerID: serverID, SessionID: sessionID, Channel: ChannelSSH})
+}
+
+func issue(ticket Ticket) (string, Ticket, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Ticket{}, err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+
+	ticket.ExpiresAt = time.Now().Add(TicketTTL)
+
+	ticketsMu.Lock()
+	defer ticketsMu.Unlock()
+
+	// Drop expired tickets so abandoned ones don't accumulate
+	now := time.Now()
+	for k, t := range tickets {
+		if now.After(t.ExpiresAt) {
+			delete(tickets, k)
+		}
+	}
+	tickets[value] = ticket
+
+	return value, ticket, nil
+}
+
+// RedeemTicket consumes a ticket issued for channel. A ticket can only be
+// redeemed once, whether or not the channel matches.
+func RedeemTicket(value, channel string) (Ticket, error) {
+	if value == "" {
+		return Ticket{}, ErrInvalidTicket
+	}
+
+	ticketsMu.Lock()
+	ticket, ok := tickets[value]
+	delete(tickets, value)
+	ticketsMu.Unlock()
+
+	if !ok || ticket.Channel != channel || time.Now().After(ticket.ExpiresAt) {
+		return Ticket{}, ErrInvalidTicket
+	}
+	return ticket, nil
+}
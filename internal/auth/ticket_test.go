@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedeemTicket(t *testing.T) {
+	value, issued, err := IssueTicket(1, 2, ChannelSSH, "unlock-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := time.Until(issued.ExpiresAt); ttl <= 0 || ttl > TicketTTL {
+		t.Fatalf("ticket expires in %v, want within %v", ttl, TicketTTL)
+	}
+
+	ticket, err := RedeemTicket(value, ChannelSSH)
+	if err != nil {
+		t.Fatalf("first redemption: %v", err)
+	}
+	if ticket.UserID != 1 || ticket.ServerID != 2 || ticket.UnlockToken != "unlock-token" {
+		t.Fatalf("redeemed %+v", ticket)
+	}
+
+	if _, err := RedeemTicket(value, ChannelSSH); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("second redemption: err = %v, want ErrInvalidTicket", err)
+	}
+}
+
+func TestRedeemTicketRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		channel string
+		expire  bool
+	}{
+		{"wrong channel", ChannelSFTP, false},
+		{"expired", ChannelSSH, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := IssueTicket(1, 2, ChannelSSH, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expire {
+				ticketsMu.Lock()
+				ticket := tickets[value]
+				ticket.ExpiresAt = time.Now().Add(-time.Second)
+				tickets[value] = ticket
+				ticketsMu.Unlock()
+			}
+
+			if _, err := RedeemTicket(value, tt.channel); !errors.Is(err, ErrInvalidTicket) {
+				t.Fatalf("err = %v, want ErrInvalidTicket", err)
+			}
+			// A failed redemption still uses the ticket up
+			if _, err := RedeemTicket(value, ChannelSSH); !errors.Is(err, ErrInvalidTicket) {
+				t.Fatalf("retry: err = %v, want ErrInvalidTicket", err)
+			}
+		})
+	}
+
+	if _, err := RedeemTicket("", ChannelSSH); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("empty ticket: err = %v, want ErrInvalidTicket", err)
+	}
+	if _, err := RedeemTicket("never-issued", ChannelSSH); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("unknown ticket: err = %v, want ErrInvalidTicket", err)
+	}
+}
+
+func TestIssueDropsExpiredTickets(t *testing.T) {
+	stale, _, err := IssueTicket(1, 2, ChannelSSH, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketsMu.Lock()
+	ticket := tickets[stale]
+	ticket.ExpiresAt = time.Now().Add(-time.Second)
+	tickets[stale] = ticket
+	ticketsMu.Unlock()
+
+	if _, _, err := IssueTicket(1, 2, ChannelSSH, ""); err != nil {
+		t.Fatal(err)
+	}
+	ticketsMu.Lock()
+	_, ok := tickets[stale]
+	ticketsMu.Unlock()
+	if ok {
+		t.Fatal("expired ticket still stored after issuing another")
+	}
+}
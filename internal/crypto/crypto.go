@@ -4,66 +4,352 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Ciphertexts are stored as versioned envelopes:
+//
+//	v3:<provider>:<base64 wrapped data key>:<algorithm>:<base64 nonce>:<base64 ciphertext>
+//
+// Each value is sealed under its own random data key, which the configured
+// KeyProvider wraps, and a Binding is authenticated as additional data.
+// Older formats still decrypt so existing rows keep working until cmd/rekey
+// rewrites them:
+//
+//	v2:<key id>:<algorithm>:<base64 nonce>:<base64 ciphertext>  bound, keyring key
+//	v1:<key id>:<algorithm>:<base64 nonce>:<base64 ciphertext>  unbound, keyring key
+//	<base64 nonce and ciphertext>                               unbound, raw ENCRYPTION_KEY
+//
+// Unbound formats are refused when ENCRYPTION_REQUIRE_BINDING is set.
+// Values in a user's vault are sealed with a key the caller supplies, and
+// only SealWithKey and OpenWithKey handle them:
+//
+//	k1:<base64 nonce>:<base64 ciphertext>
+const (
+	envelopeVersion = "v3"
+	keyringVersion  = "v2"
+	unboundVersion  = "v1"
+	userKeyVersion  = "k1"
+	legacyVersion   = ""
+	algAES256GCM    = "aes-256-gcm"
+)
+
+// Fields that hold encrypted data, used in Binding.Field.
+const (
+	FieldServerSecret         = "servers.encrypted_secret"
+	FieldServerPassphrase     = "servers.encrypted_passphrase"
+	FieldCredentialSecret     = "credentials.encrypted_secret"
+	FieldCredentialPassphrase = "credentials.encrypted_passphrase"
+	FieldCASecret             = "certificate_authorities.encrypted_secret"
+	FieldCAPassphrase         = "certificate_authorities.encrypted_passphrase"
+)
+
+// Binding identifies the record and field a ciphertext belongs to. It is
+// authenticated as GCM additional data, so a ciphertext copied onto another
+// row or column fails to decrypt.
+type Binding struct {
+	UserID   uint
+	RecordID uint
+	Field    string
+}
+
+func (b Binding) additionalData() []byte {
+	return []byte(fmt.Sprintf("user:%d|record:%d|field:%s", b.UserID, b.RecordID, b.Field))
+}
+
+var (
+	ErrUnknownKey       = errors.New("ciphertext was encrypted with an unknown key")
+	ErrInvalidEnvelope  = errors.New("invalid ciphertext envelope")
+	ErrLegacyKeyMissing = errors.New("legacy ciphertext requires ENCRYPTION_KEY")
+	ErrUnbound          = errors.New("ciphertext is not bound to its record; run cmd/rekey")
+	ErrUserKeyRequired  = errors.New("ciphertext is sealed with a user key")
 )
 
-var encryptionKey []byte
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// keyring holds every key that can decrypt, and the one new data is
+// encrypted under.
+type keyring struct {
+	active string
+	keys   map[string][]byte
+	legacy []byte // Raw key for unversioned blobs, if configured
+}
+
+var (
+	ring *keyring
+	// requireBinding rejects v1 and legacy blobs once all rows are migrated.
+	requireBinding bool
+)
 
+// Init configures encryption from the environment. KMS_PROVIDER selects the
+// KeyProvider that wraps data keys, "local" (default) or "vault". The local
+// provider reads its keys from the KMS_KEYSTORE file, or else from:
+//
+//	ENCRYPTION_KEYS    comma-separated id:secret pairs, active and retired
+//	ENCRYPTION_KEY_ID  id of the key new data is encrypted under
+//	ENCRYPTION_KEY     single secret, used as key "default" when
+//	                   ENCRYPTION_KEYS is unset, and to read legacy blobs
+//
+// These variables also keep v1, v2 and legacy ciphertexts, and data keys
+// wrapped under them, readable under any provider or keystore. Secrets should
+// be at least 32 random bytes; each key is derived from its secret with
+// HKDF-SHA256. Set ENCRYPTION_REQUIRE_BINDING=true after running cmd/rekey to
+// refuse ciphertexts not bound to their record.
 func Init() {
-	key := os.Getenv("ENCRYPTION_KEY")
-	if key == "" {
+	keysEnv, legacySecret := os.Getenv("ENCRYPTION_KEYS"), os.Getenv("ENCRYPTION_KEY")
+	name := os.Getenv("KMS_PROVIDER")
+	envBacksProvider := (name == "" || name == "local") && os.Getenv("KMS_KEYSTORE") == ""
+
+	if keysEnv != "" || legacySecret != "" || envBacksProvider {
+		r, err := loadKeyring(keysEnv, os.Getenv("ENCRYPTION_KEY_ID"), legacySecret)
+		if err != nil {
+			log.Fatalf("Invalid encryption key configuration: %v", err)
+		}
+		ring = r
+		providers["local"] = &localProvider{ring: r}
+	}
+
+	p, err := newProvider(name, ring)
+	if err != nil {
+		log.Fatalf("Invalid key provider configuration: %v", err)
+	}
+
+	// Fail at startup rather than on the first save if the provider is unusable
+	dek := make([]byte, 32)
+	wrapped, err := p.WrapKey(dek)
+	if err == nil {
+		_, err = p.UnwrapKey(wrapped)
+	}
+	if err != nil {
+		log.Fatalf("Key provider %s is not usable: %v", p.Name(), err)
+	}
+
+	provider = p
+	providers[p.Name()] = p
+	requireBinding = os.Getenv("ENCRYPTION_REQUIRE_BINDING") == "true"
+}
+
+func loadKeyring(keysEnv, activeID, legacySecret string) (*keyring, error) {
+	r := &keyring{keys: make(map[string][]byte)}
+
+	if legacySecret != "" {
+		// Unversioned blobs used the secret padded or truncated to 32 bytes
+		r.legacy = make([]byte, 32)
+		copy(r.legacy, legacySecret)
+	}
+
+	for _, pair := range strings.Split(keysEnv, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || !keyIDPattern.MatchString(id) || secret == "" {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS entry %q must be id:secret", pair)
+		}
+		if _, dup := r.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		key, err := deriveKey(id, []byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		r.keys[id] = key
+	}
+
+	switch {
+	case len(r.keys) > 0:
+		if activeID == "" {
+			return nil, errors.New("ENCRYPTION_KEY_ID must name the active key in ENCRYPTION_KEYS")
+		}
+	case legacySecret != "":
+		key, err := deriveKey("default", []byte(legacySecret))
+		if err != nil {
+			return nil, err
+		}
+		r.keys["default"] = key
+		if activeID == "" {
+			activeID = "default"
+		}
+	default:
 		fmt.Println("WARNING: ENCRYPTION_KEY not set, using a random key (data will be lost on restart)")
-		encryptionKey = make([]byte, 32)
-		rand.Read(encryptionKey)
-	} else {
-		// Ensure key is 32 bytes (256 bits)
-		if len(key) != 32 {
-			// In a real app, handle this better (e.g., hash the key)
-			// For now, we assume the user provides a 32-byte key or we pad/truncate
-			k := make([]byte, 32)
-			copy(k, []byte(key))
-			encryptionKey = k
-		} else {
-			encryptionKey = []byte(key)
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
 		}
+		r.keys["ephemeral"] = key
+		activeID = "ephemeral"
+	}
+
+	if _, ok := r.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q is not configured", activeID)
 	}
+	r.active = activeID
+	return r, nil
 }
 
-func Encrypt(text string) (string, error) {
-	c, err := aes.NewCipher(encryptionKey)
+func deriveKey(id string, secret []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("web-ssh-backend encryption key "+id))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return cipher.NewGCM(c)
+}
 
-	gcm, err := cipher.NewGCM(c)
+// Encrypt seals text under a fresh data key, bound to b, and stores the
+// data key wrapped by the configured provider alongside it.
+func Encrypt(text string, b Binding) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	wrapped, err := provider.WrapKey(dek)
 	if err != nil {
 		return "", err
 	}
 
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(text), nil)), nil
+	sealed := gcm.Seal(nil, nonce, []byte(text), b.additionalData())
+	return strings.Join([]string{
+		envelopeVersion,
+		provider.Name(),
+		base64.StdEncoding.EncodeToString([]byte(wrapped)),
+		algAES256GCM,
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(sealed),
+	}, ":"), nil
 }
 
-func Decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+// Decrypt opens a ciphertext produced by Encrypt for b, or by an earlier
+// version of it. Unbound v1 and legacy blobs are accepted unless
+// ENCRYPTION_REQUIRE_BINDING is set.
+func Decrypt(ciphertext string, b Binding) (string, error) {
+	version := envelopeVersionOf(ciphertext)
+	if requireBinding && (version == unboundVersion || version == legacyVersion) {
+		return "", ErrUnbound
+	}
+
+	switch version {
+	case userKeyVersion:
+		return "", ErrUserKeyRequired
+
+	case envelopeVersion:
+		parts := strings.Split(ciphertext, ":")
+		if len(parts) != 6 || parts[3] != algAES256GCM {
+			return "", ErrInvalidEnvelope
+		}
+		p, err := lookupProvider(parts[1])
+		if err != nil {
+			return "", err
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", ErrInvalidEnvelope
+		}
+		dek, err := p.UnwrapKey(string(wrapped))
+		if err != nil {
+			return "", err
+		}
+		return open(dek, parts[4], parts[5], b.additionalData())
+
+	case keyringVersion, unboundVersion:
+		parts := strings.Split(ciphertext, ":")
+		if len(parts) != 5 || parts[2] != algAES256GCM {
+			return "", ErrInvalidEnvelope
+		}
+		var key []byte
+		if ring != nil {
+			key = ring.keys[parts[1]]
+		}
+		if key == nil {
+			return "", fmt.Errorf("%w: %s", ErrUnknownKey, parts[1])
+		}
+		var additionalData []byte
+		if version == keyringVersion {
+			additionalData = b.additionalData()
+		}
+		return open(key, parts[3], parts[4], additionalData)
+
+	default:
+		return decryptLegacy(ciphertext)
+	}
+}
+
+// open decrypts the base64 nonce and ciphertext of an envelope under key.
+func open(key []byte, encodedNonce, encodedSealed string, additionalData []byte) (string, error) {
+	nonce, err := base64.StdEncoding.DecodeString(encodedNonce)
+	if err != nil {
+		return "", ErrInvalidEnvelope
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encodedSealed)
+	if err != nil {
+		return "", ErrInvalidEnvelope
+	}
+
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", ErrInvalidEnvelope
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// envelopeVersionOf returns the envelope version of ciphertext, or
+// legacyVersion for blobs that predate envelopes.
+func envelopeVersionOf(ciphertext string) string {
+	for _, v := range []string{envelopeVersion, keyringVersion, unboundVersion, userKeyVersion} {
+		if strings.HasPrefix(ciphertext, v+":") {
+			return v
+		}
+	}
+	return legacyVersion
+}
 
-	c, err := aes.NewCipher(encryptionKey)
+func decryptLegacy(ciphertext string) (string, error) {
+	if ring == nil || ring.legacy == nil {
+		return "", ErrLegacyKeyMissing
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
 	}
 
-	gcm, err := cipher.NewGCM(c)
+	gcm, err := newGCM(ring.legacy)
 	if err != nil {
 		return "", err
 	}
@@ -81,3 +367,59 @@ func Decrypt(ciphertext string) (string, error) {
 
 	return string(plaintext), nil
 }
+
+// SealWithKey seals text under a 32-byte key held by the caller, bound to b.
+func SealWithKey(key []byte, text string, b Binding) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nil, nonce, []byte(text), b.additionalData())
+	return strings.Join([]string{
+		userKeyVersion,
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(sealed),
+	}, ":"), nil
+}
+
+// OpenWithKey opens a ciphertext produced by SealWithKey for b.
+func OpenWithKey(key []byte, ciphertext string, b Binding) (string, error) {
+	parts := strings.Split(ciphertext, ":")
+	if len(parts) != 3 || parts[0] != userKeyVersion {
+		return "", ErrInvalidEnvelope
+	}
+	return open(key, parts[1], parts[2], b.additionalData())
+}
+
+// IsKeySealed reports whether ciphertext was produced by SealWithKey.
+func IsKeySealed(ciphertext string) bool {
+	return envelopeVersionOf(ciphertext) == userKeyVersion
+}
+
+// NeedsRekey reports whether ciphertext is not a current envelope whose data
+// key is wrapped under the active provider's active key. Values sealed with
+// a user key can only be rewritten by their owner and never need it.
+func NeedsRekey(ciphertext string) bool {
+	if ciphertext == "" || IsKeySealed(ciphertext) {
+		return false
+	}
+	if envelopeVersionOf(ciphertext) != envelopeVersion {
+		return true
+	}
+	parts := strings.Split(ciphertext, ":")
+	if len(parts) != 6 || parts[1] != provider.Name() {
+		return true
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	return err != nil || !provider.Current(string(wrapped))
+}
+
+// ActiveKeyID describes the provider and key new data keys are wrapped under.
+func ActiveKeyID() string {
+	return provider.Name() + "/" + provider.KeyID()
+}
@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var configVars = []string{
+	"ENCRYPTION_KEYS", "ENCRYPTION_KEY", "ENCRYPTION_KEY_ID", "ENCRYPTION_REQUIRE_BINDING",
+	"KMS_PROVIDER", "KMS_KEYSTORE",
+	"VAULT_ADDR", "VAULT_TOKEN", "VAULT_TOKEN_FILE", "VAULT_NAMESPACE", "VAULT_TRANSIT_MOUNT", "VAULT_TRANSIT_KEY",
+}
+
+// setup runs Init with only the given configuration, as if the process had
+// just started.
+func setup(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range configVars {
+		t.Setenv(name, env[name])
+	}
+	ring, provider, providers, requireBinding = nil, nil, map[string]KeyProvider{}, false
+	Init()
+}
+
+// sealKeyring builds a v1 or v2 envelope under the keyring key id.
+func sealKeyring(t *testing.T, version, id, text string, b *Binding) string {
+	t.Helper()
+	gcm, err := newGCM(ring.keys[id])
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	var additionalData []byte
+	if b != nil {
+		additionalData = b.additionalData()
+	}
+	sealed := gcm.Seal(nil, nonce, []byte(text), additionalData)
+	return strings.Join([]string{version, id, algAES256GCM,
+		base64.StdEncoding.EncodeToString(nonce), base64.StdEncoding.EncodeToString(sealed)}, ":")
+}
+
+// sealLegacy builds an unversioned blob under the raw ENCRYPTION_KEY.
+func sealLegacy(t *testing.T, text string) string {
+	t.Helper()
+	gcm, err := newGCM(ring.legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(text), nil))
+}
+
+var binding = Binding{UserID: 1, RecordID: 2, Field: FieldServerSecret}
+
+func TestDecryptEnvelopeVersions(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEY": "legacy secret"})
+
+	current, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(current, envelopeVersion+":local:") {
+		t.Fatalf("Encrypt() = %q, want a v3 local envelope", current)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		needsRekey bool
+	}{
+		{"v3", current, false},
+		{"v2", sealKeyring(t, keyringVersion, "default", "hunter2", &binding), true},
+		{"v1", sealKeyring(t, unboundVersion, "default", "hunter2", nil), true},
+		{"legacy", sealLegacy(t, "hunter2"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decrypt(tt.ciphertext, binding)
+			if err != nil || got != "hunter2" {
+				t.Errorf("Decrypt() = %q, %v; want hunter2", got, err)
+			}
+			if NeedsRekey(tt.ciphertext) != tt.needsRekey {
+				t.Errorf("NeedsRekey() = %v, want %v", !tt.needsRekey, tt.needsRekey)
+			}
+		})
+	}
+
+	if NeedsRekey("") {
+		t.Error("NeedsRekey() is true for an empty value")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEYS": "k1:first secret,k2:second secret", "ENCRYPTION_KEY_ID": "k1"})
+	old, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setup(t, map[string]string{"ENCRYPTION_KEYS": "k1:first secret,k2:second secret", "ENCRYPTION_KEY_ID": "k2"})
+	if got, err := Decrypt(old, binding); err != nil || got != "hunter2" {
+		t.Fatalf("Decrypt() under a retired key = %q, %v", got, err)
+	}
+	if !NeedsRekey(old) {
+		t.Error("value under the retired key does not need rekeying")
+	}
+	rekeyed, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NeedsRekey(rekeyed) {
+		t.Error("value under the active key needs rekeying")
+	}
+	if ActiveKeyID() != "local/k2" {
+		t.Errorf("ActiveKeyID() = %q, want local/k2", ActiveKeyID())
+	}
+
+	setup(t, map[string]string{"ENCRYPTION_KEYS": "k2:second secret", "ENCRYPTION_KEY_ID": "k2"})
+	if _, err := Decrypt(old, binding); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt() after removing the key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestDecryptLegacyWithoutKey(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEYS": "k1:first secret", "ENCRYPTION_KEY_ID": "k1"})
+	if _, err := Decrypt("bm90IGEgcmVhbCBibG9i", binding); !errors.Is(err, ErrLegacyKeyMissing) {
+		t.Errorf("Decrypt() = %v, want ErrLegacyKeyMissing", err)
+	}
+}
+
+func TestBinding(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEY": "legacy secret"})
+	sealed, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := sealKeyring(t, keyringVersion, "default", "hunter2", &binding)
+
+	for _, other := range []Binding{
+		{UserID: 9, RecordID: binding.RecordID, Field: binding.Field},
+		{UserID: binding.UserID, RecordID: 9, Field: binding.Field},
+		{UserID: binding.UserID, RecordID: binding.RecordID, Field: FieldServerPassphrase},
+	} {
+		if _, err := Decrypt(sealed, other); err == nil {
+			t.Errorf("v3 value decrypted under %+v", other)
+		}
+		if _, err := Decrypt(bound, other); err == nil {
+			t.Errorf("v2 value decrypted under %+v", other)
+		}
+	}
+}
+
+func TestRequireBinding(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEY": "legacy secret", "ENCRYPTION_REQUIRE_BINDING": "true"})
+	for name, ciphertext := range map[string]string{
+		"v1":     sealKeyring(t, unboundVersion, "default", "hunter2", nil),
+		"legacy": sealLegacy(t, "hunter2"),
+	} {
+		if _, err := Decrypt(ciphertext, binding); !errors.Is(err, ErrUnbound) {
+			t.Errorf("%s: Decrypt() = %v, want ErrUnbound", name, err)
+		}
+	}
+	bound := sealKeyring(t, keyringVersion, "default", "hunter2", &binding)
+	if got, err := Decrypt(bound, binding); err != nil || got != "hunter2" {
+		t.Errorf("v2: Decrypt() = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// wrapAdditionalData keeps a wrapped data key from being opened as anything
+// else sealed under the same key-encryption key.
+var wrapAdditionalData = []byte("web-ssh-backend data key")
+
+// localProvider wraps data keys with AES-256-GCM under keys held in this
+// process. Wrapped keys are "<key id>:<base64 nonce and ciphertext>".
+type localProvider struct {
+	ring *keyring
+}
+
+func (p *localProvider) Name() string  { return "local" }
+func (p *localProvider) KeyID() string { return p.ring.active }
+
+func (p *localProvider) WrapKey(dek []byte) (string, error) {
+	gcm, err := newGCM(p.ring.keys[p.ring.active])
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, dek, wrapAdditionalData)
+	return p.ring.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (p *localProvider) UnwrapKey(wrapped string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return nil, ErrInvalidEnvelope
+	}
+	key, ok := p.ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrInvalidEnvelope
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], wrapAdditionalData)
+}
+
+func (p *localProvider) Current(wrapped string) bool {
+	id, _, _ := strings.Cut(wrapped, ":")
+	return id == p.ring.active
+}
+
+// retire adds other's keys to r for decryption only, so data keys wrapped
+// before moving to a keystore can still be unwrapped. A key id present in
+// both must name the same key.
+func (r *keyring) retire(other *keyring) error {
+	for id, key := range other.keys {
+		if existing, ok := r.keys[id]; ok {
+			if !bytes.Equal(existing, key) {
+				return fmt.Errorf("key id %q is configured with different secrets in KMS_KEYSTORE and ENCRYPTION_KEYS", id)
+			}
+			continue
+		}
+		r.keys[id] = key
+	}
+	return nil
+}
+
+// loadKeystore reads a JSON keystore of the form
+//
+//	{"active": "k2", "keys": {"k1": "<secret>", "k2": "<secret>"}}
+//
+// Keys are derived from the secrets as for ENCRYPTION_KEYS. The file must not
+// be accessible to group or others.
+func loadKeystore(path string) (*keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("keystore %s must not be accessible to group or others (mode %v)", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var store struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("keystore %s: %v", path, err)
+	}
+
+	r := &keyring{keys: make(map[string][]byte)}
+	for id, secret := range store.Keys {
+		if !keyIDPattern.MatchString(id) || secret == "" {
+			return nil, fmt.Errorf("keystore %s: invalid key %q", path, id)
+		}
+		if r.keys[id], err = deriveKey(id, []byte(secret)); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := r.keys[store.Active]; !ok {
+		return nil, errors.New("keystore active key is not configured")
+	}
+	r.active = store.Active
+	return r, nil
+}
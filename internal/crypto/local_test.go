@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKeystore(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeystoreKeepsEnvironmentKeys(t *testing.T) {
+	env := map[string]string{"ENCRYPTION_KEYS": "k1:first secret", "ENCRYPTION_KEY_ID": "k1"}
+	setup(t, env)
+	old, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env["KMS_KEYSTORE"] = writeKeystore(t, `{"active": "k2", "keys": {"k2": "second secret"}}`)
+	setup(t, env)
+	if got, err := Decrypt(old, binding); err != nil || got != "hunter2" {
+		t.Fatalf("Decrypt() of a value wrapped under ENCRYPTION_KEYS = %q, %v", got, err)
+	}
+	if !NeedsRekey(old) {
+		t.Error("value wrapped under ENCRYPTION_KEYS does not need rekeying")
+	}
+	if ActiveKeyID() != "local/k2" {
+		t.Errorf("ActiveKeyID() = %q, want local/k2", ActiveKeyID())
+	}
+}
+
+func TestKeystoreConflictingKey(t *testing.T) {
+	setup(t, map[string]string{"ENCRYPTION_KEYS": "k1:first secret", "ENCRYPTION_KEY_ID": "k1"})
+	envRing := ring
+
+	t.Setenv("KMS_KEYSTORE", writeKeystore(t, `{"active": "k1", "keys": {"k1": "another secret"}}`))
+	if _, err := newProvider("local", envRing); err == nil {
+		t.Error("newProvider() accepted a key id with two different secrets")
+	}
+}
+
+func TestKeystorePermissions(t *testing.T) {
+	path := writeKeystore(t, `{"active": "k1", "keys": {"k1": "first secret"}}`)
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeystore(path); err == nil {
+		t.Error("loadKeystore() accepted a world-readable keystore")
+	}
+}
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// KeyProvider wraps and unwraps the per-record data keys secrets are
+// encrypted under, so the key-encryption key can live outside this process.
+type KeyProvider interface {
+	// Name identifies the provider in stored envelopes.
+	Name() string
+	// KeyID describes the key new data keys are wrapped under, for logs.
+	KeyID() string
+	// WrapKey encrypts a data key. The result is opaque and printable.
+	WrapKey(dek []byte) (string, error)
+	// UnwrapKey recovers a data key wrapped by WrapKey.
+	UnwrapKey(wrapped string) ([]byte, error)
+	// Current reports whether wrapped is under the active key, so cmd/rekey
+	// knows what to rewrap.
+	Current(wrapped string) bool
+}
+
+var ErrUnknownProvider = errors.New("ciphertext was wrapped by an unconfigured key provider")
+
+var (
+	provider KeyProvider
+	// providers holds every provider that can unwrap, by name; the local
+	// keyring stays available so data can move to another provider.
+	providers = map[string]KeyProvider{}
+)
+
+// newProvider builds the provider named by KMS_PROVIDER:
+//
+//	local  keys from the KMS_KEYSTORE file, or from ENCRYPTION_KEYS when
+//	       unset; with both, the ENCRYPTION_KEYS keys still unwrap what
+//	       they wrapped
+//	vault  a Vault transit key, see newVaultProvider
+func newProvider(name string, envRing *keyring) (KeyProvider, error) {
+	switch name {
+	case "", "local":
+		if path := os.Getenv("KMS_KEYSTORE"); path != "" {
+			r, err := loadKeystore(path)
+			if err != nil {
+				return nil, err
+			}
+			if envRing != nil {
+				if err := r.retire(envRing); err != nil {
+					return nil, err
+				}
+			}
+			return &localProvider{ring: r}, nil
+		}
+		if envRing == nil {
+			return nil, errors.New("local provider needs KMS_KEYSTORE or ENCRYPTION_KEYS")
+		}
+		return &localProvider{ring: envRing}, nil
+	case "vault":
+		return newVaultProvider()
+	default:
+		return nil, fmt.Errorf("unknown KMS_PROVIDER %q", name)
+	}
+}
+
+func lookupProvider(name string) (KeyProvider, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+	return p, nil
+}
@@ -0,0 +1,135 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultProvider wraps data keys with a Vault transit key, or anything that
+// speaks the same encrypt/decrypt API. Wrapped keys are Vault's own
+// "vault:v<n>:..." ciphertexts.
+type vaultProvider struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	client    *http.Client
+}
+
+// newVaultProvider configures the transit provider from the environment:
+//
+//	VAULT_ADDR           server address, e.g. https://vault.internal:8200
+//	VAULT_TOKEN          token allowed to encrypt and decrypt with the key,
+//	VAULT_TOKEN_FILE     or a file holding it
+//	VAULT_NAMESPACE      optional enterprise namespace
+//	VAULT_TRANSIT_MOUNT  transit mount path (default: transit)
+//	VAULT_TRANSIT_KEY    transit key name (default: web-ssh)
+func newVaultProvider() (*vaultProvider, error) {
+	p := &vaultProvider{
+		addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		mount:     strings.Trim(os.Getenv("VAULT_TRANSIT_MOUNT"), "/"),
+		key:       os.Getenv("VAULT_TRANSIT_KEY"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.addr == "" {
+		return nil, errors.New("VAULT_ADDR is required for the vault provider")
+	}
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p.token = strings.TrimSpace(string(token))
+	}
+	if p.token == "" {
+		return nil, errors.New("VAULT_TOKEN or VAULT_TOKEN_FILE is required for the vault provider")
+	}
+	if p.mount == "" {
+		p.mount = "transit"
+	}
+	if p.key == "" {
+		p.key = "web-ssh"
+	}
+	return p, nil
+}
+
+func (p *vaultProvider) Name() string  { return "vault" }
+func (p *vaultProvider) KeyID() string { return p.mount + "/" + p.key }
+
+func (p *vaultProvider) WrapKey(dek []byte) (string, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}
+	if err := p.call("encrypt", req, &resp); err != nil {
+		return "", err
+	}
+	if resp.Data.Ciphertext == "" {
+		return "", errors.New("vault: empty ciphertext in response")
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+func (p *vaultProvider) UnwrapKey(wrapped string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := p.call("decrypt", map[string]string{"ciphertext": wrapped}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// Current is always true: Vault keeps older key versions able to decrypt,
+// and rotates stored ciphertexts with its own rewrap endpoint.
+func (p *vaultProvider) Current(wrapped string) bool {
+	return true
+}
+
+// call POSTs body to /v1/<mount>/<op>/<key> and decodes the JSON response.
+func (p *vaultProvider) call(op string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", p.addr, p.mount, op, p.key)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %v", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("vault %s: %s: %s", op, resp.Status, strings.Join(failure.Errors, "; "))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
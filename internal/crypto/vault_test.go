@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transit is a stand-in for Vault's transit encrypt and decrypt endpoints.
+// Ciphertexts are opaque handles into a map rather than real encryptions.
+type transit struct {
+	token  string
+	sealed bool
+
+	mu        sync.Mutex
+	plaintext map[string]string
+}
+
+func (v *transit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+	}
+	if v.sealed {
+		fail(http.StatusServiceUnavailable, "Vault is sealed")
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+
+	var req struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var data map[string]string
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/web-ssh":
+		ciphertext := "vault:v1:" + strings.Repeat("x", len(v.plaintext)+1)
+		v.plaintext[ciphertext] = req.Plaintext
+		data = map[string]string{"ciphertext": ciphertext}
+	case "/v1/transit/decrypt/web-ssh":
+		plaintext, ok := v.plaintext[req.Ciphertext]
+		if !ok {
+			fail(http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		data = map[string]string{"plaintext": plaintext}
+	default:
+		fail(http.StatusNotFound, "no handler for route")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func newTransit(t *testing.T) (*transit, map[string]string) {
+	v := &transit{token: "test-token", plaintext: make(map[string]string)}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return v, map[string]string{"KMS_PROVIDER": "vault", "VAULT_ADDR": srv.URL, "VAULT_TOKEN": v.token}
+}
+
+func TestVaultProviderRoundTrip(t *testing.T) {
+	_, env := newTransit(t)
+	env["ENCRYPTION_KEYS"], env["ENCRYPTION_KEY_ID"] = "k1:first secret", "k1"
+	setup(t, env)
+
+	sealed, err := Encrypt("hunter2", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, envelopeVersion+":vault:") {
+		t.Fatalf("Encrypt() = %q, want a v3 vault envelope", sealed)
+	}
+	if got, err := Decrypt(sealed, binding); err != nil || got != "hunter2" {
+		t.Fatalf("Decrypt() = %q, %v; want hunter2", got, err)
+	}
+	if NeedsRekey(sealed) {
+		t.Error("value wrapped by vault needs rekeying")
+	}
+	if ActiveKeyID() != "vault/transit/web-ssh" {
+		t.Errorf("ActiveKeyID() = %q, want vault/transit/web-ssh", ActiveKeyID())
+	}
+
+	// Values wrapped locally before switching providers stay readable
+	local, err := (&localProvider{ring: ring}).WrapKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := providers["local"].UnwrapKey(local); err != nil {
+		t.Errorf("local provider is not available under vault: %v", err)
+	}
+	old := sealKeyring(t, keyringVersion, "k1", "hunter2", &binding)
+	if !NeedsRekey(old) {
+		t.Error("keyring value does not need rekeying under vault")
+	}
+}
+
+func TestVaultProviderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		sealed bool
+		want   string
+	}{
+		{"forbidden", "wrong-token", false, "403 Forbidden: permission denied"},
+		{"sealed", "test-token", true, "503 Service Unavailable: Vault is sealed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, env := newTransit(t)
+			v.sealed = tt.sealed
+			env["VAULT_TOKEN"] = tt.token
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			p, err := newVaultProvider()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.WrapKey(make([]byte, 32)); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("WrapKey() = %v, want an error containing %q", err, tt.want)
+			}
+			if _, err := p.UnwrapKey("vault:v1:x"); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("UnwrapKey() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -27,12 +27,16 @@ func Init() {
 
 	log.Println("Database connection established")
 
-	// Auto Migrate - Order matters! Migrate referenced tables first
-	// Folder must be migrated before Server because Server has a foreign key to Folder
-	err = DB.AutoMigrate(&models.User{}, &models.Folder{}, &models.Server{})
-	if err != nil {
+	if err := Migrate(); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	log.Println("Database migration completed")
 }
+
+// Migrate creates or updates the tables for all models in DB.
+func Migrate() error {
+	// Auto Migrate - Order matters! Migrate referenced tables first
+	// Folder must be migrated before Server because Server has a foreign key to Folder
+	return DB.AutoMigrate(&models.User{}, &models.Folder{}, &models.Server{}, &models.ServerGrant{}, &models.SessionRecording{}, &models.JumpHost{}, &models.ForwardedKey{}, &models.Credential{}, &models.CredentialGrant{}, &models.CertificateAuthority{}, &models.AuditEvent{})
+}
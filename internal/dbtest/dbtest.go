@@ -0,0 +1,48 @@
+// Package dbtest points db.DB at a fresh in-memory database for tests.
+package dbtest
+
+import (
+	"testing"
+
+	"web-ssh-backend/internal/db"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open replaces db.DB with an empty, migrated SQLite database in memory
+// until t ends.
+func Open(t testing.TB) {
+	t.Helper()
+
+	database, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	// Every connection to ":memory:" is a separate database
+	sqlDB.SetMaxOpenConns(1)
+
+	prev := db.DB
+	db.DB = database
+	t.Cleanup(func() {
+		db.DB = prev
+		sqlDB.Close()
+	})
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+}
+
+// Create inserts value, failing t on error.
+func Create(t testing.TB, value interface{}) {
+	t.Helper()
+	if err := db.DB.Create(value).Error; err != nil {
+		t.Fatalf("create %T: %v", value, err)
+	}
+}
@@ -0,0 +1,345 @@
+// Package egress decides which addresses the gateway may open SSH
+// connections to, so that stored servers can't point it at cloud metadata
+// endpoints, its own database or other internal services.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrDenied = errors.New("egress policy denies connection")
+
+// DeniedError reports a destination the policy refuses and the rule that
+// matched.
+type DeniedError struct {
+	Host string
+	Port int
+	Addr string // Resolved address, empty when refused before resolution
+	Rule string
+}
+
+func (e *DeniedError) Error() string {
+	dest := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	if e.Addr != "" && e.Addr != e.Host {
+		dest += " (" + e.Addr + ")"
+	}
+	return fmt.Sprintf("egress policy denies %s: %s", dest, e.Rule)
+}
+
+func (e *DeniedError) Is(target error) bool {
+	return target == ErrDenied
+}
+
+// defaultDenyCIDRs cover loopback, link-local (including the metadata
+// endpoints of most clouds), unspecified and multicast addresses.
+var defaultDenyCIDRs = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"100.100.100.200/32", // Alibaba Cloud metadata
+	"224.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fe80::/10",
+	"fd00:ec2::254/128", // AWS metadata over IPv6
+	"ff00::/8",
+}
+
+// defaultPrivateCIDRs cover private, shared (CGNAT) and unique local
+// addresses, where the database and internal services usually live.
+// Unlike other denied ranges, addresses in EGRESS_ALLOW_CIDRS are exempt.
+var defaultPrivateCIDRs = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct{ lo, hi int }
+
+var (
+	allowCIDRs   []netip.Prefix
+	denyCIDRs    []netip.Prefix
+	privateCIDRs []netip.Prefix // Denied unless allowed
+	allowHosts   []string
+	denyHosts    []string
+	allowPorts   []portRange
+	denyPorts    []portRange
+
+	// The database's hosts and addresses, denied on every port
+	dbHosts map[string]bool
+	dbAddrs map[netip.Addr]bool
+)
+
+// Init reads the policy from comma-separated lists:
+//
+//	EGRESS_ALLOW_CIDRS  if set, resolved addresses must fall in one
+//	EGRESS_DENY_CIDRS   addresses refused; replaces the built-in lists of
+//	                    loopback, link-local, metadata and multicast ranges
+//	                    and of private ranges, "none" to deny nothing by
+//	                    address
+//	EGRESS_ALLOW_HOSTS  if set, server hosts must match one
+//	EGRESS_DENY_HOSTS   server hosts refused
+//	EGRESS_ALLOW_PORTS  if set, ports must be in one, e.g. "22,2200-2299"
+//	EGRESS_DENY_PORTS   ports refused
+//
+// Host patterns match a name exactly, or any subdomain with a leading
+// "*." or ".". Deny rules win over allow rules, except that the built-in
+// private ranges only apply outside EGRESS_ALLOW_CIDRS. The database host
+// from DB_PATH is always denied.
+func Init() {
+	var err error
+	if allowCIDRs, err = parseCIDRs(os.Getenv("EGRESS_ALLOW_CIDRS")); err != nil {
+		log.Fatalf("Invalid EGRESS_ALLOW_CIDRS: %v", err)
+	}
+	privateCIDRs = nil
+	switch v := os.Getenv("EGRESS_DENY_CIDRS"); v {
+	case "":
+		denyCIDRs, err = parseCIDRs(strings.Join(defaultDenyCIDRs, ","))
+		if err == nil {
+			privateCIDRs, err = parseCIDRs(strings.Join(defaultPrivateCIDRs, ","))
+		}
+	case "none":
+		denyCIDRs = nil
+	default:
+		denyCIDRs, err = parseCIDRs(v)
+	}
+	if err != nil {
+		log.Fatalf("Invalid EGRESS_DENY_CIDRS: %v", err)
+	}
+	allowHosts = parseHosts(os.Getenv("EGRESS_ALLOW_HOSTS"))
+	denyHosts = parseHosts(os.Getenv("EGRESS_DENY_HOSTS"))
+	if allowPorts, err = parsePorts(os.Getenv("EGRESS_ALLOW_PORTS")); err != nil {
+		log.Fatalf("Invalid EGRESS_ALLOW_PORTS: %v", err)
+	}
+	if denyPorts, err = parsePorts(os.Getenv("EGRESS_DENY_PORTS")); err != nil {
+		log.Fatalf("Invalid EGRESS_DENY_PORTS: %v", err)
+	}
+
+	denyDatabase(os.Getenv("DB_PATH"))
+}
+
+// denyDatabase denies the hosts in dsn and the addresses they resolve to
+// now.
+func denyDatabase(dsn string) {
+	dbHosts = make(map[string]bool)
+	dbAddrs = make(map[netip.Addr]bool)
+	config, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return
+	}
+
+	hosts := []string{config.Host}
+	for _, fb := range config.Fallbacks {
+		hosts = append(hosts, fb.Host)
+	}
+	for _, host := range hosts {
+		// Unix sockets can't be dialed over TCP anyway
+		if host == "" || strings.HasPrefix(host, "/") {
+			continue
+		}
+		dbHosts[strings.ToLower(host)] = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := resolve(ctx, host)
+		cancel()
+		if err != nil {
+			log.Printf("Egress: cannot resolve database host %s: %v", host, err)
+			continue
+		}
+		for _, addr := range addrs {
+			dbAddrs[addr] = true
+		}
+	}
+}
+
+// Check applies the policy to host and port and returns the addresses a
+// connection may use. A name resolving to any denied address is refused, so
+// callers must dial only the returned addresses.
+func Check(ctx context.Context, host string, port int) ([]netip.Addr, error) {
+	deny := func(addr, rule string) error {
+		return &DeniedError{Host: host, Port: port, Addr: addr, Rule: rule}
+	}
+
+	if inPorts(denyPorts, port) {
+		return nil, deny("", fmt.Sprintf("port %d is denied", port))
+	}
+	if len(allowPorts) > 0 && !inPorts(allowPorts, port) {
+		return nil, deny("", fmt.Sprintf("port %d is not allowed", port))
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if dbHosts[name] {
+		return nil, deny("", "host is the gateway's database")
+	}
+	if pattern := matchHost(denyHosts, name); pattern != "" {
+		return nil, deny("", fmt.Sprintf("host matches denied %q", pattern))
+	}
+	if len(allowHosts) > 0 && matchHost(allowHosts, name) == "" {
+		return nil, deny("", "host is not allowed")
+	}
+
+	addrs, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if dbAddrs[addr] {
+			return nil, deny(addr.String(), "address is the gateway's database")
+		}
+		if prefix, ok := inCIDRs(denyCIDRs, addr); ok {
+			return nil, deny(addr.String(), "address in denied range "+prefix.String())
+		}
+		_, allowed := inCIDRs(allowCIDRs, addr)
+		if prefix, ok := inCIDRs(privateCIDRs, addr); ok && !allowed {
+			return nil, deny(addr.String(), "address in private range "+prefix.String())
+		}
+		if len(allowCIDRs) > 0 && !allowed {
+			return nil, deny(addr.String(), "address is not in an allowed range")
+		}
+	}
+	return addrs, nil
+}
+
+// Dial connects to host:port over TCP with d, once the policy allows it.
+// The checked addresses are dialed directly so a second lookup can't
+// return a different answer.
+func Dial(ctx context.Context, d *net.Dialer, host string, port int) (net.Conn, error) {
+	addrs, err := Check(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// lookupNetIP resolves host names; tests replace it.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// resolve returns the addresses of host, which may be an IP literal.
+func resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	addrs, err := lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, nil
+}
+
+func inCIDRs(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// matchHost returns the first pattern matching name, or "".
+func matchHost(patterns []string, name string) string {
+	for _, p := range patterns {
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			p = suffix
+		}
+		if strings.HasPrefix(p, ".") {
+			if strings.HasSuffix(name, p) {
+				return p
+			}
+		} else if name == p {
+			return p
+		}
+	}
+	return ""
+}
+
+func inPorts(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(v string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range splitList(v) {
+		// A bare address is a single-address range
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func parseHosts(v string) []string {
+	hosts := splitList(v)
+	for i, h := range hosts {
+		hosts[i] = strings.ToLower(strings.TrimSuffix(h, "."))
+	}
+	return hosts
+}
+
+func parsePorts(v string) ([]portRange, error) {
+	var ranges []portRange
+	for _, s := range splitList(v) {
+		loStr, hiStr, isRange := strings.Cut(s, "-")
+		if !isRange {
+			hiStr = loStr
+		}
+		lo, err1 := strconv.Atoi(loStr)
+		hi, err2 := strconv.Atoi(hiStr)
+		if err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+		ranges = append(ranges, portRange{lo, hi})
+	}
+	return ranges, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
+	}
+	return items
+}
@@ -0,0 +1,169 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// fakeDNS answers lookups from a fixed table.
+var fakeDNS = map[string][]string{
+	"web.example.com":      {"203.0.113.10"},
+	"metadata.example.com": {"169.254.169.254"},
+	"mixed.example.com":    {"203.0.113.11", "127.0.0.1"},
+	"mapped.example.com":   {"::ffff:127.0.0.1"},
+	"v6.example.com":       {"2001:db8::10"},
+	"db.internal":          {"10.0.0.5"},
+	"db-alias.example.com": {"10.0.0.5"},
+	"office.example.com":   {"198.51.100.7"},
+}
+
+// setup applies the policy in env, resolving names with fakeDNS.
+func setup(t *testing.T, env map[string]string) {
+	t.Helper()
+	orig := lookupNetIP
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		answers, ok := fakeDNS[host]
+		if !ok {
+			return nil, fmt.Errorf("lookup %s: no such host", host)
+		}
+		var addrs []netip.Addr
+		for _, a := range answers {
+			addrs = append(addrs, netip.MustParseAddr(a))
+		}
+		return addrs, nil
+	}
+	t.Cleanup(func() { lookupNetIP = orig })
+
+	for _, name := range []string{
+		"EGRESS_ALLOW_CIDRS", "EGRESS_DENY_CIDRS", "EGRESS_ALLOW_HOSTS",
+		"EGRESS_DENY_HOSTS", "EGRESS_ALLOW_PORTS", "EGRESS_DENY_PORTS", "DB_PATH",
+	} {
+		t.Setenv(name, env[name])
+	}
+	Init()
+}
+
+func TestCheckDefaultPolicy(t *testing.T) {
+	setup(t, map[string]string{"DB_PATH": "host=db.internal user=app dbname=app"})
+
+	tests := []struct {
+		host string
+		port int
+		rule string // Empty when allowed
+	}{
+		{"web.example.com", 22, ""},
+		{"v6.example.com", 22, ""},
+		{"203.0.113.10", 22, ""},
+		{"127.0.0.1", 22, "denied range 127.0.0.0/8"},
+		{"localhost.", 22, "no such host"},
+		{"metadata.example.com", 22, "denied range 169.254.0.0/16"},
+		{"mixed.example.com", 22, "denied range 127.0.0.0/8"},
+		{"mapped.example.com", 22, "denied range 127.0.0.0/8"},
+		{"::ffff:169.254.169.254", 22, "denied range 169.254.0.0/16"},
+		{"192.168.1.10", 22, "private range 192.168.0.0/16"},
+		{"100.64.0.1", 22, "private range 100.64.0.0/10"},
+		{"fd12::1", 22, "private range fc00::/7"},
+		{"office.example.com", 22, ""},
+		{"DB.internal", 22, "the gateway's database"},
+		{"db-alias.example.com", 2222, "the gateway's database"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			addrs, err := Check(context.Background(), tt.host, tt.port)
+			if tt.rule == "" {
+				if err != nil || len(addrs) == 0 {
+					t.Fatalf("Check() = %v, %v; want allowed", addrs, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.rule) {
+				t.Fatalf("Check() = %v, %v; want an error mentioning %q", addrs, err, tt.rule)
+			}
+		})
+	}
+
+	_, err := Check(context.Background(), "metadata.example.com", 22)
+	var denied *DeniedError
+	if !errors.As(err, &denied) || !errors.Is(err, ErrDenied) || denied.Addr != "169.254.169.254" {
+		t.Errorf("Check() = %v, want a DeniedError naming the resolved address", err)
+	}
+}
+
+func TestCheckConfiguredPolicy(t *testing.T) {
+	setup(t, map[string]string{
+		"EGRESS_ALLOW_CIDRS": "203.0.113.0/24,198.51.100.7",
+		"EGRESS_DENY_CIDRS":  "203.0.113.11/32",
+		"EGRESS_ALLOW_HOSTS": "*.example.com",
+		"EGRESS_DENY_HOSTS":  "office.example.com",
+		"EGRESS_ALLOW_PORTS": "22,2200-2299",
+		"EGRESS_DENY_PORTS":  "2222",
+	})
+
+	tests := []struct {
+		host string
+		port int
+		rule string
+	}{
+		{"web.example.com", 22, ""},
+		{"web.example.com", 2201, ""},
+		{"web.example.com", 2222, "port 2222 is denied"},
+		{"web.example.com", 80, "port 80 is not allowed"},
+		{"office.example.com", 22, `denied "office.example.com"`},
+		{"203.0.113.10", 22, "host is not allowed"},
+		{"v6.example.com", 22, "not in an allowed range"},
+		{"mixed.example.com", 22, "denied range 203.0.113.11/32"},
+		// With EGRESS_DENY_CIDRS set, the built-in ranges no longer apply,
+		// but the allow list still keeps out what it doesn't name
+		{"metadata.example.com", 22, "not in an allowed range"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.host, tt.port), func(t *testing.T) {
+			_, err := Check(context.Background(), tt.host, tt.port)
+			if tt.rule == "" {
+				if err != nil {
+					t.Fatalf("Check() = %v, want allowed", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.rule) {
+				t.Fatalf("Check() = %v, want an error mentioning %q", err, tt.rule)
+			}
+		})
+	}
+}
+
+func TestCheckAllowedPrivateRange(t *testing.T) {
+	setup(t, map[string]string{
+		"EGRESS_ALLOW_CIDRS": "10.0.0.0/8,127.0.0.0/8",
+		"DB_PATH":            "host=db.internal user=app dbname=app",
+	})
+
+	tests := []struct {
+		host string
+		rule string
+	}{
+		{"10.1.2.3", ""},
+		{"192.168.1.10", "private range 192.168.0.0/16"},
+		{"web.example.com", "not in an allowed range"},
+		{"127.0.0.1", "denied range 127.0.0.0/8"},
+		{"db-alias.example.com", "the gateway's database"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			_, err := Check(context.Background(), tt.host, 22)
+			if tt.rule == "" {
+				if err != nil {
+					t.Fatalf("Check() = %v, want allowed", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.rule) {
+				t.Fatalf("Check() = %v, want an error mentioning %q", err, tt.rule)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+// Package errcode defines the error codes that more than one package sends
+// to API and WebSocket clients as "code". They are stable; clients may
+// switch on them.
+package errcode
+
+const (
+	HostKeyChanged  = "host_key_changed"  // Presented host key differs from the pinned one
+	HostKeyUnpinned = "host_key_unpinned" // No host key pinned under the strict policy
+
+	CredentialsLocked = "credentials_locked" // Secrets are in a vault that isn't unlocked
+)
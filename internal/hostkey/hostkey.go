@@ -0,0 +1,194 @@
+package hostkey
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/errcode"
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ChangedError is returned when a server presents a host key that differs
+// from the one pinned for it. The new key is kept as pending until the owner
+// reviews and accepts it.
+type ChangedError struct {
+	ServerID       uint   `json:"server_id"`
+	Host           string `json:"host"`
+	OldFingerprint string `json:"old_fingerprint"`
+	NewFingerprint string `json:"new_fingerprint"`
+}
+
+func (e *ChangedError) Error() string {
+	return fmt.Sprintf("host key for %s changed: expected %s, got %s", e.Host, e.OldFingerprint, e.NewFingerprint)
+}
+
+// Payload returns the error in the structured form sent to API and
+// WebSocket clients.
+func (e *ChangedError) Payload() map[string]interface{} {
+	return map[string]interface{}{
+		"error":           e.Error(),
+		"code":            errcode.HostKeyChanged,
+		"server_id":       e.ServerID,
+		"host":            e.Host,
+		"old_fingerprint": e.OldFingerprint,
+		"new_fingerprint": e.NewFingerprint,
+	}
+}
+
+// UnpinnedError is returned under RequirePinned when a server has no pinned
+// host key. The presented key is kept as pending so the owner can accept it
+// after checking its fingerprint.
+type UnpinnedError struct {
+	ServerID    uint   `json:"server_id"`
+	Host        string `json:"host"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (e *UnpinnedError) Error() string {
+	return fmt.Sprintf("no host key is pinned for %s; review %s before connecting", e.Host, e.Fingerprint)
+}
+
+// Payload returns the error in the structured form sent to API and
+// WebSocket clients.
+func (e *UnpinnedError) Payload() map[string]interface{} {
+	return map[string]interface{}{
+		"error":           e.Error(),
+		"code":            errcode.HostKeyUnpinned,
+		"server_id":       e.ServerID,
+		"host":            e.Host,
+		"new_fingerprint": e.Fingerprint,
+	}
+}
+
+// Policy decides how a server without a pinned host key is treated.
+type Policy string
+
+const (
+	// TrustOnFirstUse pins the first key a server presents.
+	TrustOnFirstUse Policy = "tofu"
+	// RequirePinned refuses to connect until a key is pinned or accepted.
+	RequirePinned Policy = "strict"
+)
+
+// Encode returns key in authorized_keys format without the trailing newline.
+func Encode(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// Parse parses a key in authorized_keys format, as stored on models.Server.
+func Parse(encoded string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(encoded))
+	return key, err
+}
+
+// Apply configures config to verify the host key of server. When no key is
+// pinned yet, policy decides whether the first key presented is trusted and
+// stored.
+func Apply(config *ssh.ClientConfig, server *models.Server, policy Policy) error {
+	if server.HostKey != "" {
+		pinned, err := Parse(server.HostKey)
+		if err != nil {
+			return fmt.Errorf("invalid pinned host key: %w", err)
+		}
+		// Ask for the pinned key type so servers with several keys present
+		// the same one, keeping to the configured algorithms where they
+		// allow it
+		algorithms := algorithmsFor(pinned.Type())
+		if allowed := config.HostKeyAlgorithms; len(allowed) > 0 {
+			filtered := slices.DeleteFunc(slices.Clone(algorithms), func(algo string) bool {
+				return !slices.Contains(allowed, algo)
+			})
+			if len(filtered) > 0 {
+				algorithms = filtered
+			}
+		}
+		config.HostKeyAlgorithms = algorithms
+	}
+	config.HostKeyCallback = Callback(server, policy)
+	return nil
+}
+
+// Callback returns a host key callback for server that checks the pinned
+// key, or applies policy when there is none.
+func Callback(server *models.Server, policy Policy) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		encoded := Encode(key)
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if server.HostKey == "" && policy == RequirePinned {
+			if err := db.DB.Model(&models.Server{}).Where("id = ?", server.ID).Updates(map[string]interface{}{
+				"pending_host_key":             encoded,
+				"pending_host_key_fingerprint": fingerprint,
+			}).Error; err != nil {
+				return fmt.Errorf("failed to record host key: %w", err)
+			}
+			return &UnpinnedError{ServerID: server.ID, Host: hostname, Fingerprint: fingerprint}
+		}
+
+		if server.HostKey == "" {
+			// Only pin if nobody else pinned a key in the meantime
+			res := db.DB.Model(&models.Server{}).
+				Where("id = ? AND (host_key = '' OR host_key IS NULL)", server.ID).
+				Updates(map[string]interface{}{
+					"host_key":                     encoded,
+					"host_key_fingerprint":         fingerprint,
+					"pending_host_key":             "",
+					"pending_host_key_fingerprint": "",
+				})
+			if res.Error != nil {
+				return fmt.Errorf("failed to store host key: %w", res.Error)
+			}
+			if res.RowsAffected == 1 {
+				server.HostKey = encoded
+				server.HostKeyFingerprint = fingerprint
+				return nil
+			}
+
+			var current models.Server
+			if err := db.DB.Select("host_key", "host_key_fingerprint").First(&current, server.ID).Error; err != nil {
+				return fmt.Errorf("failed to load host key: %w", err)
+			}
+			server.HostKey = current.HostKey
+			server.HostKeyFingerprint = current.HostKeyFingerprint
+		}
+
+		pinned, err := Parse(server.HostKey)
+		if err != nil {
+			return fmt.Errorf("invalid pinned host key: %w", err)
+		}
+		if bytes.Equal(pinned.Marshal(), key.Marshal()) {
+			return nil
+		}
+
+		if err := db.DB.Model(&models.Server{}).Where("id = ?", server.ID).Updates(map[string]interface{}{
+			"pending_host_key":             encoded,
+			"pending_host_key_fingerprint": fingerprint,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to record changed host key: %w", err)
+		}
+
+		return &ChangedError{
+			ServerID:       server.ID,
+			Host:           hostname,
+			OldFingerprint: ssh.FingerprintSHA256(pinned),
+			NewFingerprint: fingerprint,
+		}
+	}
+}
+
+func algorithmsFor(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	default:
+		return []string{keyType}
+	}
+}
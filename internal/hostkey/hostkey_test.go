@@ -0,0 +1,169 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var remote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newServer(t *testing.T) *models.Server {
+	t.Helper()
+	server := &models.Server{UserID: 1, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, server)
+	return server
+}
+
+func reload(t *testing.T, id uint) models.Server {
+	t.Helper()
+	var server models.Server
+	if err := db.DB.First(&server, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	dbtest.Open(t)
+	server := newServer(t)
+	key, other := newKey(t), newKey(t)
+
+	check := Callback(server, TrustOnFirstUse)
+	if err := check("web.example:22", remote, key); err != nil {
+		t.Fatalf("first connect: %v", err)
+	}
+	stored := reload(t, server.ID)
+	if stored.HostKey != Encode(key) || stored.HostKeyFingerprint != ssh.FingerprintSHA256(key) {
+		t.Fatalf("pinned %q, want %q", stored.HostKey, Encode(key))
+	}
+
+	// The same key passes from the stored pin as well as the cached one
+	if err := Callback(&stored, TrustOnFirstUse)("web.example:22", remote, key); err != nil {
+		t.Fatalf("second connect: %v", err)
+	}
+
+	err := Callback(&stored, TrustOnFirstUse)("web.example:22", remote, other)
+	var changed *ChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("changed key: err = %v, want ChangedError", err)
+	}
+	if changed.OldFingerprint != ssh.FingerprintSHA256(key) || changed.NewFingerprint != ssh.FingerprintSHA256(other) {
+		t.Fatalf("ChangedError %+v", changed)
+	}
+	stored = reload(t, server.ID)
+	if stored.HostKey != Encode(key) {
+		t.Fatal("changed key replaced the pin")
+	}
+	if stored.PendingHostKey != Encode(other) {
+		t.Fatalf("pending key %q, want the changed key", stored.PendingHostKey)
+	}
+}
+
+func TestTrustOnFirstUseRace(t *testing.T) {
+	dbtest.Open(t)
+	server := newServer(t)
+	first, second := newKey(t), newKey(t)
+
+	// Two connections start before either pins; the second presents a
+	// different key and must not overwrite the first pin
+	stale := *server
+	if err := Callback(server, TrustOnFirstUse)("web.example:22", remote, first); err != nil {
+		t.Fatal(err)
+	}
+	err := Callback(&stale, TrustOnFirstUse)("web.example:22", remote, second)
+	var changed *ChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("err = %v, want ChangedError", err)
+	}
+	if got := reload(t, server.ID).HostKey; got != Encode(first) {
+		t.Fatalf("pinned %q, want the first key", got)
+	}
+}
+
+func TestRequirePinned(t *testing.T) {
+	dbtest.Open(t)
+	server := newServer(t)
+	key := newKey(t)
+
+	err := Callback(server, RequirePinned)("web.example:22", remote, key)
+	var unpinned *UnpinnedError
+	if !errors.As(err, &unpinned) {
+		t.Fatalf("err = %v, want UnpinnedError", err)
+	}
+	if unpinned.Fingerprint != ssh.FingerprintSHA256(key) || unpinned.Payload()["code"] != "host_key_unpinned" {
+		t.Fatalf("UnpinnedError %+v", unpinned)
+	}
+	stored := reload(t, server.ID)
+	if stored.HostKey != "" {
+		t.Fatal("strict policy pinned a key")
+	}
+	if stored.PendingHostKey != Encode(key) || stored.PendingHostKeyFingerprint != ssh.FingerprintSHA256(key) {
+		t.Fatal("presented key not kept for review")
+	}
+
+	// Once the key is pinned, strict behaves like any pinned server
+	stored.HostKey = stored.PendingHostKey
+	if err := Callback(&stored, RequirePinned)("web.example:22", remote, key); err != nil {
+		t.Fatalf("pinned key: %v", err)
+	}
+	if err := Callback(&stored, RequirePinned)("web.example:22", remote, newKey(t)); !errors.As(err, new(*ChangedError)) {
+		t.Fatalf("other key: err = %v, want ChangedError", err)
+	}
+}
+
+func TestApplyHostKeyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &models.Server{HostKey: Encode(pinned)}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		want    []string
+	}{
+		{"defaults", nil, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+		{"narrowed by configuration", []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA256}, []string{ssh.KeyAlgoRSASHA256}},
+		{"nothing in common", []string{ssh.KeyAlgoED25519}, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &ssh.ClientConfig{HostKeyAlgorithms: tt.allowed}
+			if err := Apply(config, server, TrustOnFirstUse); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(config.HostKeyAlgorithms, tt.want) {
+				t.Fatalf("HostKeyAlgorithms = %v, want %v", config.HostKeyAlgorithms, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrPassphraseRequired  = errors.New("private key is encrypted; a passphrase is required")
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase for private key")
+)
+
+// ParseSigner parses a private key in OpenSSH, PEM (PKCS#1, PKCS#8, SEC 1)
+// or PuTTY .ppk format. passphrase may be empty for unencrypted keys.
+func ParseSigner(key, passphrase []byte) (ssh.Signer, error) {
+	key = bytes.TrimSpace(key)
+
+	if isPPK(key) {
+		return parsePPK(key, passphrase)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, ErrIncorrectPassphrase
+	}
+	return signer, err
+}
+
+// ParseCertSigner parses a private key as ParseSigner does and pairs it with
+// an OpenSSH certificate for that key, in authorized_keys format.
+func ParseCertSigner(key, passphrase, certificate []byte) (ssh.Signer, error) {
+	signer, err := ParseSigner(key, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("invalid certificate: not an OpenSSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("invalid certificate: not a user certificate")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
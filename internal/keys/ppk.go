@@ -0,0 +1,319 @@
+package keys
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// PuTTY private key files, versions 2 and 3.
+// See https://the.earth.li/~sgtatham/putty/0.78/htmldoc/AppendixC.html
+
+const ppkPrefix = "PuTTY-User-Key-File-"
+
+func isPPK(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ppkPrefix))
+}
+
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	headers    map[string]string
+	public     []byte
+	private    []byte
+	mac        []byte
+}
+
+func readPPK(data []byte) (*ppkFile, error) {
+	f := &ppkFile{headers: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	readBlob := func(countHeader string) ([]byte, error) {
+		n, err := strconv.Atoi(f.headers[countHeader])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ppk: invalid %s", countHeader)
+		}
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("ppk: truncated %s", countHeader)
+			}
+			b.WriteString(strings.TrimSpace(scanner.Text()))
+		}
+		return base64.StdEncoding.DecodeString(b.String())
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("ppk: malformed line %q", line)
+		}
+		f.headers[name] = value
+
+		var err error
+		switch {
+		case strings.HasPrefix(name, ppkPrefix):
+			f.version, err = strconv.Atoi(strings.TrimPrefix(name, ppkPrefix))
+			f.algorithm = value
+		case name == "Encryption":
+			f.encryption = value
+		case name == "Comment":
+			f.comment = value
+		case name == "Public-Lines":
+			f.public, err = readBlob(name)
+		case name == "Private-Lines":
+			f.private, err = readBlob(name)
+		case name == "Private-MAC":
+			f.mac, err = hex.DecodeString(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.version != 2 && f.version != 3 {
+		return nil, fmt.Errorf("ppk: unsupported version %d", f.version)
+	}
+	if f.public == nil || f.private == nil || f.mac == nil {
+		return nil, errors.New("ppk: missing key data")
+	}
+	return f, nil
+}
+
+// Limits on the Argon2 parameters of version 3 files. PuTTY's defaults are
+// 8 MiB, 13 passes and 1 lane; memory is in KiB.
+const (
+	maxArgon2Memory      = 1 << 20 // 1 GiB
+	maxArgon2Passes      = 64
+	maxArgon2Parallelism = 16
+)
+
+// keys derives the cipher key, IV and MAC key for the file.
+func (f *ppkFile) keys(passphrase []byte) (key, iv, macKey []byte, err error) {
+	if f.version == 2 {
+		h := sha1.New()
+		h.Write([]byte("putty-private-key-file-mac-key"))
+		if f.encryption != "none" {
+			h.Write(passphrase)
+		}
+		macKey = h.Sum(nil)
+		if f.encryption == "none" {
+			return nil, nil, macKey, nil
+		}
+
+		var k []byte
+		for seq := uint32(0); seq < 2; seq++ {
+			h := sha1.New()
+			binary.Write(h, binary.BigEndian, seq)
+			h.Write(passphrase)
+			k = h.Sum(k)
+		}
+		return k[:32], make([]byte, aes.BlockSize), macKey, nil
+	}
+
+	if f.encryption == "none" {
+		return nil, nil, []byte{}, nil
+	}
+
+	salt, err := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, nil, nil, errors.New("ppk: invalid Argon2-Salt")
+	}
+	memory, err1 := strconv.ParseUint(f.headers["Argon2-Memory"], 10, 32)
+	passes, err2 := strconv.ParseUint(f.headers["Argon2-Passes"], 10, 32)
+	parallelism, err3 := strconv.ParseUint(f.headers["Argon2-Parallelism"], 10, 8)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, nil, nil, errors.New("ppk: invalid Argon2 parameters")
+	}
+	// The file is untrusted; don't let it exhaust memory or CPU
+	if memory > maxArgon2Memory || passes < 1 || passes > maxArgon2Passes ||
+		parallelism < 1 || parallelism > maxArgon2Parallelism {
+		return nil, nil, nil, errors.New("ppk: Argon2 parameters out of range")
+	}
+
+	var out []byte
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+		out = argon2.IDKey(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80)
+	case "Argon2i":
+		out = argon2.Key(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80)
+	default:
+		return nil, nil, nil, fmt.Errorf("ppk: unsupported key derivation %q", f.headers["Key-Derivation"])
+	}
+	return out[:32], out[32:48], out[48:], nil
+}
+
+func parsePPK(data, passphrase []byte) (ssh.Signer, error) {
+	f, err := readPPK(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.encryption {
+	case "none":
+	case "aes256-cbc":
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+	default:
+		return nil, fmt.Errorf("ppk: unsupported encryption %q", f.encryption)
+	}
+
+	key, iv, macKey, err := f.keys(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	private := f.private
+	if key != nil {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("ppk: invalid private blob length")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, f.private)
+	}
+
+	var newHash func() hash.Hash = sha1.New
+	if f.version == 3 {
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(f.algorithm), []byte(f.encryption), []byte(f.comment), f.public, private} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	if !hmac.Equal(mac.Sum(nil), f.mac) {
+		if key != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+		return nil, errors.New("ppk: MAC verification failed")
+	}
+
+	raw, err := ppkPrivateKey(f.algorithm, f.public, private)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(raw)
+}
+
+func ppkPrivateKey(algorithm string, public, private []byte) (interface{}, error) {
+	switch algorithm {
+	case ssh.KeyAlgoRSA:
+		var pub struct {
+			Name string
+			E    *big.Int
+			N    *big.Int
+		}
+		var priv struct {
+			D    *big.Int
+			P    *big.Int
+			Q    *big.Int
+			Iqmp *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(public, &pub); err != nil {
+			return nil, err
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		if !pub.E.IsInt64() {
+			return nil, errors.New("ppk: invalid RSA exponent")
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: pub.N, E: int(pub.E.Int64())},
+			D:         priv.D,
+			Primes:    []*big.Int{priv.P, priv.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+
+	case ssh.KeyAlgoED25519:
+		var priv struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		if len(priv.Key) != ed25519.SeedSize {
+			return nil, errors.New("ppk: invalid ed25519 key")
+		}
+		return ed25519.NewKeyFromSeed(priv.Key), nil
+
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var pub struct {
+			Name  string
+			Curve string
+			Q     []byte
+		}
+		var priv struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(public, &pub); err != nil {
+			return nil, err
+		}
+		if err := ssh.Unmarshal(private, &priv); err != nil {
+			return nil, err
+		}
+		var curve elliptic.Curve
+		switch pub.Curve {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ppk: unsupported curve %q", pub.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, pub.Q)
+		if x == nil {
+			return nil, errors.New("ppk: invalid ECDSA public key")
+		}
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         priv.D,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("ppk: unsupported key type %q", algorithm)
+	}
+}
@@ -0,0 +1,177 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ppkOptions describe a PuTTY key file for writePPK.
+type ppkOptions struct {
+	version    int
+	passphrase string
+	argon2     map[string]string // Overrides of the version 3 Argon2 headers
+}
+
+// writePPK encodes key as a PuTTY private key file, as puttygen would.
+func writePPK(t *testing.T, key ed25519.PrivateKey, opts ppkOptions) []byte {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := pub.Marshal()
+	private := ssh.Marshal(struct{ Key []byte }{key.Seed()})
+
+	encryption := "none"
+	headers := map[string]string{
+		"Key-Derivation":     "Argon2id",
+		"Argon2-Memory":      "8192",
+		"Argon2-Passes":      "8",
+		"Argon2-Parallelism": "1",
+		"Argon2-Salt":        hex.EncodeToString(bytes.Repeat([]byte{7}, 16)),
+	}
+	for name, value := range opts.argon2 {
+		headers[name] = value
+	}
+	f := &ppkFile{version: opts.version, headers: headers}
+	if opts.passphrase != "" {
+		encryption = "aes256-cbc"
+		private = append(private, make([]byte, aes.BlockSize-len(private)%aes.BlockSize)...)
+	}
+	f.encryption = encryption
+
+	var cipherKey, iv, macKey []byte
+	if opts.version == 3 && encryption != "none" && opts.argon2 != nil {
+		// Out-of-range parameters can't be derived; any MAC will do
+		macKey = []byte{}
+	} else if cipherKey, iv, macKey, err = f.keys([]byte(opts.passphrase)); err != nil {
+		t.Fatal(err)
+	}
+
+	var newHash func() hash.Hash = sha1.New
+	if opts.version == 3 {
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(ssh.KeyAlgoED25519), []byte(encryption), []byte("test key"), public, private} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	if cipherKey != nil {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(private, private)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "PuTTY-User-Key-File-%d: %s\n", opts.version, ssh.KeyAlgoED25519)
+	fmt.Fprintf(&b, "Encryption: %s\nComment: test key\n", encryption)
+	writeLines(&b, "Public-Lines", public)
+	if opts.version == 3 && encryption != "none" {
+		for _, name := range []string{"Key-Derivation", "Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism", "Argon2-Salt"} {
+			fmt.Fprintf(&b, "%s: %s\n", name, headers[name])
+		}
+	}
+	writeLines(&b, "Private-Lines", private)
+	fmt.Fprintf(&b, "Private-MAC: %x\n", mac.Sum(nil))
+	return []byte(b.String())
+}
+
+// writeLines writes data base64 encoded in lines of 64 characters.
+func writeLines(b *strings.Builder, header string, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(encoded) > 64 {
+		lines, encoded = append(lines, encoded[:64]), encoded[64:]
+	}
+	lines = append(lines, encoded)
+	fmt.Fprintf(b, "%s: %d\n%s\n", header, len(lines), strings.Join(lines, "\n"))
+}
+
+func TestParsePPK(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       ppkOptions
+		passphrase string
+		err        error // Nil when the key should parse
+	}{
+		{"v2 unencrypted", ppkOptions{version: 2}, "", nil},
+		{"v2 encrypted", ppkOptions{version: 2, passphrase: "hunter2"}, "hunter2", nil},
+		{"v3 unencrypted", ppkOptions{version: 3}, "", nil},
+		{"v3 encrypted", ppkOptions{version: 3, passphrase: "hunter2"}, "hunter2", nil},
+		{"v2 wrong passphrase", ppkOptions{version: 2, passphrase: "hunter2"}, "hunter3", ErrIncorrectPassphrase},
+		{"v3 wrong passphrase", ppkOptions{version: 3, passphrase: "hunter2"}, "hunter3", ErrIncorrectPassphrase},
+		{"v3 missing passphrase", ppkOptions{version: 3, passphrase: "hunter2"}, "", ErrPassphraseRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := ParseSigner(writePPK(t, key, tt.opts), []byte(tt.passphrase))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ParseSigner() = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+				t.Fatal("parsed key does not match")
+			}
+		})
+	}
+}
+
+func TestParsePPKArgon2Limits(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value map[string]string
+	}{
+		{"memory", map[string]string{"Argon2-Memory": "4294967295"}},
+		{"no passes", map[string]string{"Argon2-Passes": "0"}},
+		{"passes", map[string]string{"Argon2-Passes": "1000000"}},
+		{"no parallelism", map[string]string{"Argon2-Parallelism": "0"}},
+		{"parallelism", map[string]string{"Argon2-Parallelism": "255"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := writePPK(t, key, ppkOptions{version: 3, passphrase: "hunter2", argon2: tt.value})
+			_, err := ParseSigner(data, []byte("hunter2"))
+			if err == nil || !strings.Contains(err.Error(), "out of range") {
+				t.Fatalf("ParseSigner() = %v, want parameters out of range", err)
+			}
+		})
+	}
+}
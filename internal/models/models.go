@@ -17,31 +17,163 @@ type User struct {
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Vault mode: server secrets are sealed under a key derived from a
+	// passphrase only the user knows; the backend keeps just enough to
+	// check the passphrase
+	VaultEnabled  bool   `gorm:"not null;default:false" json:"vault_enabled"`
+	VaultKDF      string `json:"-"` // Argon2id parameters
+	VaultSalt     string `json:"-"`
+	VaultVerifier string `json:"-"`
+
+	// Role is added to the principals of SSH certificates issued to the user
+	Role string `gorm:"not null;default:user" json:"role"`
 }
 
 // Folder represents a group of servers.
 type Folder struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	UserID    uint           `gorm:"index;not null" json:"user_id"`
-	Name      string         `gorm:"not null" json:"name"`
-	Servers   []Server       `gorm:"foreignKey:FolderID" json:"servers,omitempty"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID             uint           `gorm:"primaryKey" json:"id"`
+	UserID         uint           `gorm:"index;not null" json:"user_id"`
+	Name           string         `gorm:"not null" json:"name"`
+	RecordSessions bool           `gorm:"not null;default:false" json:"record_sessions"`
+	Servers        []Server       `gorm:"foreignKey:FolderID" json:"servers,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // Server represents a remote server configuration.
 type Server struct {
-	ID              uint           `gorm:"primaryKey" json:"id"`
-	UserID          uint           `gorm:"index;not null" json:"user_id"`
-	FolderID        *uint          `gorm:"index" json:"folder_id"` // Nullable
-	Name            string         `gorm:"not null" json:"name"`
-	Host            string         `gorm:"not null" json:"host"`
-	Port            int            `gorm:"default:22" json:"port"`
-	Username        string         `gorm:"not null" json:"username"`
-	AuthType        string         `gorm:"not null" json:"auth_type"` // "password" or "key"
-	EncryptedSecret string         `gorm:"not null" json:"-"`         // Encrypted password or private key
-	CreatedAt       time.Time      `json:"created_at"`
-	UpdatedAt       time.Time      `json:"updated_at"`
-	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                        uint           `gorm:"primaryKey" json:"id"`
+	UserID                    uint           `gorm:"index;not null" json:"user_id"`
+	FolderID                  *uint          `gorm:"index" json:"folder_id"` // Nullable
+	Name                      string         `gorm:"not null" json:"name"`
+	Host                      string         `gorm:"not null" json:"host"`
+	Port                      int            `gorm:"default:22" json:"port"`
+	Username                  string         `gorm:"not null" json:"username"`
+	AuthType                  string         `gorm:"not null" json:"auth_type"` // "password", "key", "credential", "certificate" or "agent"
+	EncryptedSecret           string         `gorm:"not null" json:"-"`         // Encrypted password or private key
+	EncryptedPassphrase       string         `json:"-"`                         // Encrypted private key passphrase, if any
+	HostKey                   string         `json:"-"`                         // Pinned host key in authorized_keys format
+	HostKeyFingerprint        string         `json:"host_key_fingerprint"`
+	PendingHostKey            string         `json:"-"` // Changed or unpinned key awaiting review
+	PendingHostKeyFingerprint string         `json:"pending_host_key_fingerprint,omitempty"`
+	RecordSessions            bool           `gorm:"not null;default:false" json:"record_sessions"`
+	JumpHostIDs               []uint         `gorm:"-" json:"jump_host_ids"`          // Loaded from JumpHost
+	CredentialID              *uint          `gorm:"index" json:"credential_id"`      // Shared credential, when AuthType is "credential"
+	CAID                      *uint          `gorm:"column:ca_id;index" json:"ca_id"` // Signing CA, when AuthType is "certificate"
+	ForwardAgent              bool           `gorm:"not null;default:false" json:"forward_agent"`
+	TunnelsEnabled            bool           `gorm:"not null;default:false" json:"tunnels_enabled"`        // Allow proxying and forwarding to remote ports
+	AgentKeyIDs               []uint         `gorm:"-" json:"agent_key_ids"`                               // Credentials forwarded to the server, loaded from ForwardedKey
+	AlgorithmProfile          string         `gorm:"not null;default:compatible" json:"algorithm_profile"` // "modern", "compatible" or "legacy"
+	KexAlgorithms             string         `json:"kex_algorithms"`                                       // Comma-separated lists replacing the profile's, like OpenSSH's options
+	Ciphers                   string         `json:"ciphers"`
+	MACs                      string         `gorm:"column:macs" json:"macs"`
+	HostKeyAlgorithms         string         `json:"host_key_algorithms"`
+	WeakAlgorithms            bool           `gorm:"-" json:"weak_algorithms"`                 // Set when returned by the API
+	SessionMode               string         `gorm:"not null;default:pty" json:"session_mode"` // "pty", "shell" or "exec"
+	Command                   string         `json:"command"`                                  // Run by "exec" sessions
+	CreatedAt                 time.Time      `json:"created_at"`
+	UpdatedAt                 time.Time      `json:"updated_at"`
+	DeletedAt                 gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Credential is a login secret stored once and referenced by any number of
+// servers, so rotating it updates all of them.
+type Credential struct {
+	ID                  uint           `gorm:"primaryKey" json:"id"`
+	UserID              uint           `gorm:"index;not null" json:"user_id"`
+	Name                string         `gorm:"not null" json:"name"`
+	Type                string         `gorm:"not null" json:"type"`    // "password", "key" or "certificate"
+	EncryptedSecret     string         `gorm:"not null" json:"-"`       // Encrypted password or private key
+	EncryptedPassphrase string         `json:"-"`                       // Encrypted private key passphrase, if any
+	HasPassphrase       bool           `gorm:"-" json:"has_passphrase"` // Set when returned by the API
+	Certificate         string         `json:"certificate,omitempty"`   // OpenSSH user certificate for the key
+	PublicKey           string         `json:"public_key,omitempty"`    // Public half of a key, in authorized_keys format
+	CreatedAt           time.Time      `json:"created_at"`
+	UpdatedAt           time.Time      `json:"updated_at"`
+	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// CertificateAuthority is an SSH CA key that signs short-lived user
+// certificates when connecting to servers that trust it.
+type CertificateAuthority struct {
+	ID                  uint           `gorm:"primaryKey" json:"id"`
+	UserID              uint           `gorm:"index;not null" json:"user_id"`
+	Name                string         `gorm:"not null" json:"name"`
+	PublicKey           string         `gorm:"not null" json:"public_key"` // For TrustedUserCAKeys on servers
+	Fingerprint         string         `gorm:"not null" json:"fingerprint"`
+	EncryptedSecret     string         `gorm:"not null" json:"-"`                    // Encrypted CA private key
+	EncryptedPassphrase string         `json:"-"`                                    // Encrypted private key passphrase, if any
+	CertTTL             int            `gorm:"not null;default:300" json:"cert_ttl"` // Seconds a certificate is valid
+	CreatedAt           time.Time      `json:"created_at"`
+	UpdatedAt           time.Time      `json:"updated_at"`
+	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// SealedTables lists the tables whose encrypted_secret and
+// encrypted_passphrase columns hold ciphertexts bound to their row.
+var SealedTables = []string{"servers", "credentials", "certificate_authorities"}
+
+// AuditEvent records a security-relevant action, such as issuing an SSH
+// certificate. Details is a JSON object specific to the action.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"` // User the action was taken for
+	ServerID  *uint     `gorm:"index" json:"server_id,omitempty"`
+	Action    string    `gorm:"index;not null" json:"action"`
+	Details   string    `gorm:"type:text" json:"details"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// ServerGrant gives a user other than the owner access to a server.
+type ServerGrant struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ServerID  uint      `gorm:"uniqueIndex:idx_server_grant;not null" json:"server_id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_server_grant;not null" json:"user_id"`
+	GrantedBy uint      `gorm:"not null" json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CredentialGrant lets a user other than the owner log in with a key or
+// certificate credential from their own servers. The grantee never sees the
+// secret material; password credentials can't be granted, since every
+// server they are used with receives the password.
+type CredentialGrant struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CredentialID uint      `gorm:"uniqueIndex:idx_credential_grant;not null" json:"credential_id"`
+	UserID       uint      `gorm:"uniqueIndex:idx_credential_grant;not null" json:"user_id"`
+	GrantedBy    uint      `gorm:"not null" json:"granted_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// JumpHost links a server to another stored server it is reached through.
+// A server's hops are dialed in ascending Position order.
+type JumpHost struct {
+	ID          uint `gorm:"primaryKey" json:"id"`
+	ServerID    uint `gorm:"index;not null" json:"server_id"`
+	HopServerID uint `gorm:"index;not null" json:"hop_server_id"`
+	Position    int  `gorm:"not null" json:"position"`
+}
+
+// ForwardedKey is a key credential offered through agent forwarding on a
+// server with ForwardAgent set.
+type ForwardedKey struct {
+	ID           uint `gorm:"primaryKey" json:"id"`
+	ServerID     uint `gorm:"index;not null" json:"server_id"`
+	CredentialID uint `gorm:"index;not null" json:"credential_id"`
+}
+
+// SessionRecording is an asciicast v2 recording of a terminal session.
+type SessionRecording struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index;not null" json:"user_id"`
+	ServerID   uint       `gorm:"index;not null" json:"server_id"`
+	StorageKey string     `json:"-"`
+	Cols       int        `json:"cols"`
+	Rows       int        `json:"rows"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at"` // Nil while the session is running
+	Size       int64      `json:"size"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
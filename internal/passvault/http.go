@@ -0,0 +1,74 @@
+package passvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"web-ssh-backend/internal/errcode"
+)
+
+type contextKey struct{}
+
+// WithToken returns a copy of ctx carrying an unlock token.
+func WithToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, token)
+}
+
+// TokenFromContext returns the unlock token carried by ctx, if any.
+func TokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(contextKey{}).(string)
+	return token
+}
+
+// Middleware moves the unlock token in the X-Unlock-Token header into the
+// request context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get(TokenHeader); token != "" {
+			r = r.WithContext(WithToken(r.Context(), token))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LockedPayload returns ErrLocked in the structured form sent to API and
+// WebSocket clients.
+func LockedPayload() map[string]interface{} {
+	return map[string]interface{}{
+		"error": ErrLocked.Error(),
+		"code":  errcode.CredentialsLocked,
+	}
+}
+
+// StatusCode maps an error from this package to an HTTP status.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrLocked):
+		return http.StatusLocked
+	case errors.Is(err, ErrIncorrectPassphrase):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotEnabled), errors.Is(err, ErrAlreadyEnabled):
+		return http.StatusConflict
+	case errors.Is(err, ErrPassphraseTooShort):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteError writes err to w using the status from StatusCode. A locked
+// vault is reported as JSON so clients can prompt for the passphrase.
+func WriteError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrLocked) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusLocked)
+		json.NewEncoder(w).Encode(LockedPayload())
+		return
+	}
+	http.Error(w, err.Error(), StatusCode(err))
+}
@@ -0,0 +1,366 @@
+// Package passvault implements opt-in per-user credential vaults. A user in
+// vault mode has their server secrets sealed under a key derived from a
+// passphrase with Argon2id; the backend stores only the salt and a
+// verifier, and holds the key in memory for as long as an unlock token is
+// in use.
+package passvault
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"gorm.io/gorm"
+)
+
+// TokenHeader carries an unlock token on API requests.
+const TokenHeader = "X-Unlock-Token"
+
+// MinPassphraseLength is the shortest passphrase accepted when enabling.
+const MinPassphraseLength = 12
+
+var (
+	ErrLocked               = errors.New("credential vault locked")
+	ErrIncorrectPassphrase  = errors.New("incorrect vault passphrase")
+	ErrNotEnabled           = errors.New("vault is not enabled")
+	ErrAlreadyEnabled       = errors.New("vault is already enabled")
+	ErrPassphraseTooShort   = fmt.Errorf("vault passphrase must be at least %d characters", MinPassphraseLength)
+	errUnsupportedKDFParams = errors.New("unsupported vault KDF parameters")
+)
+
+// Argon2id cost for new vaults. Parameters are stored per user, so they can
+// be raised without breaking existing vaults.
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+)
+
+// unlockTTL is how long an unlock token stays valid without being used.
+var unlockTTL = 30 * time.Minute
+
+// kdfSlots bounds concurrent key derivations; each one takes kdfMemory.
+var kdfSlots = make(chan struct{}, 4)
+
+type unlock struct {
+	userID    uint
+	key       []byte
+	expiresAt time.Time
+}
+
+var (
+	unlocksMu sync.Mutex
+	unlocks   = make(map[string]*unlock)
+)
+
+// Init reads USER_VAULT_UNLOCK_TTL, the idle lifetime of an unlock token.
+func Init() {
+	if v := os.Getenv("USER_VAULT_UNLOCK_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid USER_VAULT_UNLOCK_TTL %q", v)
+		}
+		unlockTTL = d
+	}
+}
+
+// Enable turns on vault mode for userID and moves their existing server and
+// credential secrets into it. It returns an unlock token for the new vault.
+func Enable(userID uint, passphrase string) (string, time.Time, error) {
+	if len(passphrase) < MinPassphraseLength {
+		return "", time.Time{}, ErrPassphraseTooShort
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", time.Time{}, err
+	}
+	params := fmt.Sprintf("argon2id$m=%d,t=%d,p=%d", kdfMemory, kdfTime, kdfThreads)
+	key, verifier, err := derive(passphrase, salt, params)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		if user.VaultEnabled {
+			return ErrAlreadyEnabled
+		}
+
+		if err := reseal(tx, userID, crypto.Decrypt, func(text string, b crypto.Binding) (string, error) {
+			return crypto.SealWithKey(key, text, b)
+		}); err != nil {
+			return err
+		}
+
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"vault_enabled":  true,
+			"vault_kdf":      params,
+			"vault_salt":     base64.StdEncoding.EncodeToString(salt),
+			"vault_verifier": base64.StdEncoding.EncodeToString(verifier),
+		}).Error
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return issue(userID, key)
+}
+
+// Unlock checks passphrase and returns a token that unlocks userID's vault.
+func Unlock(userID uint, passphrase string) (string, time.Time, error) {
+	key, err := open(userID, passphrase)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return issue(userID, key)
+}
+
+// Lock forgets every unlock token for userID.
+func Lock(userID uint) {
+	unlocksMu.Lock()
+	defer unlocksMu.Unlock()
+	for token, u := range unlocks {
+		if u.userID == userID {
+			delete(unlocks, token)
+		}
+	}
+}
+
+// Disable turns off vault mode for userID, moving their server and
+// credential secrets back under the server-side key provider.
+func Disable(userID uint, passphrase string) error {
+	key, err := open(userID, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := reseal(tx, userID, func(ciphertext string, b crypto.Binding) (string, error) {
+			return crypto.OpenWithKey(key, ciphertext, b)
+		}, crypto.Encrypt); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"vault_enabled":  false,
+			"vault_kdf":      "",
+			"vault_salt":     "",
+			"vault_verifier": "",
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	Lock(userID)
+	return nil
+}
+
+// Enabled reports whether userID is in vault mode.
+func Enabled(userID uint) (bool, error) {
+	var user models.User
+	if err := db.DB.Select("vault_enabled").First(&user, userID).Error; err != nil {
+		return false, err
+	}
+	return user.VaultEnabled, nil
+}
+
+// Unlocked reports whether ctx carries a live unlock token for userID, and
+// when it expires.
+func Unlocked(ctx context.Context, userID uint) (time.Time, bool) {
+	unlocksMu.Lock()
+	defer unlocksMu.Unlock()
+	u, ok := unlocks[TokenFromContext(ctx)]
+	if !ok || u.userID != userID || time.Now().After(u.expiresAt) {
+		return time.Time{}, false
+	}
+	return u.expiresAt, true
+}
+
+// EncryptSecret seals text for the record b describes: under the owner's
+// vault key if they are in vault mode, else under the key provider.
+func EncryptSecret(ctx context.Context, text string, b crypto.Binding) (string, error) {
+	enabled, err := Enabled(b.UserID)
+	if err != nil {
+		return "", err
+	}
+	if !enabled {
+		return crypto.Encrypt(text, b)
+	}
+
+	key, err := keyFor(ctx, b.UserID)
+	if err != nil {
+		return "", err
+	}
+	return crypto.SealWithKey(key, text, b)
+}
+
+// DecryptSecret opens a ciphertext produced by EncryptSecret for b.
+func DecryptSecret(ctx context.Context, ciphertext string, b crypto.Binding) (string, error) {
+	if !crypto.IsKeySealed(ciphertext) {
+		return crypto.Decrypt(ciphertext, b)
+	}
+
+	key, err := keyFor(ctx, b.UserID)
+	if err != nil {
+		return "", err
+	}
+	return crypto.OpenWithKey(key, ciphertext, b)
+}
+
+// keyFor returns the vault key of userID from the unlock token in ctx,
+// extending the token's lifetime.
+func keyFor(ctx context.Context, userID uint) ([]byte, error) {
+	token := TokenFromContext(ctx)
+	if token == "" {
+		return nil, ErrLocked
+	}
+
+	unlocksMu.Lock()
+	defer unlocksMu.Unlock()
+	u, ok := unlocks[token]
+	if !ok || u.userID != userID {
+		return nil, ErrLocked
+	}
+	if time.Now().After(u.expiresAt) {
+		delete(unlocks, token)
+		return nil, ErrLocked
+	}
+	u.expiresAt = time.Now().Add(unlockTTL)
+	return u.key, nil
+}
+
+// open checks passphrase against userID's verifier and returns the vault key.
+func open(userID uint, passphrase string) ([]byte, error) {
+	var user models.User
+	if err := db.DB.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	if !user.VaultEnabled {
+		return nil, ErrNotEnabled
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(user.VaultSalt)
+	if err != nil {
+		return nil, err
+	}
+	want, err := base64.StdEncoding.DecodeString(user.VaultVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	key, verifier, err := derive(passphrase, salt, user.VaultKDF)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(verifier, want) {
+		return nil, ErrIncorrectPassphrase
+	}
+	return key, nil
+}
+
+// derive stretches passphrase with Argon2id and splits the result into the
+// vault key and the verifier stored to check the passphrase.
+func derive(passphrase string, salt []byte, params string) (key, verifier []byte, err error) {
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(params, "argon2id$m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || memory == 0 || iterations == 0 || threads == 0 {
+		return nil, nil, errUnsupportedKDFParams
+	}
+
+	kdfSlots <- struct{}{}
+	master := argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, 32)
+	<-kdfSlots
+
+	key = make([]byte, 32)
+	verifier = make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("web-ssh-backend vault key")), key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("web-ssh-backend vault verifier")), verifier); err != nil {
+		return nil, nil, err
+	}
+	return key, verifier, nil
+}
+
+// reseal rewrites every secret of userID, including those of soft-deleted
+// rows, from one form to another.
+func reseal(tx *gorm.DB, userID uint, decrypt func(string, crypto.Binding) (string, error), encrypt func(string, crypto.Binding) (string, error)) error {
+	for _, table := range models.SealedTables {
+		var rows []struct {
+			ID                  uint
+			EncryptedSecret     string
+			EncryptedPassphrase string
+		}
+		// Table() skips the soft-delete scope
+		if err := tx.Table(table).Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			changes := map[string]interface{}{}
+			for column, value := range map[string]string{
+				"encrypted_secret":     row.EncryptedSecret,
+				"encrypted_passphrase": row.EncryptedPassphrase,
+			} {
+				if value == "" {
+					continue
+				}
+				binding := crypto.Binding{UserID: userID, RecordID: row.ID, Field: table + "." + column}
+				plaintext, err := decrypt(value, binding)
+				if err != nil {
+					return fmt.Errorf("%s %d: cannot decrypt %s: %w", table, row.ID, column, err)
+				}
+				if changes[column], err = encrypt(plaintext, binding); err != nil {
+					return err
+				}
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			if err := tx.Table(table).Where("id = ?", row.ID).UpdateColumns(changes).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func issue(userID uint, key []byte) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(unlockTTL)
+
+	unlocksMu.Lock()
+	defer unlocksMu.Unlock()
+	now := time.Now()
+	for t, u := range unlocks {
+		if now.After(u.expiresAt) {
+			delete(unlocks, t)
+		}
+	}
+	unlocks[token] = &unlock{userID: userID, key: key, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
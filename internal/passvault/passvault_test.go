@@ -0,0 +1,199 @@
+package passvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+const passphrase = "correct horse battery"
+
+// setup creates a user with a server whose password is sealed under the
+// server-side key provider.
+func setup(t *testing.T) (*models.User, *models.Server, crypto.Binding) {
+	t.Helper()
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+
+	user := &models.User{GoogleID: "g1", Email: "owner@example.com"}
+	dbtest.Create(t, user)
+	server := &models.Server{UserID: user.ID, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, server)
+	b := crypto.Binding{UserID: user.ID, RecordID: server.ID, Field: crypto.FieldServerSecret}
+	sealed, err := crypto.Encrypt("hunter2", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Model(server).UpdateColumn("encrypted_secret", sealed).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user, server, b
+}
+
+// storedSecret returns the encrypted_secret column of server.
+func storedSecret(t *testing.T, server *models.Server) string {
+	t.Helper()
+	var stored models.Server
+	if err := db.DB.First(&stored, server.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return stored.EncryptedSecret
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	user, server, b := setup(t)
+
+	if _, _, err := Enable(user.ID, "too short"); !errors.Is(err, ErrPassphraseTooShort) {
+		t.Fatalf("Enable() with a short passphrase = %v", err)
+	}
+	token, _, err := Enable(user.ID, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Enable(user.ID, passphrase); !errors.Is(err, ErrAlreadyEnabled) {
+		t.Fatalf("second Enable() = %v, want ErrAlreadyEnabled", err)
+	}
+
+	sealed := storedSecret(t, server)
+	if !crypto.IsKeySealed(sealed) {
+		t.Fatal("existing secret was not moved into the vault")
+	}
+	if _, err := crypto.Decrypt(sealed, b); err == nil {
+		t.Fatal("vault secret opens with the server key")
+	}
+
+	unlocked := WithToken(context.Background(), token)
+	if got, err := DecryptSecret(unlocked, sealed, b); err != nil || got != "hunter2" {
+		t.Fatalf("DecryptSecret() = %q, %v; want hunter2", got, err)
+	}
+	if _, err := DecryptSecret(context.Background(), sealed, b); !errors.Is(err, ErrLocked) {
+		t.Fatalf("DecryptSecret() without a token = %v, want ErrLocked", err)
+	}
+
+	// New secrets go into the vault too
+	fresh, err := EncryptSecret(unlocked, "s3cret", b)
+	if err != nil || !crypto.IsKeySealed(fresh) {
+		t.Fatalf("EncryptSecret() = %q, %v; want a vault secret", fresh, err)
+	}
+	if _, err := EncryptSecret(context.Background(), "s3cret", b); !errors.Is(err, ErrLocked) {
+		t.Fatalf("EncryptSecret() without a token = %v, want ErrLocked", err)
+	}
+
+	// A token from a later unlock opens the same vault
+	Lock(user.ID)
+	if _, err := DecryptSecret(unlocked, sealed, b); !errors.Is(err, ErrLocked) {
+		t.Fatalf("DecryptSecret() after Lock = %v, want ErrLocked", err)
+	}
+	token, _, err = Unlock(user.ID, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptSecret(WithToken(context.Background(), token), sealed, b); err != nil || got != "hunter2" {
+		t.Fatalf("DecryptSecret() after Unlock = %q, %v", got, err)
+	}
+}
+
+func TestUnlockWrongPassphrase(t *testing.T) {
+	user, _, _ := setup(t)
+	if _, _, err := Unlock(user.ID, passphrase); !errors.Is(err, ErrNotEnabled) {
+		t.Fatalf("Unlock() before Enable = %v, want ErrNotEnabled", err)
+	}
+	if _, _, err := Enable(user.ID, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Unlock(user.ID, "incorrect horse battery"); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Fatalf("Unlock() = %v, want ErrIncorrectPassphrase", err)
+	}
+	if err := Disable(user.ID, "incorrect horse battery"); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Fatalf("Disable() = %v, want ErrIncorrectPassphrase", err)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	user, server, b := setup(t)
+	ttl := unlockTTL
+	unlockTTL = 200 * time.Millisecond
+	t.Cleanup(func() { unlockTTL = ttl })
+
+	token, _, err := Enable(user.ID, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithToken(context.Background(), token)
+	sealed := storedSecret(t, server)
+
+	// Use extends the token
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := DecryptSecret(ctx, sealed, b); err != nil {
+			t.Fatalf("DecryptSecret() while in use = %v", err)
+		}
+	}
+	if _, ok := Unlocked(ctx, user.ID); !ok {
+		t.Fatal("Unlocked() is false while the token is live")
+	}
+	if _, ok := Unlocked(ctx, user.ID+1); ok {
+		t.Fatal("token unlocks another user's vault")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := Unlocked(ctx, user.ID); ok {
+		t.Fatal("Unlocked() is true after the token expired")
+	}
+	if _, err := DecryptSecret(ctx, sealed, b); !errors.Is(err, ErrLocked) {
+		t.Fatalf("DecryptSecret() after expiry = %v, want ErrLocked", err)
+	}
+}
+
+func TestDisableReseals(t *testing.T) {
+	user, server, b := setup(t)
+	if _, _, err := Enable(user.ID, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := Unlock(user.ID, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Disable(user.ID, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := Enabled(user.ID); err != nil || enabled {
+		t.Fatalf("Enabled() = %v, %v after Disable", enabled, err)
+	}
+	sealed := storedSecret(t, server)
+	if crypto.IsKeySealed(sealed) {
+		t.Fatal("secret is still sealed under the vault key")
+	}
+	if got, err := crypto.Decrypt(sealed, b); err != nil || got != "hunter2" {
+		t.Fatalf("Decrypt() under the server key = %q, %v", got, err)
+	}
+	if _, ok := Unlocked(WithToken(context.Background(), token), user.ID); ok {
+		t.Fatal("unlock token survived Disable")
+	}
+}
+
+func TestLockedError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, ErrLocked)
+	if w.Code != http.StatusLocked {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusLocked)
+	}
+	var payload map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["code"] != "credentials_locked" {
+		t.Errorf("code = %q, want credentials_locked", payload["code"])
+	}
+}
@@ -0,0 +1,471 @@
+// Package proxy reverse-proxies HTTP and WebSocket traffic to services that
+// listen on a remote host, such as a dashboard on localhost:3000, through
+// direct-tcpip channels of the server's SSH connection. It also tunnels raw
+// TCP over /ws/tunnel for clients such as cmd/tunnel.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"web-ssh-backend/internal/access"
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+)
+
+// CookieName holds the proxy session; it is never passed on to the service.
+const CookieName = "web_ssh_proxy"
+
+var (
+	// sessionTTL is how long an unused proxy session keeps its SSH connection.
+	sessionTTL = 30 * time.Minute
+	// proxyDomain is the parent of the per-server proxy origins; the HTTP
+	// proxy is off without it. See serverHost.
+	proxyDomain string
+)
+
+var ErrTunnelsDisabled = errors.New("tunnels are disabled for this server")
+
+// session is a browser's authenticated use of the proxy for one server. It
+// leases one pooled SSH connection that every proxied request opens
+// channels on.
+type session struct {
+	userID      uint
+	serverID    uint
+	unlockToken string
+	expiresAt   time.Time
+
+	mu         sync.Mutex
+	lease      *sshconn.Lease
+	transports map[int]*http.Transport
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*session)
+)
+
+// Init reads PROXY_DOMAIN and PROXY_SESSION_TTL and starts closing idle
+// proxy sessions.
+func Init() {
+	proxyDomain = strings.ToLower(strings.Trim(os.Getenv("PROXY_DOMAIN"), "."))
+	if v := os.Getenv("PROXY_SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid PROXY_SESSION_TTL %q", v)
+		}
+		sessionTTL = d
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			expireSessions()
+		}
+	}()
+}
+
+// serverHost is the host a server's services are proxied on:
+// "<server_id>.<PROXY_DOMAIN>". Giving each server its own origin keeps a
+// proxied page from reading the backend's, or another server's, pages and
+// cookies.
+func serverHost(serverID uint) string {
+	return fmt.Sprintf("%d.%s", serverID, proxyDomain)
+}
+
+// Handle serves /proxy/{server_id}/{port}/... from port on the server's
+// loopback interface, on the server's own origin. The first request carries
+// a "proxy" ticket from /api/ws-ticket, which is traded for a cookie scoped
+// to that origin.
+func Handle(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverID, err := strconv.ParseUint(vars["server_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.Atoi(vars["port"])
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	prefix := fmt.Sprintf("/proxy/%d/%d", serverID, port)
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if proxyDomain == "" {
+		http.Error(w, "The HTTP proxy is disabled; set PROXY_DOMAIN to enable it", http.StatusNotFound)
+		return
+	}
+	// The gateway may listen on a non-default port, which the server's
+	// origin keeps
+	hostname, listenPort := r.Host, ""
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		hostname, listenPort = h, p
+	}
+	if host := serverHost(uint(serverID)); !strings.EqualFold(hostname, host) {
+		scheme := "http"
+		if isSecure(r) {
+			scheme = "https"
+		}
+		if listenPort != "" {
+			host = net.JoinHostPort(host, listenPort)
+		}
+		http.Redirect(w, r, scheme+"://"+host+r.URL.RequestURI(), http.StatusFound)
+		return
+	}
+	if !allowedFetch(r) {
+		http.Error(w, "Cross-site requests to proxied services are refused", http.StatusForbidden)
+		return
+	}
+
+	if value := r.URL.Query().Get("ticket"); value != "" {
+		startSession(w, r, uint(serverID), value)
+		return
+	}
+
+	// Relative links only resolve below the prefix with a trailing slash
+	if r.URL.Path == prefix {
+		http.Redirect(w, r, prefix+"/", http.StatusFound)
+		return
+	}
+
+	s := lookupSession(r, uint(serverID))
+	if s == nil {
+		http.Error(w, "Proxy session required; open this URL with a proxy ticket", http.StatusUnauthorized)
+		return
+	}
+
+	// Re-check access: a grant may have been revoked since the session began
+	server, err := access.ResolveServer(s.userID, s.serverID)
+	if err != nil {
+		access.WriteError(w, err)
+		return
+	}
+	if !server.TunnelsEnabled {
+		http.Error(w, ErrTunnelsDisabled.Error(), http.StatusForbidden)
+		return
+	}
+	s.dropStale()
+
+	target := net.JoinHostPort("localhost", strconv.Itoa(port))
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = target
+			pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, prefix)
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = target
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			stripSessionCookie(pr.Out)
+		},
+		Transport: s.transport(port),
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteResponse(resp, prefix, port)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			writeProxyError(w, err, port)
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// startSession redeems a proxy ticket for serverID, sets the session cookie
+// and redirects to the same URL without the ticket.
+func startSession(w http.ResponseWriter, r *http.Request, serverID uint, value string) {
+	ticket, err := auth.RedeemTicket(value, auth.ChannelProxy)
+	if err != nil {
+		access.WriteError(w, err)
+		return
+	}
+	if ticket.ServerID != serverID {
+		access.WriteError(w, access.ErrForbidden)
+		return
+	}
+	server, err := access.ResolveServer(ticket.UserID, serverID)
+	if err != nil {
+		access.WriteError(w, err)
+		return
+	}
+	if !server.TunnelsEnabled {
+		http.Error(w, ErrTunnelsDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Failed to start proxy session", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	sessionsMu.Lock()
+	sessions[token] = &session{
+		userID:      ticket.UserID,
+		serverID:    serverID,
+		unlockToken: ticket.UnlockToken,
+		expiresAt:   time.Now().Add(sessionTTL),
+		transports:  make(map[int]*http.Transport),
+	}
+	sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     fmt.Sprintf("/proxy/%d/", serverID),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	u := *r.URL
+	q := u.Query()
+	q.Del("ticket")
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+}
+
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// allowedFetch reports whether r may reach a proxied service. Other sites,
+// including the proxy origins of other servers, may only navigate to it;
+// their subresource requests and form posts would otherwise carry the
+// session cookie. Browsers that don't send Fetch Metadata are let through.
+func allowedFetch(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-site", "cross-site":
+		return r.Header.Get("Sec-Fetch-Mode") == "navigate" && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+	}
+	return true
+}
+
+// lookupSession returns the live session in r's cookie for serverID,
+// extending its lifetime.
+func lookupSession(r *http.Request, serverID uint) *session {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[cookie.Value]
+	if !ok || s.serverID != serverID || time.Now().After(s.expiresAt) {
+		return nil
+	}
+	s.expiresAt = time.Now().Add(sessionTTL)
+	return s
+}
+
+// expireSessions drops idle sessions and closes their connections.
+func expireSessions() {
+	sessionsMu.Lock()
+	var expired []*session
+	now := time.Now()
+	for token, s := range sessions {
+		if now.After(s.expiresAt) {
+			delete(sessions, token)
+			expired = append(expired, s)
+		}
+	}
+	sessionsMu.Unlock()
+
+	for _, s := range expired {
+		s.close()
+	}
+}
+
+// transport returns the HTTP transport for port, whose connections are
+// direct-tcpip channels on the session's SSH connection.
+func (s *session) transport(port int) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.transports[port]; ok {
+		return t
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dial(ctx, addr)
+		},
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	s.transports[port] = t
+	return t
+}
+
+// dial opens a channel to addr, reconnecting once if the SSH connection
+// has dropped.
+func (s *session) dial(ctx context.Context, addr string) (net.Conn, error) {
+	lease, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lease.Client.DialContext(ctx, "tcp", addr)
+	var refused *ssh.OpenChannelError
+	if err == nil || errors.As(err, &refused) || ctx.Err() != nil {
+		return conn, err
+	}
+
+	s.reset(lease)
+	if lease, err = s.connect(); err != nil {
+		return nil, err
+	}
+	return lease.Client.DialContext(ctx, "tcp", addr)
+}
+
+// connect returns the session's lease on an SSH connection, acquiring one
+// with the server's current settings if needed.
+func (s *session) connect() (*sshconn.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease != nil {
+		return s.lease, nil
+	}
+
+	server, err := access.ResolveServer(s.userID, s.serverID)
+	if err != nil {
+		return nil, err
+	}
+	ctx := passvault.WithToken(context.Background(), s.unlockToken)
+	lease, err := sshconn.Acquire(ctx, server, &sshconn.Options{UserID: s.userID})
+	if err != nil {
+		return nil, err
+	}
+	s.lease = lease
+	return lease, nil
+}
+
+// dropStale releases the session's lease once its connection has been
+// evicted, as when the server is edited, along with the idle HTTP
+// connections running over it. The next request dials with the server's
+// current settings.
+func (s *session) dropStale() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == nil || !s.lease.Stale() {
+		return
+	}
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+	s.lease.Release()
+	s.lease = nil
+}
+
+// reset discards lease, whose connection has failed, if it is still the
+// session's.
+func (s *session) reset(lease *sshconn.Lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == lease {
+		s.lease.Discard()
+		s.lease = nil
+	}
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transports {
+		t.CloseIdleConnections()
+	}
+	if s.lease != nil {
+		s.lease.Release()
+		s.lease = nil
+	}
+}
+
+// stripSessionCookie removes the proxy session cookie from r so the
+// service never sees it.
+func stripSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != CookieName {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// rewriteResponse maps redirects and cookie paths of the service, which
+// thinks it is served from /, back under prefix.
+func rewriteResponse(resp *http.Response, prefix string, port int) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil {
+			switch {
+			case u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(loc, "//"):
+				resp.Header.Set("Location", prefix+loc)
+			case isLoopback(u, port):
+				u.Scheme, u.Host, u.User = "", "", nil
+				resp.Header.Set("Location", prefix+u.RequestURI())
+			}
+		}
+	}
+
+	setCookies := resp.Header.Values("Set-Cookie")
+	resp.Header.Del("Set-Cookie")
+	for _, line := range setCookies {
+		c, err := http.ParseSetCookie(line)
+		if err != nil || c.Name == CookieName {
+			continue
+		}
+		path := c.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/"
+		}
+		c.Path = prefix + path
+		c.Domain = ""
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+}
+
+// isLoopback reports whether u points at port on the remote host itself.
+func isLoopback(u *url.URL, port int) bool {
+	if u.Port() != strconv.Itoa(port) {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// writeProxyError reports a failure to reach the service: a refused
+// channel names the port, and failed connections to the server carry the
+// same structured errors as other endpoints.
+func writeProxyError(w http.ResponseWriter, err error, port int) {
+	var refused *ssh.OpenChannelError
+	if errors.As(err, &refused) {
+		http.Error(w, fmt.Sprintf("Nothing is accepting connections on remote port %d: %v", port, refused), http.StatusBadGateway)
+		return
+	}
+	if sshconn.ErrorCode(err) == "" {
+		http.Error(w, "Proxy error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	sshconn.WriteError(w, err, "")
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.PathPrefix("/proxy/{server_id:[0-9]+}/{port:[0-9]+}").HandlerFunc(Handle)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandleOrigin(t *testing.T) {
+	proxyDomain = ""
+	if w := serve(httptest.NewRequest("GET", "http://localhost:8080/proxy/5/3000/", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("without PROXY_DOMAIN: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	proxyDomain = "proxy.example.com"
+	t.Cleanup(func() { proxyDomain = "" })
+
+	tests := []struct {
+		name     string
+		url      string
+		site     string // Sec-Fetch-Site
+		mode     string // Sec-Fetch-Mode
+		method   string
+		want     int
+		location string
+	}{
+		{"backend origin", "https://api.example.com/proxy/5/3000/app?x=1", "", "", "GET", http.StatusFound, "https://5.proxy.example.com/proxy/5/3000/app?x=1"},
+		{"another server's origin", "http://6.proxy.example.com/proxy/5/3000/", "", "", "GET", http.StatusFound, "http://5.proxy.example.com/proxy/5/3000/"},
+		{"backend origin on a port", "http://api.example.com:8080/proxy/5/3000/", "", "", "GET", http.StatusFound, "http://5.proxy.example.com:8080/proxy/5/3000/"},
+		{"own origin", "http://5.proxy.example.com/proxy/5/3000/", "same-origin", "cors", "GET", http.StatusUnauthorized, ""},
+		{"own origin on a port", "http://5.PROXY.example.com:8080/proxy/5/3000/", "same-origin", "cors", "GET", http.StatusUnauthorized, ""},
+		{"navigation from another site", "http://5.proxy.example.com/proxy/5/3000/", "cross-site", "navigate", "GET", http.StatusUnauthorized, ""},
+		{"fetch from another server", "http://5.proxy.example.com/proxy/5/3000/", "same-site", "cors", "GET", http.StatusForbidden, ""},
+		{"form post from another site", "http://5.proxy.example.com/proxy/5/3000/", "cross-site", "navigate", "POST", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.site != "" {
+				r.Header.Set("Sec-Fetch-Site", tt.site)
+				r.Header.Set("Sec-Fetch-Mode", tt.mode)
+			}
+			w := serve(r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if loc := w.Header().Get("Location"); loc != tt.location {
+				t.Errorf("Location %q, want %q", loc, tt.location)
+			}
+		})
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Location", "http://localhost:3000/login?next=/")
+	resp.Header.Add("Set-Cookie", "session=abc; Path=/; Domain=proxy.example.com")
+	resp.Header.Add("Set-Cookie", CookieName+"=forged; Path=/")
+
+	rewriteResponse(resp, "/proxy/5/3000", 3000)
+
+	if loc := resp.Header.Get("Location"); loc != "/proxy/5/3000/login?next=/" {
+		t.Errorf("Location %q", loc)
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 1 || cookies[0] != "session=abc; Path=/proxy/5/3000/" {
+		t.Errorf("Set-Cookie %q, want only the service's cookie, host-only and under the prefix", cookies)
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"web-ssh-backend/internal/access"
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
+	"web-ssh-backend/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// HandleTunnelWebSocket carries raw TCP over /ws/tunnel to a host:port as
+// seen from the server, through direct-tcpip channels. With host and port in
+// the query it relays one connection as binary messages; with mode=mux it
+// speaks the tunnel package's framing so one WebSocket carries many.
+func HandleTunnelWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Redeem the one-time ticket issued by /api/ws-ticket before upgrading
+	server, ticket, err := access.ServerFromTicket(r, auth.ChannelTunnel)
+	if err != nil {
+		access.WriteError(w, err)
+		return
+	}
+	if !server.TunnelsEnabled {
+		http.Error(w, ErrTunnelsDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	muxMode := query.Get("mode") == "mux"
+	var target string
+	if !muxMode {
+		port, err := strconv.Atoi(query.Get("port"))
+		if err != nil || port < 1 || port > 65535 {
+			http.Error(w, "Invalid port", http.StatusBadRequest)
+			return
+		}
+		host := query.Get("host")
+		if host == "" {
+			host = "localhost"
+		}
+		target = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	ctx := passvault.WithToken(context.Background(), ticket.UnlockToken)
+	lease, err := sshconn.Acquire(ctx, server, &sshconn.Options{UserID: ticket.UserID})
+	if err != nil {
+		closeTunnel(ws, connectErrorText(err))
+		return
+	}
+	defer lease.Release()
+	client := lease.Client
+
+	done := make(chan struct{})
+	defer close(done)
+	keepAlive(ws, lease.Done(), done)
+
+	if muxMode {
+		m := tunnel.NewMux(ws)
+		m.Serve(func(target string) (net.Conn, error) {
+			return client.Dial("tcp", target)
+		})
+		return
+	}
+
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		closeTunnel(ws, err.Error())
+		return
+	}
+	tunnel.Relay(conn, &wsStream{ws: ws})
+}
+
+// keepAlive pings the WebSocket until done closes, and closes it if the
+// SSH connection ends first.
+func keepAlive(ws *websocket.Conn, sshDone, done <-chan struct{}) {
+	const (
+		writeWait  = 10 * time.Second
+		pongWait   = 60 * time.Second
+		pingPeriod = (pongWait * 9) / 10
+	)
+
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// WriteControl is safe alongside the relay's writes
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					return
+				}
+			case <-sshDone:
+				closeTunnel(ws, "connection to server lost")
+				ws.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// connectErrorText describes a failed connection in a close frame, which
+// has no room for the structured payloads other endpoints send, as
+// "code: message".
+func connectErrorText(err error) string {
+	code := sshconn.ErrorCode(err)
+	text := err.Error()
+	switch code {
+	case sshconn.CodeHostKeyChanged:
+		text = "host key changed; review it before connecting"
+	case sshconn.CodeHostKeyUnpinned:
+		text = "host key not pinned; review it before connecting"
+	case sshconn.CodeCredentialsLocked:
+		text = passvault.ErrLocked.Error()
+	}
+	if code != "" {
+		text = code + ": " + text
+	}
+	return text
+}
+
+// closeTunnel ends the WebSocket with reason, cut to fit a close frame.
+func closeTunnel(ws *websocket.Conn, reason string) {
+	const maxReason = 123 // 125-byte control payload less the status code
+	if len(reason) > maxReason {
+		reason = reason[:maxReason]
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason)
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(10*time.Second))
+}
+
+// wsStream reads and writes a single tunnelled connection as binary
+// WebSocket messages.
+type wsStream struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		msgType, data, err := s.ws.ReadMessage()
+		if err != nil {
+			return 0, io.EOF
+		}
+		if msgType == websocket.BinaryMessage {
+			s.buf = data
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	s.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return s.ws.Close()
+}
@@ -0,0 +1,168 @@
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+)
+
+// Recorder writes a terminal session as an asciicast v2 file.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type Recorder struct {
+	mu      sync.Mutex
+	rec     *models.SessionRecording
+	w       io.WriteCloser
+	start   time.Time
+	size    int64
+	pending []byte // Incomplete UTF-8 sequence carried to the next write
+	closed  bool
+}
+
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Enabled reports whether sessions on server should be recorded, either
+// because the server or its folder opted in.
+func Enabled(server *models.Server) bool {
+	if server.RecordSessions {
+		return true
+	}
+	if server.FolderID == nil {
+		return false
+	}
+	var folder models.Folder
+	if err := db.DB.Select("record_sessions").First(&folder, *server.FolderID).Error; err != nil {
+		return false
+	}
+	return folder.RecordSessions
+}
+
+// Start creates a recording for a session opened by userID on server.
+func Start(userID uint, server *models.Server, cols, rows int) (*Recorder, error) {
+	now := time.Now()
+	rec := &models.SessionRecording{
+		UserID:    userID,
+		ServerID:  server.ID,
+		Cols:      cols,
+		Rows:      rows,
+		StartedAt: now,
+	}
+	if err := db.DB.Create(rec).Error; err != nil {
+		return nil, err
+	}
+
+	rec.StorageKey = fmt.Sprintf("%d/%d-%s.cast", server.ID, rec.ID, now.UTC().Format("20060102T150405Z"))
+	if err := db.DB.Model(rec).Update("storage_key", rec.StorageKey).Error; err != nil {
+		return nil, err
+	}
+
+	w, err := store.Create(rec.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{rec: rec, w: w, start: now}
+	if err := r.writeLine(header{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: now.Unix(),
+		Title:     server.Name,
+		Env:       map[string]string{"TERM": "xterm"},
+	}); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write records terminal output. It never fails so that a broken recording
+// does not interrupt the session it records.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending, p...)
+	cut := len(data)
+	// Hold back a trailing partial rune; it completes in the next chunk
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				cut = len(data) - i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+
+	if cut > 0 {
+		r.event("o", string(data[:cut]))
+	}
+	return len(p), nil
+}
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(cols, rows int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close finishes the file and stores the end time and size.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	r.closed = true
+
+	err := r.w.Close()
+	now := time.Now()
+	if dbErr := db.DB.Model(r.rec).Updates(map[string]interface{}{
+		"ended_at": now,
+		"size":     r.size,
+	}).Error; dbErr != nil && err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+func (r *Recorder) event(kind, data string) {
+	if r.closed {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	if err := r.writeLine([]interface{}{elapsed, kind, data}); err != nil {
+		log.Printf("Recording %d write failed: %v", r.rec.ID, err)
+	}
+}
+
+func (r *Recorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	n, err := r.w.Write(append(line, '\n'))
+	r.size += int64(n)
+	return err
+}
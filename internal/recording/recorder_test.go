@@ -0,0 +1,142 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+// setup stores recordings in a temporary directory and returns a server to
+// record sessions on.
+func setup(t *testing.T) *models.Server {
+	dbtest.Open(t)
+	t.Setenv("RECORDING_STORAGE", "")
+	t.Setenv("RECORDING_DIR", t.TempDir())
+	Init()
+	server := models.Server{UserID: 1, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, &server)
+	return &server
+}
+
+// readCast returns the header and events of the recording rec.
+func readCast(t *testing.T, rec *models.SessionRecording) (header, [][]interface{}) {
+	t.Helper()
+	file, err := Open(rec.StorageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var h header
+	if !scanner.Scan() {
+		t.Fatal("recording is empty")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	var events [][]interface{}
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("event %q: %v", scanner.Text(), err)
+		}
+		if len(event) != 3 {
+			t.Fatalf("event %q doesn't have 3 fields", scanner.Text())
+		}
+		events = append(events, event)
+	}
+	return h, events
+}
+
+func TestRecorder(t *testing.T) {
+	server := setup(t)
+	started := time.Now()
+	r, err := Start(2, server, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Write([]byte("hello "))
+	time.Sleep(50 * time.Millisecond)
+	// "é" and "€" split across writes
+	r.Write([]byte{0xc3})
+	r.Write([]byte{0xa9, 0xe2, 0x82})
+	r.Write([]byte{0xac})
+	r.Resize(100, 30)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec models.SessionRecording
+	if err := db.DB.First(&rec, r.rec.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec.UserID != 2 || rec.ServerID != server.ID || rec.Cols != 80 || rec.Rows != 24 {
+		t.Errorf("recording row = %+v", rec)
+	}
+	if rec.EndedAt == nil || rec.Size != r.size {
+		t.Errorf("ended_at = %v, size = %d; want the end time and size %d", rec.EndedAt, rec.Size, r.size)
+	}
+
+	h, events := readCast(t, &rec)
+	want := header{Version: 2, Width: 80, Height: 24, Timestamp: started.Unix(), Title: "web", Env: map[string]string{"TERM": "xterm"}}
+	if h.Version != want.Version || h.Width != want.Width || h.Height != want.Height || h.Title != want.Title || h.Env["TERM"] != "xterm" {
+		t.Errorf("header = %+v, want %+v", h, want)
+	}
+	if d := h.Timestamp - want.Timestamp; d < 0 || d > 1 {
+		t.Errorf("header timestamp = %d, want about %d", h.Timestamp, want.Timestamp)
+	}
+
+	wantEvents := []struct{ kind, data string }{
+		{"o", "hello "},
+		{"o", "é"},
+		{"o", "€"},
+		{"r", "100x30"},
+	}
+	if len(events) != len(wantEvents) {
+		t.Fatalf("events = %v, want %d", events, len(wantEvents))
+	}
+	var last float64
+	for i, event := range events {
+		elapsed, _ := event[0].(float64)
+		if event[1] != wantEvents[i].kind || event[2] != wantEvents[i].data {
+			t.Errorf("event %d = %v, want %q %q", i, event, wantEvents[i].kind, wantEvents[i].data)
+		}
+		if elapsed < last {
+			t.Errorf("event %d at %f, before the previous one at %f", i, elapsed, last)
+		}
+		last = elapsed
+	}
+	if first, second := events[0][0].(float64), events[1][0].(float64); first > 0.05 || second-first < 0.05 {
+		t.Errorf("events at %f and %f, want the second 50ms after the first", first, second)
+	}
+}
+
+func TestRecorderFlushesPartialRuneOnClose(t *testing.T) {
+	server := setup(t)
+	r, err := Start(1, server, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("ok\xe2\x82"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after Close are dropped
+	r.Write([]byte("late"))
+
+	_, events := readCast(t, r.rec)
+	if len(events) != 2 || events[0][2] != "ok" {
+		t.Fatalf("events = %v, want the output and the held back bytes", events)
+	}
+	// JSON encoding replaces each byte of the cut off rune
+	if events[1][1] != "o" || events[1][2] != "\ufffd\ufffd" {
+		t.Errorf("held back bytes recorded as %v, want replacement characters", events[1])
+	}
+}
@@ -0,0 +1,79 @@
+package recording
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage persists recording files. Keys are slash-separated relative paths.
+type Storage interface {
+	Create(key string) (io.WriteCloser, error)
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+}
+
+// LocalStorage stores recordings as files below Dir.
+type LocalStorage struct {
+	Dir string
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid recording key %q", key)
+	}
+	return filepath.Join(s.Dir, clean), nil
+}
+
+func (s *LocalStorage) Create(key string) (io.WriteCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+}
+
+func (s *LocalStorage) Open(key string) (io.ReadSeekCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+var store Storage
+
+// Init selects the storage backend from RECORDING_STORAGE. Only "local"
+// (the default) is available; files go to RECORDING_DIR.
+func Init() {
+	switch backend := os.Getenv("RECORDING_STORAGE"); backend {
+	case "", "local":
+		dir := os.Getenv("RECORDING_DIR")
+		if dir == "" {
+			dir = "recordings"
+		}
+		store = &LocalStorage{Dir: dir}
+	default:
+		log.Fatalf("Unknown RECORDING_STORAGE backend: %s", backend)
+	}
+}
+
+// Open opens a stored recording for reading.
+func Open(key string) (io.ReadSeekCloser, error) {
+	return store.Open(key)
+}
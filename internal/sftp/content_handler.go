@@ -3,6 +3,8 @@ package sftp
 import (
 	"encoding/json"
 	"net/http"
+
+	"web-ssh-backend/internal/sshconn"
 )
 
 func HandleSaveFileContent(w http.ResponseWriter, r *http.Request) {
@@ -17,13 +19,18 @@ func HandleSaveFileContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sshClient, sftpClient, err := connectSFTP(uint(req.ServerID))
+	server, ok := resolveServer(w, r, uint(req.ServerID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	file, err := sftpClient.Create(req.Path)
 	if err != nil {
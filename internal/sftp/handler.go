@@ -4,21 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"mime"
-	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
-	"web-ssh-backend/internal/crypto"
-	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/access"
+	"web-ssh-backend/internal/auth"
 	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshconn"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/sftp"
-	"golang.org/x/crypto/ssh"
 )
 
 var upgrader = websocket.Upgrader{
@@ -28,9 +28,10 @@ var upgrader = websocket.Upgrader{
 }
 
 type SFTPMessage struct {
-	Action string `json:"action"` // "ls", "mkdir", "rm", "mv"
-	Path   string `json:"path"`
-	Dest   string `json:"dest,omitempty"` // For mv
+	Action  string   `json:"action"` // "ls", "mkdir", "rm", "mv", "auth_response"
+	Path    string   `json:"path"`
+	Dest    string   `json:"dest,omitempty"`    // For mv
+	Answers []string `json:"answers,omitempty"` // For auth_response, one per prompt
 }
 
 type FileInfo struct {
@@ -40,125 +41,58 @@ type FileInfo struct {
 	Mode  string `json:"mode"`
 }
 
-func connectSFTP(serverID uint) (*ssh.Client, *sftp.Client, error) {
-	var server models.Server
-	if err := db.DB.First(&server, serverID).Error; err != nil {
-		return nil, nil, err
+// resolveServer loads serverID on behalf of the authenticated caller. On
+// failure it writes the error response and returns false.
+func resolveServer(w http.ResponseWriter, r *http.Request, serverID uint) (*models.Server, bool) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
 	}
 
-	secret, err := crypto.Decrypt(server.EncryptedSecret)
+	server, err := access.ResolveServer(userID, serverID)
 	if err != nil {
-		return nil, nil, err
+		access.WriteError(w, err)
+		return nil, false
 	}
-
-	authMethod := ssh.Password(secret)
-	if server.AuthType == "key" {
-		signer, err := ssh.ParsePrivateKey([]byte(secret))
-		if err != nil {
-			return nil, nil, err
-		}
-		authMethod = ssh.PublicKeys(signer)
-	}
-
-	config := &ssh.ClientConfig{
-		User:            server.Username,
-		Auth:            []ssh.AuthMethod{authMethod},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", server.Host, server.Port), config)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	sftpClient, err := sftp.NewClient(sshClient)
-	if err != nil {
-		sshClient.Close()
-		return nil, nil, err
-	}
-
-	return sshClient, sftpClient, nil
+	return server, true
 }
 
-func connectSFTPWithKeepalive(ctx context.Context, serverID uint) (*ssh.Client, *sftp.Client, error) {
-	var server models.Server
-	if err := db.DB.First(&server, serverID).Error; err != nil {
-		return nil, nil, err
-	}
-
-	secret, err := crypto.Decrypt(server.EncryptedSecret)
-	if err != nil {
-		return nil, nil, err
-	}
+// connectSFTP opens an SFTP subsystem on a pooled connection to server for
+// the authenticated user in ctx. Close the SFTP client, then release the
+// lease.
+func connectSFTP(ctx context.Context, server *models.Server) (*sshconn.Lease, *sftp.Client, error) {
+	userID, _ := auth.UserIDFromContext(ctx)
+	return openSFTP(ctx, server, &sshconn.Options{UserID: userID})
+}
 
-	authMethod := ssh.Password(secret)
-	if server.AuthType == "key" {
-		signer, err := ssh.ParsePrivateKey([]byte(secret))
+// openSFTP leases a connection to server and starts the SFTP subsystem on
+// it. A reused connection that turns out to be broken is replaced.
+func openSFTP(ctx context.Context, server *models.Server, opts *sshconn.Options) (*sshconn.Lease, *sftp.Client, error) {
+	for {
+		lease, err := sshconn.Acquire(ctx, server, opts)
 		if err != nil {
 			return nil, nil, err
 		}
-		authMethod = ssh.PublicKeys(signer)
-	}
-
-	config := &ssh.ClientConfig{
-		User:            server.Username,
-		Auth:            []ssh.AuthMethod{authMethod},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
-
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 15 * time.Second,
-	}
-
-	addr := fmt.Sprintf("%s:%d", server.Host, server.Port)
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
-	if err != nil {
-		conn.Close()
-		return nil, nil, err
-	}
-	sshClient := ssh.NewClient(sshConn, chans, reqs)
-
-	// SSH keepalive (application-level) to survive server-side idle timeouts.
-	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
-				if err != nil {
-					log.Printf("SFTP SSH keepalive failed: %v", err)
-					return
-				}
-			}
+		sftpClient, err := sftp.NewClient(lease.Client)
+		if err == nil {
+			return lease, sftpClient, nil
 		}
-	}()
-
-	sftpClient, err := sftp.NewClient(sshClient)
-	if err != nil {
-		sshClient.Close()
-		return nil, nil, err
+		if !lease.Reused {
+			lease.Release()
+			return nil, nil, err
+		}
+		lease.Discard()
 	}
-
-	return sshClient, sftpClient, nil
 }
 
 func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Token validation should be done via middleware or query param check similar to SSH
-	// For brevity, assuming valid token passed in query and validated (omitted here)
-
-	serverIDStr := r.URL.Query().Get("server_id")
-	serverID, _ := strconv.Atoi(serverIDStr)
+	// Redeem the one-time ticket issued by /api/ws-ticket before upgrading
+	server, ticket, err := access.ServerFromTicket(r, auth.ChannelSFTP)
+	if err != nil {
+		access.WriteError(w, err)
+		return
+	}
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -181,6 +115,15 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	// gorilla/websocket allows only one concurrent writer
+	var writeMu sync.Mutex
+	send := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		return ws.WriteJSON(v)
+	}
+
 	pingTicker := time.NewTicker(pingPeriod)
 	defer pingTicker.Stop()
 
@@ -189,8 +132,11 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 		for {
 			select {
 			case <-pingTicker.C:
+				writeMu.Lock()
 				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				err := ws.WriteMessage(websocket.PingMessage, nil)
+				writeMu.Unlock()
+				if err != nil {
 					return
 				}
 			case <-done:
@@ -199,17 +145,46 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	ctx, cancel := context.WithCancel(r.Context())
+	ctx, cancel := context.WithCancel(passvault.WithToken(r.Context(), ticket.UnlockToken))
 	defer cancel()
 
-	sshClient, sftpClient, err := connectSFTPWithKeepalive(ctx, uint(serverID))
+	// Relay keyboard-interactive questions (e.g. a TOTP code) to the client
+	prompt := func(srv *models.Server, name, instruction string, prompts []sshconn.Prompt) ([]string, error) {
+		if err := send(map[string]interface{}{
+			"action":      "auth_prompt",
+			"server":      srv.Name,
+			"name":        name,
+			"instruction": instruction,
+			"prompts":     prompts,
+		}); err != nil {
+			return nil, err
+		}
+
+		ws.SetReadDeadline(time.Now().Add(sshconn.PromptTimeout))
+		defer ws.SetReadDeadline(time.Now().Add(pongWait))
+
+		for {
+			var msg SFTPMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				return nil, err
+			}
+			switch msg.Action {
+			case "auth_response":
+				return msg.Answers, nil
+			case "ping":
+				send(map[string]string{"action": "pong"})
+			}
+		}
+	}
+
+	lease, sftpClient, err := openSFTP(ctx, server, &sshconn.Options{Prompt: prompt, UserID: ticket.UserID})
 	if err != nil {
-		ws.WriteJSON(map[string]string{"error": err.Error()})
+		send(sshconn.ErrorPayload(err, ""))
 		close(done)
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	for {
 		var msg SFTPMessage
@@ -220,8 +195,7 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		switch msg.Action {
 		case "ping":
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			_ = ws.WriteJSON(map[string]string{"action": "pong"})
+			send(map[string]string{"action": "pong"})
 		case "ls":
 			path := msg.Path
 			if path == "" || path == "." {
@@ -240,7 +214,7 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 
 			files, err := sftpClient.ReadDir(path)
 			if err != nil {
-				ws.WriteJSON(map[string]string{"error": err.Error()})
+				send(map[string]string{"error": err.Error()})
 				continue
 			}
 			var fileList []FileInfo
@@ -252,17 +226,14 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 					Mode:  f.Mode().String(),
 				})
 			}
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			ws.WriteJSON(map[string]interface{}{"action": "ls", "path": path, "files": fileList})
+			send(map[string]interface{}{"action": "ls", "path": path, "files": fileList})
 
 		case "mkdir":
 			err := sftpClient.Mkdir(msg.Path)
 			if err != nil {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				ws.WriteJSON(map[string]string{"error": err.Error()})
+				send(map[string]string{"error": err.Error()})
 			} else {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				ws.WriteJSON(map[string]string{"status": "ok", "action": "mkdir"})
+				send(map[string]string{"status": "ok", "action": "mkdir"})
 			}
 
 		case "rm":
@@ -273,11 +244,9 @@ func HandleSFTPWebSocket(w http.ResponseWriter, r *http.Request) {
 				err = sftpClient.RemoveDirectory(msg.Path)
 			}
 			if err != nil {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				ws.WriteJSON(map[string]string{"error": err.Error()})
+				send(map[string]string{"error": err.Error()})
 			} else {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				ws.WriteJSON(map[string]string{"status": "ok", "action": "rm"})
+				send(map[string]string{"status": "ok", "action": "rm"})
 			}
 		}
 	}
@@ -288,13 +257,18 @@ func HandleDownload(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	serverID, _ := strconv.Atoi(serverIDStr)
 
-	sshClient, sftpClient, err := connectSFTP(uint(serverID))
+	server, ok := resolveServer(w, r, uint(serverID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	file, err := sftpClient.Open(path)
 	if err != nil {
@@ -359,13 +333,18 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	sshClient, sftpClient, err := connectSFTP(uint(serverID))
+	server, ok := resolveServer(w, r, uint(serverID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	remotePath := filepath.Join(destPath, header.Filename)
 	dstFile, err := sftpClient.Create(remotePath)
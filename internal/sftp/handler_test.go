@@ -0,0 +1,142 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+)
+
+const (
+	owner    = 1
+	grantee  = 2
+	stranger = 3
+	revoked  = 4 // Had a grant that was deleted
+)
+
+// setup stores two servers owned by owner, the first shared with grantee.
+// They use browser-held keys, so handlers that get past the access check
+// stop at 409 agent_required without dialing.
+func setup(t *testing.T) (shared, private uint) {
+	dbtest.Open(t)
+	var servers [2]models.Server
+	for i := range servers {
+		servers[i] = models.Server{UserID: owner, Name: fmt.Sprint("server", i), Host: "127.0.0.1", Port: 22, Username: "root", AuthType: "agent"}
+		dbtest.Create(t, &servers[i])
+	}
+	dbtest.Create(t, &models.ServerGrant{ServerID: servers[0].ID, UserID: grantee, GrantedBy: owner})
+	grant := models.ServerGrant{ServerID: servers[0].ID, UserID: revoked, GrantedBy: owner}
+	dbtest.Create(t, &grant)
+	if err := db.DB.Delete(&grant).Error; err != nil {
+		t.Fatal(err)
+	}
+	return servers[0].ID, servers[1].ID
+}
+
+// asUser authenticates r as userID the way auth.AuthMiddleware does.
+func asUser(r *http.Request, userID uint) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "user_id", float64(userID)))
+}
+
+func TestHandleDownloadAccess(t *testing.T) {
+	shared, private := setup(t)
+
+	tests := []struct {
+		name     string
+		userID   uint
+		serverID uint
+		want     int
+	}{
+		{"owner", owner, shared, http.StatusConflict},
+		{"grantee", grantee, shared, http.StatusConflict},
+		{"grantee on unshared server", grantee, private, http.StatusForbidden},
+		{"stranger", stranger, shared, http.StatusForbidden},
+		{"deleted grant", revoked, shared, http.StatusForbidden},
+		{"missing server", owner, private + 100, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", fmt.Sprintf("/api/sftp/download?server_id=%d&path=/etc/hostname", tt.serverID), nil)
+			w := httptest.NewRecorder()
+			HandleDownload(w, asUser(r, tt.userID))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleTransferAccess(t *testing.T) {
+	shared, private := setup(t)
+
+	tests := []struct {
+		name     string
+		userID   uint
+		src, dst uint
+		want     int
+	}{
+		{"owner", owner, shared, private, http.StatusConflict},
+		{"grantee between shared servers", grantee, shared, shared, http.StatusConflict},
+		{"grantee to unshared destination", grantee, shared, private, http.StatusForbidden},
+		{"grantee from unshared source", grantee, private, shared, http.StatusForbidden},
+		{"stranger", stranger, shared, shared, http.StatusForbidden},
+		{"deleted grant", revoked, shared, shared, http.StatusForbidden},
+		{"missing destination", owner, shared, private + 100, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"source_server_id":%d,"source_path":"/a","dest_server_id":%d,"dest_path":"/b"}`, tt.src, tt.dst)
+			r := httptest.NewRequest("POST", "/api/transfer", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			HandleTransfer(w, asUser(r, tt.userID))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSFTPWebSocketAccess(t *testing.T) {
+	shared, _ := setup(t)
+
+	tests := []struct {
+		name   string
+		userID uint
+		revoke bool // Delete the user's grant after the ticket is issued
+		want   int
+	}{
+		// Requests that pass the access check fail the upgrade, since
+		// they aren't WebSocket handshakes
+		{"owner", owner, false, http.StatusBadRequest},
+		{"grantee", grantee, false, http.StatusBadRequest},
+		{"stranger", stranger, false, http.StatusForbidden},
+		{"grant deleted after issue", grantee, true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := auth.IssueTicket(tt.userID, shared, auth.ChannelSFTP, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				db.DB.Where("user_id = ?", tt.userID).Delete(&models.ServerGrant{})
+				t.Cleanup(func() {
+					dbtest.Create(t, &models.ServerGrant{ServerID: shared, UserID: tt.userID, GrantedBy: owner})
+				})
+			}
+
+			w := httptest.NewRecorder()
+			HandleSFTPWebSocket(w, httptest.NewRequest("GET", "/ws/sftp?ticket="+value, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
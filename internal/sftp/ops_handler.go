@@ -5,6 +5,8 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+
+	"web-ssh-backend/internal/sshconn"
 )
 
 type FileOpRequest struct {
@@ -20,13 +22,18 @@ func HandleMoveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sshClient, sftpClient, err := connectSFTP(uint(req.ServerID))
+	server, ok := resolveServer(w, r, uint(req.ServerID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	// Rename handles move
 	// Ensure destination is the full path including filename
@@ -51,13 +58,18 @@ func HandleCopyFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sshClient, sftpClient, err := connectSFTP(uint(req.ServerID))
+	server, ok := resolveServer(w, r, uint(req.ServerID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	// Open source
 	srcFile, err := sftpClient.Open(req.SrcPath)
@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+
+	"web-ssh-backend/internal/sshconn"
 )
 
 type TransferRequest struct {
@@ -24,14 +26,24 @@ func HandleTransfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Authorize both ends before opening any connection
+	srcServer, ok := resolveServer(w, r, req.SourceServerID)
+	if !ok {
+		return
+	}
+	destServer, ok := resolveServer(w, r, req.DestServerID)
+	if !ok {
+		return
+	}
+
 	// 1. Connect to Source Server
-	srcSSH, srcSFTP, err := connectSFTP(req.SourceServerID)
+	srcLease, srcSFTP, err := connectSFTP(r.Context(), srcServer)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to source server: %v", err), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "Failed to connect to source server")
 		return
 	}
+	defer srcLease.Release()
 	defer srcSFTP.Close()
-	defer srcSSH.Close()
 
 	// 2. Open Source File
 	srcFile, err := srcSFTP.Open(req.SourcePath)
@@ -53,13 +65,13 @@ func HandleTransfer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 4. Connect to Destination Server
-	destSSH, destSFTP, err := connectSFTP(req.DestServerID)
+	destLease, destSFTP, err := connectSFTP(r.Context(), destServer)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to destination server: %v", err), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "Failed to connect to destination server")
 		return
 	}
+	defer destLease.Release()
 	defer destSFTP.Close()
-	defer destSSH.Close()
 
 	// 5. Create Destination File
 	// Ensure destination directory exists? For now assume user provides valid path or we just write to the path.
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"web-ssh-backend/internal/sshconn"
 )
 
 func HandleDownloadZip(w http.ResponseWriter, r *http.Request) {
@@ -15,13 +17,18 @@ func HandleDownloadZip(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	serverID, _ := strconv.Atoi(serverIDStr)
 
-	sshClient, sftpClient, err := connectSFTP(uint(serverID))
+	server, ok := resolveServer(w, r, uint(serverID))
+	if !ok {
+		return
+	}
+
+	lease, sftpClient, err := connectSFTP(r.Context(), server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sshconn.WriteError(w, err, "")
 		return
 	}
+	defer lease.Release()
 	defer sftpClient.Close()
-	defer sshClient.Close()
 
 	info, err := sftpClient.Stat(path)
 	if err != nil {
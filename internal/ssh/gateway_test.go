@@ -0,0 +1,301 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/sshconn"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestHandleSSHWebSocketAccess(t *testing.T) {
+	const (
+		owner    = 1
+		grantee  = 2
+		stranger = 3
+	)
+	dbtest.Open(t)
+	server := models.Server{UserID: owner, Name: "web", Host: "127.0.0.1", Port: 22, Username: "root", AuthType: "agent"}
+	dbtest.Create(t, &server)
+	dbtest.Create(t, &models.ServerGrant{ServerID: server.ID, UserID: grantee, GrantedBy: owner})
+
+	tests := []struct {
+		name     string
+		userID   uint
+		serverID uint
+		channel  string
+		query    string
+		revoke   bool // Delete the user's grant after the ticket is issued
+		want     int
+	}{
+		// Requests that pass the access check fail the upgrade, since
+		// they aren't WebSocket handshakes
+		{"owner", owner, server.ID, auth.ChannelSSH, "", false, http.StatusBadRequest},
+		{"grantee", grantee, server.ID, auth.ChannelSSH, "", false, http.StatusBadRequest},
+		{"stranger", stranger, server.ID, auth.ChannelSSH, "", false, http.StatusForbidden},
+		{"missing server", owner, server.ID + 100, auth.ChannelSSH, "", false, http.StatusNotFound},
+		{"grant deleted after issue", grantee, server.ID, auth.ChannelSSH, "", true, http.StatusForbidden},
+		{"ticket for another channel", owner, server.ID, auth.ChannelSFTP, "", false, http.StatusUnauthorized},
+		{"mismatched server_id", owner, server.ID, auth.ChannelSSH, "&server_id=999", false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, _, err := auth.IssueTicket(tt.userID, tt.serverID, tt.channel, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				db.DB.Where("user_id = ?", tt.userID).Delete(&models.ServerGrant{})
+				t.Cleanup(func() {
+					dbtest.Create(t, &models.ServerGrant{ServerID: server.ID, UserID: tt.userID, GrantedBy: owner})
+				})
+			}
+
+			w := httptest.NewRecorder()
+			HandleSSHWebSocket(w, httptest.NewRequest("GET", "/ws/ssh?ticket="+value+tt.query, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+
+			w = httptest.NewRecorder()
+			HandleSSHWebSocket(w, httptest.NewRequest("GET", "/ws/ssh?ticket="+value, nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("reused ticket: status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestPromptUser(t *testing.T) {
+	prev := promptTimeout
+	promptTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { promptTimeout = prev })
+
+	server := &models.Server{Name: "web"}
+	prompts := []sshconn.Prompt{{Text: "Password: "}, {Text: "Verification code: ", Echo: true}}
+
+	tests := []struct {
+		name    string
+		browser func(client *websocket.Conn) error // Answers the prompt
+		answers []string
+		err     string
+		timeout bool
+	}{
+		{
+			name: "answered",
+			browser: func(client *websocket.Conn) error {
+				var msg WSMessage
+				if err := client.ReadJSON(&msg); err != nil {
+					return err
+				}
+				if msg.Type != "auth_prompt" || msg.Server != "web" || msg.Name != "login" || msg.Instruction != "Two-factor" ||
+					len(msg.Prompts) != 2 || msg.Prompts[0] != prompts[0] || msg.Prompts[1] != prompts[1] {
+					return errors.New("unexpected prompt")
+				}
+				// Pings are answered while waiting, other messages ignored
+				client.WriteJSON(WSMessage{Type: "ping"})
+				if err := client.ReadJSON(&msg); err != nil || msg.Type != "pong" {
+					return errors.New("ping not answered")
+				}
+				client.WriteMessage(websocket.TextMessage, []byte("not json"))
+				client.WriteJSON(WSMessage{Type: "resize", Cols: 80, Rows: 24})
+				return client.WriteJSON(WSMessage{Type: "auth_response", Answers: []string{"hunter2", "123456"}})
+			},
+			answers: []string{"hunter2", "123456"},
+		},
+		{
+			name: "cancelled",
+			browser: func(client *websocket.Conn) error {
+				return client.WriteJSON(WSMessage{Type: "terminate"})
+			},
+			err: "authentication cancelled",
+		},
+		{
+			name:    "unanswered",
+			browser: func(client *websocket.Conn) error { return nil },
+			timeout: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := connPair(t)
+			browserErr := make(chan error, 1)
+			go func() { browserErr <- tt.browser(client) }()
+
+			answers, err := conn.promptUser(server, "login", "Two-factor", prompts)
+			if err := <-browserErr; err != nil {
+				t.Fatalf("browser: %v", err)
+			}
+			var netErr net.Error
+			switch {
+			case tt.timeout:
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					t.Fatalf("promptUser() = %q, %v; want a timeout", answers, err)
+				}
+				return
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("promptUser() = %q, %v; want an error containing %q", answers, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(answers, ",") != strings.Join(tt.answers, ",") {
+				t.Errorf("answers = %q, want %q", answers, tt.answers)
+			}
+		})
+	}
+}
+
+// serveAgent answers the "agent_request" messages on client from keyring,
+// sending each response in two parts.
+func serveAgent(client *websocket.Conn, keyring agent.Agent) error {
+	agentConn, relay := net.Pipe()
+	defer relay.Close()
+	go agent.ServeAgent(keyring, agentConn)
+
+	for {
+		var msg WSMessage
+		if err := client.ReadJSON(&msg); err != nil {
+			return nil
+		}
+		if msg.Type != "agent_request" || msg.Server != "web" {
+			return fmt.Errorf("unexpected %s message for %q", msg.Type, msg.Server)
+		}
+		req, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return err
+		}
+		// Each request is one whole agent protocol message
+		if len(req) < 5 || int(binary.BigEndian.Uint32(req)) != len(req)-4 {
+			return fmt.Errorf("request %x is not length-prefixed", req)
+		}
+		if _, err := relay.Write(req); err != nil {
+			return err
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(relay, header); err != nil {
+			return err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(relay, body); err != nil {
+			return err
+		}
+		for _, part := range [][]byte{header, body} {
+			if err := client.WriteJSON(WSMessage{Type: "agent_response", Data: base64.StdEncoding.EncodeToString(part)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestAgentRelay(t *testing.T) {
+	prev := promptTimeout
+	promptTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { promptTimeout = prev })
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "browser"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		conn, client := connPair(t)
+		served := make(chan error, 1)
+		go func() { served <- serveAgent(client, keyring) }()
+		relay := agent.NewClient(&agentRelay{conn: conn, server: "web"})
+
+		keys, err := relay.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].Comment != "browser" {
+			t.Fatalf("List() = %v, want the browser's key", keys)
+		}
+		signers, err := relay.Signers()
+		if err != nil || len(signers) != 1 {
+			t.Fatalf("Signers() = %v, %v", signers, err)
+		}
+		data := []byte("session id")
+		sig, err := signers[0].Sign(rand.Reader, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keys[0].Verify(data, sig); err != nil {
+			t.Errorf("signature from the browser doesn't verify: %v", err)
+		}
+
+		client.Close()
+		if err := <-served; err != nil {
+			t.Fatalf("browser: %v", err)
+		}
+	})
+
+	t.Run("unanswered", func(t *testing.T) {
+		conn, client := connPair(t)
+		go func() {
+			// Read the request but never answer it
+			var msg WSMessage
+			client.ReadJSON(&msg)
+		}()
+		relay := agent.NewClient(&agentRelay{conn: conn, server: "web"})
+
+		start := time.Now()
+		if _, err := relay.List(); err == nil {
+			t.Fatal("List() succeeded without an answer")
+		}
+		if elapsed := time.Since(start); elapsed > 5*promptTimeout {
+			t.Errorf("List() took %v, want it bounded by %v", elapsed, promptTimeout)
+		}
+		// The WebSocket can't be read after a timeout, so later requests fail
+		if _, err := relay.List(); err == nil {
+			t.Error("List() succeeded after a timed out request")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		conn, client := connPair(t)
+		client.Close()
+		relay := agent.NewClient(&agentRelay{conn: conn, server: "web"})
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := relay.List()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("List() succeeded after the browser left")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("List() blocked after the browser left")
+		}
+		if _, err := relay.Signers(); err == nil {
+			t.Error("Signers() succeeded after the browser left")
+		}
+	})
+}
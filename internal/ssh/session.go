@@ -0,0 +1,604 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/recording"
+	"web-ssh-backend/internal/sshconn"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// detachGrace is how long a session survives without an attached WebSocket.
+	detachGrace = 5 * time.Minute
+	// scrollbackSize is how much recent output is kept for replay on reattach.
+	scrollbackSize = 256 * 1024
+)
+
+// Init reads the session broker settings from SSH_DETACH_GRACE (a Go
+// duration), SSH_SCROLLBACK_BYTES and SSH_RESIZE_POLICY.
+func Init() {
+	if v := os.Getenv("SSH_DETACH_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid SSH_DETACH_GRACE: %v", err)
+		}
+		detachGrace = d
+	}
+	if v := os.Getenv("SSH_SCROLLBACK_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid SSH_SCROLLBACK_BYTES: %s", v)
+		}
+		scrollbackSize = n
+	}
+	switch v := os.Getenv("SSH_RESIZE_POLICY"); v {
+	case "":
+	case ResizeOwner, ResizeFirst:
+		defaultResizePolicy = v
+	default:
+		log.Fatalf("Invalid SSH_RESIZE_POLICY: %s", v)
+	}
+}
+
+// wsConn serializes writes to a WebSocket; gorilla/websocket allows only one
+// concurrent writer.
+type wsConn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+const writeWait = 10 * time.Second
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(messageType, data)
+}
+
+func (c *wsConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteJSON(v)
+}
+
+// ringBuffer keeps the last size bytes written to it.
+type ringBuffer struct {
+	buf  []byte
+	size int
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+}
+
+func (b *ringBuffer) Bytes() []byte {
+	return append([]byte(nil), b.buf...)
+}
+
+// Participant roles. The owner started the session; invited users either
+// watch or can also type.
+const (
+	RoleOwner       = "owner"
+	RoleInteractive = "interactive"
+	RoleView        = "view"
+)
+
+// Resize policies decide whose terminal size the shell follows when a
+// session has several participants.
+const (
+	ResizeOwner = "owner" // The owner's resize wins; others follow while the owner is away
+	ResizeFirst = "first" // The longest-connected participant's resize wins
+)
+
+// defaultResizePolicy applies to new sessions; see Init.
+var defaultResizePolicy = ResizeOwner
+
+// Session modes decide what a new session runs, per server.
+const (
+	ModePTY   = "pty"   // Shell on a terminal
+	ModeShell = "shell" // Shell without a terminal, for devices that refuse PTYs
+	ModeExec  = "exec"  // The server's command, without a terminal
+)
+
+// sendQueueSize is how many messages a participant may fall behind before
+// it is disconnected, so one stalled viewer can't hold up the session.
+const sendQueueSize = 256
+
+// Participant describes a WebSocket attached to a session.
+type Participant struct {
+	UserID uint   `json:"user_id"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+
+	conn *wsConn
+
+	// Messages for conn, written in order by send. Guarded by the
+	// session's mu.
+	queue   chan outbound
+	stopped bool
+}
+
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+// start begins writing queued messages to conn.
+func (p *Participant) start(conn *wsConn) {
+	p.conn = conn
+	p.queue = make(chan outbound, sendQueueSize)
+	go p.send()
+}
+
+func (p *Participant) send() {
+	for msg := range p.queue {
+		if err := p.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			// Later writes fail fast; keep draining so enqueue never blocks
+			p.conn.ws.Close()
+		}
+	}
+	p.conn.ws.Close()
+}
+
+// enqueue queues a message without blocking. A participant whose queue is
+// full is disconnected, which detaches it. Callers hold the session's mu.
+func (p *Participant) enqueue(messageType int, data []byte) {
+	if p.stopped {
+		return
+	}
+	select {
+	case p.queue <- outbound{messageType, data}:
+	default:
+		log.Printf("Disconnecting %s from session: too far behind", p.Name)
+		p.conn.ws.Close()
+		p.stopped = true
+		close(p.queue)
+	}
+}
+
+// enqueueJSON queues msg as a text message. Callers hold the session's mu.
+func (p *Participant) enqueueJSON(msg WSMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("WebSocket message encoding error: %v", err)
+		return
+	}
+	p.enqueue(websocket.TextMessage, data)
+}
+
+// stop sends final, if set, after what is already queued, then closes the
+// WebSocket. Callers hold the session's mu and have removed p.
+func (p *Participant) stop(final *WSMessage) {
+	if p.stopped {
+		return
+	}
+	if final != nil {
+		p.enqueueJSON(*final)
+	}
+	p.stopped = true
+	close(p.queue)
+}
+
+// Session is a running shell or command whose lifetime is independent of
+// any single WebSocket. Its output fans out to every attached participant.
+// When the last one leaves the shell keeps running for detachGrace and can
+// be reattached by ID.
+type Session struct {
+	ID         string
+	UserID     uint
+	ServerID   uint
+	ServerName string
+	CreatedAt  time.Time
+	Mode       string
+
+	lease    *sshconn.Lease
+	session  *ssh.Session
+	stdin    io.WriteCloser
+	recorder *recording.Recorder
+
+	mu           sync.Mutex
+	scrollback   ringBuffer
+	participants []*Participant // In join order
+	invites      map[uint]string
+	resizePolicy string
+	detachedAt   time.Time
+	expiry       *time.Timer
+	closed       bool
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*Session)
+)
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func registerSession(s *Session) {
+	s.scrollback.size = scrollbackSize
+	s.invites = make(map[uint]string)
+	s.resizePolicy = defaultResizePolicy
+	sessionsMu.Lock()
+	sessions[s.ID] = s
+	sessionsMu.Unlock()
+}
+
+func lookupSession(id string) *Session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[id]
+}
+
+// pump forwards output to the scrollback, the recorder and all
+// participants until the remote side exits, reports how it ended, then
+// closes the session. stderr is nil under a PTY, which merges it into stdout.
+func (s *Session) pump(stdout, stderr io.Reader) {
+	var wg sync.WaitGroup
+	if stderr != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.copyOutput(stderr, true)
+		}()
+	}
+	s.copyOutput(stdout, false)
+	wg.Wait()
+
+	s.exited(s.session.Wait())
+	s.Close()
+}
+
+func (s *Session) copyOutput(r io.Reader, stderr bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.output(buf[:n], stderr)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// output sends p to participants: stdout as binary messages, stderr as
+// "stderr" messages with the bytes base64-encoded in data. The scrollback
+// and recording keep both as they arrived.
+func (s *Session) output(p []byte, stderr bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scrollback.Write(p)
+	if s.recorder != nil {
+		s.recorder.Write(p)
+	}
+	// Participants may still be sending p's buffer, so each gets a copy
+	for _, part := range s.participants {
+		if stderr {
+			part.enqueueJSON(WSMessage{Type: "stderr", Data: base64.StdEncoding.EncodeToString(p)})
+		} else {
+			part.enqueue(websocket.BinaryMessage, append([]byte(nil), p...))
+		}
+	}
+}
+
+// exited tells participants how the remote side ended, given the result of
+// waiting for it: an "exit_status" with the status, or an "exit_signal"
+// with the signal name and any message. Nothing is sent when the server
+// didn't say, as when the connection dropped or the session was closed.
+func (s *Session) exited(err error) {
+	var msg WSMessage
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		status := 0
+		msg = WSMessage{Type: "exit_status", ExitStatus: &status}
+	case errors.As(err, &exitErr) && exitErr.Signal() != "":
+		msg = WSMessage{Type: "exit_signal", Signal: exitErr.Signal(), Content: exitErr.Msg()}
+	case errors.As(err, &exitErr):
+		status := exitErr.ExitStatus()
+		msg = WSMessage{Type: "exit_status", ExitStatus: &status}
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.broadcast(msg, nil)
+	}
+}
+
+// roleFor returns the role userID may join the session with, or "" if the
+// user was not invited.
+func (s *Session) roleFor(userID uint) string {
+	if userID == s.UserID {
+		return RoleOwner
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.invites[userID]
+}
+
+// broadcast queues msg for every participant except skip. Callers hold s.mu.
+func (s *Session) broadcast(msg WSMessage, skip *wsConn) {
+	for _, part := range s.participants {
+		if part.conn != skip {
+			part.enqueueJSON(msg)
+		}
+	}
+}
+
+func (s *Session) removeLocked(conn *wsConn) *Participant {
+	for i, part := range s.participants {
+		if part.conn == conn {
+			s.participants = append(s.participants[:i], s.participants[i+1:]...)
+			return part
+		}
+	}
+	return nil
+}
+
+// attach adds conn as a participant, optionally replaying the scrollback
+// first. If the owner attaches again, the owner's previous WebSocket is told
+// it was taken over and closed.
+func (s *Session) attach(conn *wsConn, part *Participant, replay bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if part.Role == RoleOwner {
+		for _, prev := range s.participants {
+			if prev.Role == RoleOwner {
+				s.removeLocked(prev.conn)
+				prev.stop(&WSMessage{Type: "detached", Content: "Session attached elsewhere"})
+				break
+			}
+		}
+	}
+
+	part.start(conn)
+	part.enqueueJSON(WSMessage{Type: "session", SessionID: s.ID, Role: part.Role})
+	if replay {
+		if data := s.scrollback.Bytes(); len(data) > 0 {
+			part.enqueue(websocket.BinaryMessage, data)
+		}
+	}
+	s.participants = append(s.participants, part)
+	part.enqueueJSON(WSMessage{Type: "participants", Participants: s.participants})
+	s.broadcast(WSMessage{Type: "participant", Content: "join", Participant: part}, conn)
+	return true
+}
+
+// detach removes conn. When no participants remain, the grace period starts
+// after which the session is closed unless a client reattaches.
+func (s *Session) detach(conn *wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	part := s.removeLocked(conn)
+	if part == nil {
+		return
+	}
+	part.stop(nil)
+	s.broadcast(WSMessage{Type: "participant", Content: "leave", Participant: part}, nil)
+
+	if len(s.participants) > 0 {
+		return
+	}
+	s.detachedAt = time.Now()
+	s.expiry = time.AfterFunc(detachGrace, func() {
+		log.Printf("Closing detached session %s after grace period", s.ID)
+		s.Close()
+	})
+}
+
+func (s *Session) participant(conn *wsConn) *Participant {
+	for _, part := range s.participants {
+		if part.conn == conn {
+			return part
+		}
+	}
+	return nil
+}
+
+// canWrite reports whether conn may send input. Callers hold s.mu.
+func (s *Session) canWrite(conn *wsConn) bool {
+	part := s.participant(conn)
+	return part != nil && part.Role != RoleView
+}
+
+// write sends input from conn to the shell. View-only participants are ignored.
+func (s *Session) write(conn *wsConn, p []byte) {
+	s.mu.Lock()
+	allowed := s.canWrite(conn)
+	s.mu.Unlock()
+
+	if !allowed {
+		return
+	}
+	s.stdin.Write(p)
+}
+
+// closeInput ends input from conn, so commands reading stdin to the end
+// can finish. View-only participants are ignored.
+func (s *Session) closeInput(conn *wsConn) {
+	s.mu.Lock()
+	allowed := s.canWrite(conn)
+	s.mu.Unlock()
+
+	if !allowed {
+		return
+	}
+	s.stdin.Close()
+}
+
+// resize applies a terminal size change from conn if the resize policy
+// makes conn the participant in control of the size.
+func (s *Session) resize(conn *wsConn, cols, rows int) {
+	s.mu.Lock()
+	if len(s.participants) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	controller := s.participants[0]
+	if s.resizePolicy == ResizeOwner {
+		for _, part := range s.participants {
+			if part.Role == RoleOwner {
+				controller = part
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	// Without a terminal there is nothing to resize
+	if controller.conn != conn || s.Mode != ModePTY {
+		return
+	}
+	s.session.WindowChange(rows, cols)
+	if s.recorder != nil {
+		s.recorder.Resize(cols, rows)
+	}
+}
+
+// invite lets userID join the session with role, updating an existing invite.
+func (s *Session) invite(userID uint, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.invites[userID] = role
+	for _, part := range s.participants {
+		if part.UserID == userID {
+			part.Role = role
+			part.enqueueJSON(WSMessage{Type: "session", SessionID: s.ID, Role: role})
+		}
+	}
+}
+
+// revoke removes userID's invite and disconnects the user.
+func (s *Session) revoke(userID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.invites, userID)
+	for i := 0; i < len(s.participants); {
+		part := s.participants[i]
+		if part.UserID != userID {
+			i++
+			continue
+		}
+		s.participants = append(s.participants[:i], s.participants[i+1:]...)
+		part.stop(&WSMessage{Type: "closed", Content: "Access revoked"})
+		s.broadcast(WSMessage{Type: "participant", Content: "leave", Participant: part}, nil)
+	}
+}
+
+// Close ends the shell or command, releases the SSH connection and
+// disconnects all participants.
+func (s *Session) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	for _, part := range s.participants {
+		part.stop(&WSMessage{Type: "closed"})
+	}
+	s.participants = nil
+	s.mu.Unlock()
+
+	sessionsMu.Lock()
+	delete(sessions, s.ID)
+	sessionsMu.Unlock()
+
+	s.session.Close()
+	s.lease.Release()
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+}
+
+// HandleListSessions lists the caller's detached sessions that can still be
+// reattached with /ws/ssh?session_id=.
+func HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	type sessionInfo struct {
+		ID         string    `json:"id"`
+		ServerID   uint      `json:"server_id"`
+		ServerName string    `json:"server_name"`
+		Mode       string    `json:"mode"`
+		CreatedAt  time.Time `json:"created_at"`
+		DetachedAt time.Time `json:"detached_at"`
+		ExpiresAt  time.Time `json:"expires_at"`
+	}
+
+	sessionsMu.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.UserID == userID {
+			list = append(list, s)
+		}
+	}
+	sessionsMu.Unlock()
+
+	result := []sessionInfo{}
+	for _, s := range list {
+		s.mu.Lock()
+		if len(s.participants) == 0 && !s.closed {
+			result = append(result, sessionInfo{
+				ID:         s.ID,
+				ServerID:   s.ServerID,
+				ServerName: s.ServerName,
+				Mode:       s.Mode,
+				CreatedAt:  s.CreatedAt,
+				DetachedAt: s.detachedAt,
+				ExpiresAt:  s.detachedAt.Add(detachGrace),
+			})
+		}
+		s.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
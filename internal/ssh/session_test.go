@@ -0,0 +1,278 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/sshconn"
+	"web-ssh-backend/internal/sshtest"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialPair returns the server side of a WebSocket and a client that never
+// reads from it.
+func dialPair(t *testing.T) *wsConn {
+	conn, _ := connPair(t)
+	return conn
+}
+
+// connPair returns both sides of a WebSocket.
+func connPair(t *testing.T) (*wsConn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return &wsConn{ws: <-conns}, client
+}
+
+// startTestSession starts a session in mode on srv, running command in
+// exec mode, with the owner attached over the returned WebSocket.
+func startTestSession(t *testing.T, srv *sshtest.Server, mode, command string) (*Session, *wsConn, *websocket.Conn) {
+	t.Helper()
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	server := srv.Record(t, 1, "device")
+	server.SessionMode, server.Command = mode, command
+	t.Cleanup(func() { sshconn.EvictServer(server.ID) })
+
+	conn, client := connPair(t)
+	s, err := startSession(context.Background(), conn, 1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	if !s.attach(conn, &Participant{UserID: 1, Role: RoleOwner}, false) {
+		t.Fatal("attach failed")
+	}
+	return s, conn, client
+}
+
+// nextEvent reads from client until a message other than output or the
+// session and participant updates sent on attach.
+func nextEvent(t *testing.T, client *websocket.Conn) WSMessage {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Type {
+		case "session", "participants", "participant", "stderr":
+		default:
+			return msg
+		}
+	}
+}
+
+func TestSlowParticipantIsDisconnected(t *testing.T) {
+	s := &Session{ID: "test"}
+	s.scrollback.size = 1024
+	slow := &Participant{UserID: 1, Role: RoleOwner}
+	if !s.attach(dialPair(t), slow, false) {
+		t.Fatal("attach failed")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 4*sendQueueSize; i++ {
+			s.output(chunk, false)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output blocked on a participant that isn't reading")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slow.stopped {
+		t.Error("slow participant was not disconnected")
+	}
+}
+
+func TestExitReporting(t *testing.T) {
+	tests := []struct {
+		name    string
+		exit    func(ch ssh.Channel)
+		want    string
+		status  int
+		signal  string
+		content string
+	}{
+		{"success", func(ch ssh.Channel) { sshtest.ExitStatus(ch, 0) }, "exit_status", 0, "", ""},
+		{"failure", func(ch ssh.Channel) { sshtest.ExitStatus(ch, 3) }, "exit_status", 3, "", ""},
+		{"signal", func(ch ssh.Channel) { sshtest.ExitSignal(ch, "KILL", "killed") }, "exit_signal", 0, "KILL", "killed"},
+		{"no status", func(ch ssh.Channel) {}, "closed", 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := sshtest.Start(t)
+			// Exit once input ends, so the owner is attached by then
+			srv.Run = func(ch ssh.Channel, command string) {
+				io.Copy(io.Discard, ch)
+				tt.exit(ch)
+			}
+			s, conn, client := startTestSession(t, srv, ModeExec, "show version")
+			s.closeInput(conn)
+
+			msg := nextEvent(t, client)
+			if msg.Type != tt.want {
+				t.Fatalf("got %q message, want %q", msg.Type, tt.want)
+			}
+			switch msg.Type {
+			case "exit_status":
+				if msg.ExitStatus == nil || *msg.ExitStatus != tt.status {
+					t.Errorf("exit_status = %v, want %d", msg.ExitStatus, tt.status)
+				}
+			case "exit_signal":
+				if msg.Signal != tt.signal || msg.Content != tt.content {
+					t.Errorf("exit_signal = %q, %q; want %q, %q", msg.Signal, msg.Content, tt.signal, tt.content)
+				}
+			}
+			if msg.Type != "closed" {
+				if msg := nextEvent(t, client); msg.Type != "closed" {
+					t.Errorf("got %q message after exit, want closed", msg.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		requests []string
+	}{
+		{ModePTY, []string{"pty-req", "shell", "window-change"}},
+		{ModeShell, []string{"shell"}},
+		{ModeExec, []string{"exec"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			srv := sshtest.Start(t)
+			s, conn, client := startTestSession(t, srv, tt.mode, "show version")
+			s.resize(conn, 120, 40)
+			s.closeInput(conn)
+			if msg := nextEvent(t, client); msg.Type != "exit_status" {
+				t.Fatalf("got %q message, want exit_status", msg.Type)
+			}
+
+			// Requests are recorded as the server handles them
+			var got []string
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if got = srv.Requests(); slices.Equal(got, tt.requests) {
+					break
+				}
+			}
+			if !slices.Equal(got, tt.requests) {
+				t.Errorf("session requests = %q, want %q", got, tt.requests)
+			}
+		})
+	}
+}
+
+// nextOutput reads from client until a binary message and returns it.
+func nextOutput(t *testing.T, client *websocket.Conn) []byte {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType == websocket.BinaryMessage {
+			return data
+		}
+	}
+}
+
+func TestReattachReplaysScrollback(t *testing.T) {
+	s, conn, client := startTestSession(t, sshtest.Start(t), ModeShell, "")
+	s.write(conn, []byte("hello\n"))
+	if got := string(nextOutput(t, client)); got != "hello\n" {
+		t.Fatalf("output = %q, want the echo", got)
+	}
+	s.detach(conn)
+
+	conn, client = connPair(t)
+	if !s.attach(conn, &Participant{UserID: 1, Role: RoleOwner}, true) {
+		t.Fatal("reattach failed")
+	}
+	if got := string(nextOutput(t, client)); got != "hello\n" {
+		t.Errorf("replayed scrollback = %q, want the earlier output", got)
+	}
+	s.write(conn, []byte("again\n"))
+	if got := string(nextOutput(t, client)); got != "again\n" {
+		t.Errorf("output after reattach = %q, want the echo", got)
+	}
+}
+
+func TestDetachedSessionIsReaped(t *testing.T) {
+	prev := detachGrace
+	detachGrace = 100 * time.Millisecond
+	t.Cleanup(func() { detachGrace = prev })
+
+	s, conn, _ := startTestSession(t, sshtest.Start(t), ModeShell, "")
+	if lookupSession(s.ID) != s {
+		t.Fatal("session not registered")
+	}
+
+	// Reattaching within the grace period keeps the session
+	s.detach(conn)
+	conn, _ = connPair(t)
+	if !s.attach(conn, &Participant{UserID: 1, Role: RoleOwner}, true) {
+		t.Fatal("reattach within the grace period failed")
+	}
+	time.Sleep(2 * detachGrace)
+	if lookupSession(s.ID) != s {
+		t.Fatal("reattached session was closed")
+	}
+
+	s.detach(conn)
+	for deadline := time.Now().Add(5 * time.Second); lookupSession(s.ID) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("detached session still registered after the grace period")
+		}
+	}
+	if s.attach(dialPair(t), &Participant{UserID: 1, Role: RoleOwner}, true) {
+		t.Error("reaped session accepted a participant")
+	}
+	if _, err := s.session.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("reaped session's channel is still open")
+	}
+}
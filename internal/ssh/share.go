@@ -0,0 +1,192 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"web-ssh-backend/internal/auth"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// displayName returns the name shown to other participants for userID.
+func displayName(userID uint) string {
+	var user models.User
+	if err := db.DB.Select("name", "email").First(&user, userID).Error; err != nil {
+		return ""
+	}
+	if user.Name != "" {
+		return user.Name
+	}
+	return user.Email
+}
+
+// SessionServer returns the server of a live session that userID has been
+// invited to, so a ticket for joining it can be issued.
+func SessionServer(sessionID string, userID uint) (uint, error) {
+	session := lookupSession(sessionID)
+	if session == nil || session.roleFor(userID) == "" {
+		return 0, ErrSessionNotFound
+	}
+	return session.ServerID, nil
+}
+
+// ownedSession looks up a live session owned by the caller, writing an error
+// response and returning nil if there is none.
+func ownedSession(w http.ResponseWriter, r *http.Request, sessionID string) *Session {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	session := lookupSession(sessionID)
+	if session == nil || session.UserID != userID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil
+	}
+	return session
+}
+
+// HandleShareSession invites another user, identified by email, to a
+// session owned by the caller as a "view" or "interactive" participant.
+func HandleShareSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID string `json:"session_id"`
+		Email     string `json:"email"`
+		Mode      string `json:"mode"` // "view" or "interactive"
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Mode != RoleView && req.Mode != RoleInteractive {
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	session := ownedSession(w, r, req.SessionID)
+	if session == nil {
+		return
+	}
+
+	var user models.User
+	if err := db.DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.ID == session.UserID {
+		http.Error(w, "Cannot invite the session owner", http.StatusBadRequest)
+		return
+	}
+
+	session.invite(user.ID, req.Mode)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": session.ID,
+		"user_id":    user.ID,
+		"mode":       req.Mode,
+	})
+}
+
+// HandleUnshareSession revokes an invite and disconnects the user.
+func HandleUnshareSession(w http.ResponseWriter, r *http.Request) {
+	session := ownedSession(w, r, r.URL.Query().Get("session_id"))
+	if session == nil {
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	session.revoke(uint(userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSetSessionPolicy sets whose resize the shell follows: "owner" or
+// "first" (the longest-connected participant).
+func HandleSetSessionPolicy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID    string `json:"session_id"`
+		ResizePolicy string `json:"resize_policy"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.ResizePolicy != ResizeOwner && req.ResizePolicy != ResizeFirst {
+		http.Error(w, "Invalid resize policy", http.StatusBadRequest)
+		return
+	}
+
+	session := ownedSession(w, r, req.SessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.Lock()
+	session.resizePolicy = req.ResizePolicy
+	session.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListSharedSessions lists live sessions other users invited the
+// caller to.
+func HandleListSharedSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	type sharedInfo struct {
+		ID         string    `json:"id"`
+		OwnerID    uint      `json:"owner_id"`
+		ServerID   uint      `json:"server_id"`
+		ServerName string    `json:"server_name"`
+		Mode       string    `json:"mode"`
+		CreatedAt  time.Time `json:"created_at"`
+	}
+
+	sessionsMu.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	sessionsMu.Unlock()
+
+	result := []sharedInfo{}
+	for _, s := range list {
+		s.mu.Lock()
+		mode, invited := s.invites[userID]
+		s.mu.Unlock()
+		if !invited {
+			continue
+		}
+		result = append(result, sharedInfo{
+			ID:         s.ID,
+			OwnerID:    s.UserID,
+			ServerID:   s.ServerID,
+			ServerName: s.ServerName,
+			Mode:       mode,
+			CreatedAt:  s.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,146 @@
+// Package sshca signs short-lived SSH user certificates with a stored CA
+// key, so servers that trust the CA need no long-lived key from us.
+package sshca
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"web-ssh-backend/internal/audit"
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/keys"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Certificate lifetimes accepted for a CA.
+const (
+	DefaultTTL = 5 * time.Minute
+	MinTTL     = time.Minute
+	MaxTTL     = time.Hour
+)
+
+// clockSkew backdates ValidAfter so servers with a slightly slow clock
+// accept a certificate right away.
+const clockSkew = time.Minute
+
+// Binding ties an encrypted column to ca.
+func Binding(ca *models.CertificateAuthority, field string) crypto.Binding {
+	return crypto.Binding{UserID: ca.UserID, RecordID: ca.ID, Field: field}
+}
+
+// Signer decrypts the private key of ca. Keys in the owner's vault are
+// decrypted with the unlock token carried by ctx.
+func Signer(ctx context.Context, ca *models.CertificateAuthority) (ssh.Signer, error) {
+	secret, err := passvault.DecryptSecret(ctx, ca.EncryptedSecret, Binding(ca, crypto.FieldCASecret))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt CA %q: %w", ca.Name, err)
+	}
+	var passphrase string
+	if ca.EncryptedPassphrase != "" {
+		passphrase, err = passvault.DecryptSecret(ctx, ca.EncryptedPassphrase, Binding(ca, crypto.FieldCAPassphrase))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt passphrase of CA %q: %w", ca.Name, err)
+		}
+	}
+
+	signer, err := keys.ParseSigner([]byte(secret), []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key for CA %q: %w", ca.Name, err)
+	}
+	return signer, nil
+}
+
+// Issue mints an ephemeral key and a certificate for it, signed by the CA
+// server references, for userID to log in to server. The principals are
+// the server's username and the user's role. Every certificate is recorded
+// in the audit log before it is handed out.
+func Issue(ctx context.Context, server *models.Server, userID uint) (ssh.Signer, error) {
+	if server.CAID == nil {
+		return nil, fmt.Errorf("server %q has no certificate authority", server.Name)
+	}
+
+	// The CA belongs to the server's owner, also when a grantee connects
+	var ca models.CertificateAuthority
+	if err := db.DB.Where("id = ? AND user_id = ?", *server.CAID, server.UserID).First(&ca).Error; err != nil {
+		return nil, fmt.Errorf("certificate authority %d: %w", *server.CAID, err)
+	}
+	var user models.User
+	if err := db.DB.Select("id", "role").First(&user, userID).Error; err != nil {
+		return nil, fmt.Errorf("user %d: %w", userID, err)
+	}
+
+	caSigner, err := Signer(ctx, &ca)
+	if err != nil {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	// The API validates lifetimes, but rows may have been written without it
+	ttl := time.Duration(ca.CertTTL) * time.Second
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	ttl = min(ttl, MaxTTL)
+	now := time.Now()
+	principals := []string{server.Username}
+	if user.Role != "" && user.Role != server.Username {
+		principals = append(principals, user.Role)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("web-ssh user:%d server:%d", userID, server.ID),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	if err := audit.Record(userID, &server.ID, audit.ActionCertificateIssued, map[string]interface{}{
+		"ca_id":        ca.ID,
+		"ca":           ca.Fingerprint,
+		"serial":       cert.Serial,
+		"key_id":       cert.KeyId,
+		"principals":   cert.ValidPrincipals,
+		"fingerprint":  ssh.FingerprintSHA256(cert.Key),
+		"valid_after":  time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		"valid_before": time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to audit certificate: %w", err)
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,153 @@
+package sshca
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"slices"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/audit"
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newCA stores a CA owned by userID with the given certificate lifetime.
+func newCA(t *testing.T, userID uint, ttl int) (*models.CertificateAuthority, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &models.CertificateAuthority{UserID: userID, Name: "ops", PublicKey: string(ssh.MarshalAuthorizedKey(caKey)),
+		Fingerprint: ssh.FingerprintSHA256(caKey), EncryptedSecret: "pending", CertTTL: ttl}
+	dbtest.Create(t, ca)
+	if ca.EncryptedSecret, err = crypto.Encrypt(string(pem.EncodeToMemory(block)), Binding(ca, crypto.FieldCASecret)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Model(ca).UpdateColumn("encrypted_secret", ca.EncryptedSecret).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Model(ca).UpdateColumn("cert_ttl", ttl).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ca, caKey
+}
+
+func TestIssue(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+
+	owner := models.User{GoogleID: "g1", Email: "owner@example.com", Role: "admin"}
+	grantee := models.User{GoogleID: "g2", Email: "grantee@example.com", Role: "deploy"}
+	plain := models.User{GoogleID: "g3", Email: "plain@example.com", Role: "root"}
+	for _, u := range []*models.User{&owner, &grantee, &plain} {
+		dbtest.Create(t, u)
+	}
+
+	tests := []struct {
+		name       string
+		userID     uint
+		ttl        int // CertTTL of the CA, in seconds
+		principals []string
+		lifetime   time.Duration
+	}{
+		{"owner", owner.ID, 600, []string{"root", "admin"}, 10 * time.Minute},
+		{"grantee", grantee.ID, 600, []string{"root", "deploy"}, 10 * time.Minute},
+		{"role is the username", plain.ID, 600, []string{"root"}, 10 * time.Minute},
+		{"default lifetime", owner.ID, 0, []string{"root", "admin"}, DefaultTTL},
+		{"lifetime capped", owner.ID, 86400, []string{"root", "admin"}, MaxTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, caKey := newCA(t, owner.ID, tt.ttl)
+			server := &models.Server{UserID: owner.ID, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "certificate", CAID: &ca.ID}
+			dbtest.Create(t, server)
+
+			before := time.Now()
+			signer, err := Issue(context.Background(), server, tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, ok := signer.PublicKey().(*ssh.Certificate)
+			if !ok {
+				t.Fatalf("Issue() returned a %T, want a certificate", signer.PublicKey())
+			}
+
+			if cert.CertType != ssh.UserCert || cert.Key.Type() != ssh.KeyAlgoED25519 {
+				t.Errorf("certificate type %d with a %s key, want a user certificate for ed25519", cert.CertType, cert.Key.Type())
+			}
+			if !slices.Equal(cert.ValidPrincipals, tt.principals) {
+				t.Errorf("principals %v, want %v", cert.ValidPrincipals, tt.principals)
+			}
+			validFor := time.Unix(int64(cert.ValidBefore), 0).Sub(before)
+			if validFor < tt.lifetime-time.Second || validFor > tt.lifetime+time.Second {
+				t.Errorf("valid for %v, want %v", validFor, tt.lifetime)
+			}
+			if after := time.Unix(int64(cert.ValidAfter), 0); after.After(before.Add(-clockSkew + time.Second)) {
+				t.Errorf("valid after %v, want backdated by %v", after, clockSkew)
+			}
+
+			checker := ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(caKey.Marshal())
+			}}
+			if err := checker.CheckCert("root", cert); err != nil {
+				t.Errorf("certificate does not verify against the CA: %v", err)
+			}
+
+			var event models.AuditEvent
+			if err := db.DB.Where("action = ? AND server_id = ?", audit.ActionCertificateIssued, server.ID).First(&event).Error; err != nil {
+				t.Fatalf("no audit event: %v", err)
+			}
+			var details struct {
+				Serial     uint64   `json:"serial"`
+				Principals []string `json:"principals"`
+				CA         string   `json:"ca"`
+			}
+			if err := json.Unmarshal([]byte(event.Details), &details); err != nil {
+				t.Fatal(err)
+			}
+			if event.UserID != tt.userID || details.Serial != cert.Serial || details.CA != ca.Fingerprint ||
+				!slices.Equal(details.Principals, tt.principals) {
+				t.Errorf("audit event %+v %+v does not match the certificate", event, details)
+			}
+		})
+	}
+}
+
+func TestIssueOtherOwnersCA(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	user := models.User{GoogleID: "g1", Email: "owner@example.com"}
+	dbtest.Create(t, &user)
+
+	ca, _ := newCA(t, user.ID+1, 300)
+	server := &models.Server{UserID: user.ID, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "certificate", CAID: &ca.ID}
+	dbtest.Create(t, server)
+	if _, err := Issue(context.Background(), server, user.ID); err == nil {
+		t.Fatal("Issue() signed with another user's CA")
+	}
+	var count int64
+	db.DB.Model(&models.AuditEvent{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d audit events for a refused certificate", count)
+	}
+}
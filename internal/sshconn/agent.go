@@ -0,0 +1,153 @@
+package sshconn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"web-ssh-backend/internal/audit"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errReadOnlyAgent = errors.New("forwarded agent is read-only")
+
+// agentKey is a stored key held by a forwarding agent.
+type agentKey struct {
+	credentialID uint
+	name         string
+	signer       ssh.Signer
+}
+
+// forwardingAgent is an in-memory agent over a fixed set of stored keys.
+// Every signature it makes is audited; keys can't be added or removed.
+type forwardingAgent struct {
+	userID   uint
+	serverID uint
+	keys     []agentKey
+}
+
+// ForwardingAgent returns an agent holding the keys chosen for forwarding on
+// server, for userID's session. Only credentials the server's owner owns are
+// forwarded. The keys are decrypted once and stay in memory until the agent
+// is dropped.
+func ForwardingAgent(ctx context.Context, server *models.Server, userID uint) (agent.ExtendedAgent, error) {
+	var links []models.ForwardedKey
+	if err := db.DB.Where("server_id = ?", server.ID).Order("id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	a := &forwardingAgent{userID: userID, serverID: server.ID}
+	for _, link := range links {
+		l, cred, err := credentialLogin(ctx, server.UserID, link.CredentialID)
+		if err != nil {
+			return nil, err
+		}
+		if cred.UserID != server.UserID {
+			return nil, fmt.Errorf("credential %q is granted, not owned, and can't be forwarded", cred.Name)
+		}
+		signer, err := l.signer()
+		if err != nil {
+			return nil, fmt.Errorf("credential %q: %w", cred.Name, err)
+		}
+		a.keys = append(a.keys, agentKey{credentialID: cred.ID, name: cred.Name, signer: signer})
+	}
+	return a, nil
+}
+
+func (a *forwardingAgent) List() ([]*agent.Key, error) {
+	list := make([]*agent.Key, 0, len(a.keys))
+	for _, k := range a.keys {
+		pub := k.signer.PublicKey()
+		list = append(list, &agent.Key{Format: pub.Type(), Blob: pub.Marshal(), Comment: k.name})
+	}
+	return list, nil
+}
+
+func (a *forwardingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs with the matching key once the request is recorded
+// in the audit log. For SSH logins the log names the remote user.
+func (a *forwardingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	wanted := key.Marshal()
+	for _, k := range a.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			continue
+		}
+
+		var algorithm string
+		switch flags {
+		case 0:
+		case agent.SignatureFlagRsaSha256:
+			algorithm = ssh.KeyAlgoRSASHA256
+		case agent.SignatureFlagRsaSha512:
+			algorithm = ssh.KeyAlgoRSASHA512
+		default:
+			return nil, fmt.Errorf("unsupported signature flags %d", flags)
+		}
+
+		details := map[string]interface{}{
+			"credential_id": k.credentialID,
+			"credential":    k.name,
+			"fingerprint":   ssh.FingerprintSHA256(key),
+		}
+		if user, ok := userauthUser(data); ok {
+			details["remote_user"] = user
+		}
+		if err := audit.Record(a.userID, &a.serverID, audit.ActionAgentSign, details); err != nil {
+			return nil, fmt.Errorf("failed to audit signature: %w", err)
+		}
+
+		if algorithm == "" {
+			return k.signer.Sign(rand.Reader, data)
+		}
+		algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, fmt.Errorf("key %q does not support %s", k.name, algorithm)
+		}
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+	}
+	return nil, errors.New("key not found")
+}
+
+func (a *forwardingAgent) Signers() ([]ssh.Signer, error) {
+	signers := make([]ssh.Signer, len(a.keys))
+	for i, k := range a.keys {
+		signers[i] = k.signer
+	}
+	return signers, nil
+}
+
+func (a *forwardingAgent) Add(agent.AddedKey) error   { return errReadOnlyAgent }
+func (a *forwardingAgent) Remove(ssh.PublicKey) error { return errReadOnlyAgent }
+func (a *forwardingAgent) RemoveAll() error           { return errReadOnlyAgent }
+func (a *forwardingAgent) Lock([]byte) error          { return errReadOnlyAgent }
+func (a *forwardingAgent) Unlock([]byte) error        { return errReadOnlyAgent }
+
+func (a *forwardingAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// userauthUser returns the user name from data if it is the payload signed
+// for SSH public key authentication (RFC 4252, section 7).
+func userauthUser(data []byte) (string, bool) {
+	var req struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		Rest      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &req); err != nil || req.Type != 50 || req.Method != "publickey" {
+		return "", false
+	}
+	return req.User, true
+}
@@ -0,0 +1,163 @@
+package sshconn
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm profiles for servers, from strictest to most permissive.
+const (
+	ProfileModern     = "modern"     // Current algorithms only
+	ProfileCompatible = "compatible" // The x/crypto defaults
+	ProfileLegacy     = "legacy"     // Adds SHA-1 key exchange, CBC ciphers and ssh-rsa/ssh-dss for old devices
+)
+
+// Algorithms lists the algorithms a connection may negotiate, in order of
+// preference. Empty lists keep the x/crypto defaults.
+type Algorithms struct {
+	KeyExchanges      []string `json:"kex,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+}
+
+var modernAlgorithms = Algorithms{
+	KeyExchanges: []string{
+		ssh.KeyExchangeMLKEM768X25519,
+		ssh.KeyExchangeCurve25519,
+		ssh.KeyExchangeECDHP256,
+		ssh.KeyExchangeECDHP384,
+		ssh.KeyExchangeECDHP521,
+	},
+	Ciphers: []string{
+		ssh.CipherAES128GCM,
+		ssh.CipherAES256GCM,
+		ssh.CipherChaCha20Poly1305,
+	},
+	MACs: []string{
+		ssh.HMACSHA256ETM,
+		ssh.HMACSHA512ETM,
+	},
+	HostKeyAlgorithms: []string{
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01,
+		ssh.CertAlgoRSASHA256v01,
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSASHA256,
+	},
+}
+
+// legacyAlgorithms returns the x/crypto defaults followed by every
+// algorithm it implements but considers insecure, so devices that support
+// something better still get it.
+func legacyAlgorithms() Algorithms {
+	var config ssh.Config
+	config.SetDefaults()
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	return Algorithms{
+		KeyExchanges:      appendMissing(config.KeyExchanges, insecure.KeyExchanges),
+		Ciphers:           appendMissing(config.Ciphers, insecure.Ciphers),
+		MACs:              appendMissing(config.MACs, insecure.MACs),
+		HostKeyAlgorithms: appendMissing(supported.HostKeys, insecure.HostKeys),
+	}
+}
+
+func appendMissing(list, extra []string) []string {
+	list = slices.Clone(list)
+	for _, name := range extra {
+		if !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// ServerAlgorithms returns the algorithms server may negotiate: its
+// profile, with each list the server sets replacing the profile's.
+func ServerAlgorithms(server *models.Server) (*Algorithms, error) {
+	var algorithms Algorithms
+	switch server.AlgorithmProfile {
+	case ProfileModern:
+		algorithms = modernAlgorithms
+	case ProfileCompatible, "":
+	case ProfileLegacy:
+		algorithms = legacyAlgorithms()
+	default:
+		return nil, fmt.Errorf("unknown algorithm profile %q", server.AlgorithmProfile)
+	}
+
+	known, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	lists := []struct {
+		field string
+		value string
+		known [][]string
+		dest  *[]string
+	}{
+		// x/crypto adds the libssh name for curve25519 itself, but accepts it
+		{"kex_algorithms", server.KexAlgorithms, [][]string{known.KeyExchanges, insecure.KeyExchanges, {"curve25519-sha256@libssh.org"}}, &algorithms.KeyExchanges},
+		{"ciphers", server.Ciphers, [][]string{known.Ciphers, insecure.Ciphers}, &algorithms.Ciphers},
+		{"macs", server.MACs, [][]string{known.MACs, insecure.MACs}, &algorithms.MACs},
+		{"host_key_algorithms", server.HostKeyAlgorithms, [][]string{known.HostKeys, insecure.HostKeys}, &algorithms.HostKeyAlgorithms},
+	}
+	for _, l := range lists {
+		names := splitAlgorithms(l.value)
+		if len(names) == 0 {
+			continue
+		}
+		for _, name := range names {
+			if !slices.Contains(slices.Concat(l.known...), name) {
+				return nil, fmt.Errorf("unsupported algorithm %q in %s", name, l.field)
+			}
+		}
+		*l.dest = names
+	}
+	return &algorithms, nil
+}
+
+// WeakAlgorithms reports whether server is set up to accept algorithms
+// x/crypto considers insecure: the legacy profile, or lists naming any.
+func WeakAlgorithms(server *models.Server) bool {
+	if server.AlgorithmProfile == ProfileLegacy {
+		return true
+	}
+	insecure := ssh.InsecureAlgorithms()
+	for _, l := range []struct {
+		value    string
+		insecure []string
+	}{
+		{server.KexAlgorithms, insecure.KeyExchanges},
+		{server.Ciphers, insecure.Ciphers},
+		{server.MACs, insecure.MACs},
+		{server.HostKeyAlgorithms, insecure.HostKeys},
+	} {
+		for _, name := range splitAlgorithms(l.value) {
+			if slices.Contains(l.insecure, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitAlgorithms splits a comma-separated list, as in OpenSSH's options.
+func splitAlgorithms(v string) []string {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,103 @@
+package sshconn
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerAlgorithms(t *testing.T) {
+	tests := []struct {
+		name   string
+		server models.Server
+		want   Algorithms
+		err    string
+	}{
+		{"compatible", models.Server{AlgorithmProfile: ProfileCompatible}, Algorithms{}, ""},
+		{"unset profile", models.Server{}, Algorithms{}, ""},
+		{"modern", models.Server{AlgorithmProfile: ProfileModern}, modernAlgorithms, ""},
+		{
+			"lists replace the profile's",
+			models.Server{AlgorithmProfile: ProfileModern, Ciphers: " aes256-ctr, aes128-cbc ,", MACs: "hmac-sha1"},
+			Algorithms{
+				KeyExchanges:      modernAlgorithms.KeyExchanges,
+				Ciphers:           []string{ssh.CipherAES256CTR, ssh.InsecureCipherAES128CBC},
+				MACs:              []string{ssh.HMACSHA1},
+				HostKeyAlgorithms: modernAlgorithms.HostKeyAlgorithms,
+			},
+			"",
+		},
+		{
+			"libssh curve25519",
+			models.Server{KexAlgorithms: "curve25519-sha256@libssh.org"},
+			Algorithms{KeyExchanges: []string{"curve25519-sha256@libssh.org"}},
+			"",
+		},
+		{"unknown profile", models.Server{AlgorithmProfile: "paranoid"}, Algorithms{}, `unknown algorithm profile "paranoid"`},
+		{"unknown algorithm", models.Server{HostKeyAlgorithms: "ssh-ed25519,ssh-foo"}, Algorithms{}, `unsupported algorithm "ssh-foo" in host_key_algorithms`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ServerAlgorithms(&tt.server)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ServerAlgorithms() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.KeyExchanges, tt.want.KeyExchanges) || !slices.Equal(got.Ciphers, tt.want.Ciphers) ||
+				!slices.Equal(got.MACs, tt.want.MACs) || !slices.Equal(got.HostKeyAlgorithms, tt.want.HostKeyAlgorithms) {
+				t.Fatalf("ServerAlgorithms() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyAlgorithms(t *testing.T) {
+	got, err := ServerAlgorithms(&models.Server{AlgorithmProfile: ProfileLegacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var defaults ssh.Config
+	defaults.SetDefaults()
+	// Defaults come first, so servers that support them still get them
+	if !slices.Equal(got.Ciphers[:len(defaults.Ciphers)], defaults.Ciphers) {
+		t.Errorf("Ciphers = %v, want the defaults first", got.Ciphers)
+	}
+	for _, name := range []string{ssh.InsecureKeyExchangeDH1SHA1, ssh.InsecureCipherAES128CBC, ssh.HMACSHA1, ssh.InsecureKeyAlgoDSA} {
+		if !slices.Contains(slices.Concat(got.KeyExchanges, got.Ciphers, got.MACs, got.HostKeyAlgorithms), name) {
+			t.Errorf("legacy profile lacks %s", name)
+		}
+	}
+}
+
+func TestWeakAlgorithms(t *testing.T) {
+	tests := []struct {
+		name   string
+		server models.Server
+		want   bool
+	}{
+		{"compatible", models.Server{AlgorithmProfile: ProfileCompatible}, false},
+		{"modern", models.Server{AlgorithmProfile: ProfileModern}, false},
+		{"legacy", models.Server{AlgorithmProfile: ProfileLegacy}, true},
+		{"secure lists", models.Server{Ciphers: "aes256-gcm@openssh.com", MACs: "hmac-sha2-256-etm@openssh.com"}, false},
+		{"insecure kex", models.Server{AlgorithmProfile: ProfileModern, KexAlgorithms: "curve25519-sha256,diffie-hellman-group1-sha1"}, true},
+		{"insecure cipher", models.Server{Ciphers: "aes128-cbc"}, true},
+		{"insecure mac", models.Server{MACs: "hmac-sha1-96"}, true},
+		{"insecure host key", models.Server{HostKeyAlgorithms: "ssh-dss"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WeakAlgorithms(&tt.server); got != tt.want {
+				t.Errorf("WeakAlgorithms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
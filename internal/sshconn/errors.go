@@ -0,0 +1,174 @@
+package sshconn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"web-ssh-backend/internal/egress"
+	"web-ssh-backend/internal/errcode"
+	"web-ssh-backend/internal/hostkey"
+	"web-ssh-backend/internal/passvault"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Codes for failed connections, sent to API and WebSocket clients as
+// "code". They are stable; clients may switch on them.
+const (
+	CodeConfig            = "config_invalid"      // Stored settings or credentials unusable
+	CodeDNS               = "dns_failed"          // Host name did not resolve
+	CodeTCP               = "connect_failed"      // TCP connection refused or unreachable
+	CodeTimeout           = "timeout"             // Connect or handshake took too long
+	CodeHandshake         = "handshake_failed"    // SSH protocol failure
+	CodeAlgorithms        = "algorithms_mismatch" // No algorithm in common with the server
+	CodeAuth              = "auth_failed"         // Server refused the credentials
+	CodeHostKeyChanged    = errcode.HostKeyChanged
+	CodeHostKeyUnpinned   = errcode.HostKeyUnpinned
+	CodeCredentialsLocked = errcode.CredentialsLocked
+	CodeEgressDenied      = "egress_denied"
+	CodeAgentRequired     = "agent_required"
+)
+
+// errInteractive is returned when a server asks questions nobody can answer.
+var errInteractive = errors.New("server requires interactive authentication")
+
+// Error is a failed connection, classified by the stage that failed.
+type Error struct {
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the code for an error from Dial or Acquire, or "" for
+// errors that did not come from connecting.
+func ErrorCode(err error) string {
+	var connErr *Error
+	if errors.As(err, &connErr) {
+		return connErr.Code
+	}
+	return ""
+}
+
+// StatusCode maps an error from Dial or Acquire to an HTTP status.
+func StatusCode(err error) int {
+	switch ErrorCode(err) {
+	case CodeHostKeyChanged, CodeHostKeyUnpinned, CodeAgentRequired:
+		return http.StatusConflict
+	case CodeCredentialsLocked:
+		return http.StatusLocked
+	case CodeEgressDenied:
+		return http.StatusForbidden
+	case CodeTimeout:
+		return http.StatusGatewayTimeout
+	case CodeDNS, CodeTCP, CodeHandshake, CodeAlgorithms, CodeAuth:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ErrorPayload returns err in the structured form sent to API and WebSocket
+// clients, prefixed with msg if set. Host key errors carry the fingerprints
+// for review, and failures behind a jump host name the hop.
+func ErrorPayload(err error, msg string) map[string]interface{} {
+	var changed *hostkey.ChangedError
+	var unpinned *hostkey.UnpinnedError
+	var payload map[string]interface{}
+	switch {
+	case errors.As(err, &changed):
+		payload = changed.Payload()
+	case errors.As(err, &unpinned):
+		payload = unpinned.Payload()
+	case errors.Is(err, passvault.ErrLocked):
+		payload = passvault.LockedPayload()
+	default:
+		text := err.Error()
+		if msg != "" {
+			text = msg + ": " + text
+		}
+		payload = map[string]interface{}{"error": text}
+		if code := ErrorCode(err); code != "" {
+			payload["code"] = code
+		}
+	}
+
+	var hopErr *HopError
+	if errors.As(err, &hopErr) && hopErr.Hops > 1 {
+		payload["hop"] = hopErr.Hop
+		payload["hops"] = hopErr.Hops
+		payload["hop_name"] = hopErr.Name
+	}
+	return payload
+}
+
+// WriteError writes err from Dial or Acquire as a JSON response with its
+// code and status, prefixed with msg if set.
+func WriteError(w http.ResponseWriter, err error, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(StatusCode(err))
+	json.NewEncoder(w).Encode(ErrorPayload(err, msg))
+}
+
+// configError classifies a failure to build a hop's configuration.
+func configError(err error) *Error {
+	switch {
+	case errors.Is(err, passvault.ErrLocked):
+		return &Error{Code: CodeCredentialsLocked, Err: err}
+	case errors.Is(err, ErrAgentRequired):
+		return &Error{Code: CodeAgentRequired, Err: err}
+	}
+	return &Error{Code: CodeConfig, Err: err}
+}
+
+// dialError classifies a failure to open the TCP connection to a hop.
+func dialError(err error) *Error {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	code := CodeTCP
+	switch {
+	case errors.Is(err, egress.ErrDenied):
+		return &Error{Code: CodeEgressDenied, Err: err}
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		code = CodeDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		code = CodeTimeout
+	}
+	return &Error{Code: code, Err: fmt.Errorf("connection failed: %w", err)}
+}
+
+// handshakeError classifies a failed SSH handshake, including
+// authentication.
+func handshakeError(err error) *Error {
+	var changed *hostkey.ChangedError
+	var unpinned *hostkey.UnpinnedError
+	var algErr *ssh.AlgorithmNegotiationError
+	var netErr net.Error
+	code := CodeHandshake
+	switch {
+	case errors.As(err, &changed):
+		return &Error{Code: CodeHostKeyChanged, Err: err}
+	case errors.As(err, &unpinned):
+		return &Error{Code: CodeHostKeyUnpinned, Err: err}
+	case errors.As(err, &algErr):
+		code = CodeAlgorithms
+	case errors.Is(err, errInteractive),
+		// x/crypto reports rejected credentials only as text
+		strings.Contains(err.Error(), "unable to authenticate"):
+		code = CodeAuth
+	case errors.As(err, &netErr) && netErr.Timeout():
+		code = CodeTimeout
+	}
+	return &Error{Code: code, Err: fmt.Errorf("SSH handshake failed: %w", err)}
+}
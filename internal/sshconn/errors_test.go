@@ -0,0 +1,219 @@
+package sshconn
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/egress"
+	"web-ssh-backend/internal/hostkey"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// handshake runs an SSH handshake against an in-process server configured
+// by serverConfig and returns the client's error. A nil serverConfig leaves
+// the client waiting for a server that never answers.
+func handshake(t *testing.T, config *ssh.ClientConfig, serverConfig *ssh.ServerConfig) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		server, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		if serverConfig == nil {
+			time.Sleep(time.Second)
+			return
+		}
+		if conn, _, _, err := ssh.NewServerConn(server, serverConfig); err == nil {
+			conn.Close()
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	conn, _, _, err := ssh.NewClientConn(client, "web.example:22", config)
+	if err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded")
+	}
+	return err
+}
+
+func TestHandshakeErrorCodes(t *testing.T) {
+	dbtest.Open(t)
+	hostKey := newSigner(t)
+	serverConfig := func() *ssh.ServerConfig {
+		c := &ssh.ServerConfig{
+			PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if string(password) == "hunter2" {
+					return nil, nil
+				}
+				return nil, errors.New("wrong password")
+			},
+			KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				_, err := client("", "", []string{"Verification code: "}, []bool{false})
+				return nil, err
+			},
+		}
+		c.AddHostKey(hostKey)
+		return c
+	}
+	pinned := &models.Server{UserID: 1, Name: "pinned", Host: "web.example", Port: 22, Username: "root", AuthType: "password",
+		HostKey: hostkey.Encode(newSigner(t).PublicKey())}
+	unpinned := &models.Server{UserID: 1, Name: "unpinned", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, pinned)
+	dbtest.Create(t, unpinned)
+
+	tests := []struct {
+		name   string
+		config func() *ssh.ClientConfig
+		server *ssh.ServerConfig
+		code   string
+		status int
+	}{
+		{"auth", func() *ssh.ClientConfig {
+			return &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("wrong")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		}, serverConfig(), CodeAuth, http.StatusBadGateway},
+		{"interactive", func() *ssh.ClientConfig {
+			auth := ssh.KeyboardInteractive(challenge(unpinned, "", nil))
+			return &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{auth}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		}, serverConfig(), CodeAuth, http.StatusBadGateway},
+		{"algorithms", func() *ssh.ClientConfig {
+			c := &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("hunter2")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+			c.Ciphers = []string{"aes128-ctr"}
+			return c
+		}, func() *ssh.ServerConfig {
+			c := serverConfig()
+			c.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+			return c
+		}(), CodeAlgorithms, http.StatusBadGateway},
+		{"host key changed", func() *ssh.ClientConfig {
+			c := &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("hunter2")}}
+			if err := hostkey.Apply(c, pinned, hostkey.TrustOnFirstUse); err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}, serverConfig(), CodeHostKeyChanged, http.StatusConflict},
+		{"host key unpinned", func() *ssh.ClientConfig {
+			c := &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("hunter2")}}
+			if err := hostkey.Apply(c, unpinned, hostkey.RequirePinned); err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}, serverConfig(), CodeHostKeyUnpinned, http.StatusConflict},
+		{"timeout", func() *ssh.ClientConfig {
+			return &ssh.ClientConfig{User: "root", Auth: []ssh.AuthMethod{ssh.Password("hunter2")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+		}, nil, CodeTimeout, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshakeError(handshake(t, tt.config(), tt.server))
+			checkCode(t, err, tt.code, tt.status)
+		})
+	}
+}
+
+func TestDialErrorCodes(t *testing.T) {
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	_, refused := net.Dial("tcp", closed)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, timedOut := (&net.Dialer{}).DialContext(expired, "tcp", closed)
+
+	notFound := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}}
+	denied := &egress.DeniedError{Host: "metadata.example", Port: 80, Addr: "169.254.169.254", Rule: "denied range 169.254.0.0/16"}
+
+	tests := []struct {
+		name   string
+		err    error
+		code   string
+		status int
+	}{
+		{"dns", notFound, CodeDNS, http.StatusBadGateway},
+		{"tcp", refused, CodeTCP, http.StatusBadGateway},
+		{"timeout", timedOut, CodeTimeout, http.StatusGatewayTimeout},
+		{"egress", denied, CodeEgressDenied, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("dial succeeded")
+			}
+			checkCode(t, dialError(tt.err), tt.code, tt.status)
+		})
+	}
+}
+
+func TestConfigErrorCodes(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{fmt.Errorf("failed to decrypt secret: %w", passvault.ErrLocked), CodeCredentialsLocked, http.StatusLocked},
+		{ErrAgentRequired, CodeAgentRequired, http.StatusConflict},
+		{errors.New("invalid private key"), CodeConfig, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			checkCode(t, configError(tt.err), tt.code, tt.status)
+		})
+	}
+}
+
+// checkCode checks that err, as Dial reports it for the target of a chain
+// through one jump host, maps to code and status.
+func checkCode(t *testing.T, err error, code string, status int) {
+	t.Helper()
+	err = &HopError{Hop: 2, Hops: 2, Name: "web", Addr: "web.example:22", Err: err}
+	if got := ErrorCode(err); got != code {
+		t.Fatalf("ErrorCode(%v) = %q, want %q", err, got, code)
+	}
+	if got := StatusCode(err); got != status {
+		t.Errorf("StatusCode() = %d, want %d", got, status)
+	}
+	payload := ErrorPayload(err, "")
+	if payload["code"] != code || payload["hop"] != 2 {
+		t.Errorf("ErrorPayload() = %v, want code %q at hop 2", payload, code)
+	}
+}
@@ -0,0 +1,418 @@
+package sshconn
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/hostkey"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keepaliveInterval is how often pooled connections are probed, so idle
+// timeouts on the server or in between don't drop them; zero disables
+// probes.
+var keepaliveInterval = 15 * time.Second
+
+// idleTimeout is how long a connection nobody is using stays in the pool.
+var idleTimeout = 5 * time.Minute
+
+// poolKey identifies the connections one user may share: each user has
+// their own, since users a server is shared with may authenticate
+// differently and are audited separately.
+type poolKey struct {
+	userID   uint
+	serverID uint
+}
+
+// pooled is one SSH connection and the leases on it.
+type pooled struct {
+	key       poolKey
+	ownerID   uint
+	client    *ssh.Client
+	createdAt time.Time
+	done      chan struct{} // Closed once the connection has ended
+
+	// Guarded by poolMu
+	leases   int
+	lastUsed time.Time
+	retired  bool // No new leases; closed once the last one is released
+	closed   bool
+
+	agentOnce sync.Once
+	agentErr  error
+}
+
+var (
+	poolMu sync.Mutex
+	pool   = make(map[poolKey]*pooled)
+
+	// Counters since startup, guarded by poolMu
+	dials, reuses, evictions int
+)
+
+// Init reads SSH_HOST_KEY_POLICY ("tofu" or "strict") and the Go durations
+// SSH_DIAL_TIMEOUT, SSH_HANDSHAKE_TIMEOUT, SSH_KEEPALIVE_INTERVAL ("0" for
+// no probes) and SSH_POOL_IDLE_TIMEOUT, and starts evicting idle
+// connections.
+func Init() {
+	switch v := hostkey.Policy(os.Getenv("SSH_HOST_KEY_POLICY")); v {
+	case "":
+	case hostkey.TrustOnFirstUse, hostkey.RequirePinned:
+		hostKeyPolicy = v
+	default:
+		log.Fatalf("Invalid SSH_HOST_KEY_POLICY %q", v)
+	}
+	durationEnv("SSH_DIAL_TIMEOUT", &dialTimeout, false)
+	durationEnv("SSH_HANDSHAKE_TIMEOUT", &handshakeTimeout, false)
+	durationEnv("SSH_KEEPALIVE_INTERVAL", &keepaliveInterval, true)
+	durationEnv("SSH_POOL_IDLE_TIMEOUT", &idleTimeout, false)
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			evictIdle()
+		}
+	}()
+}
+
+// durationEnv sets *d from the environment variable name, if set. Only
+// positive durations are valid, or zero when allowZero is set.
+func durationEnv(name string, d *time.Duration, allowZero bool) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed < 0 || (parsed == 0 && !allowZero) {
+		log.Fatalf("Invalid %s %q", name, v)
+	}
+	*d = parsed
+}
+
+// Lease is a use of a pooled connection. Open sessions, channels and SFTP
+// subsystems on Client as needed, but don't close it; call Release instead.
+type Lease struct {
+	Client *ssh.Client
+	Reused bool // Whether the connection was already open
+
+	conn *pooled
+	once sync.Once
+}
+
+// Acquire returns a lease on a connection to server for the user opts is
+// made for, dialing one with opts unless a live one can be reused. Callers
+// must have checked the user's access to server; changes to its connection
+// settings must call EvictServer or EvictCredential. Prompt and Agent only
+// answer authentication, so a connection is shared whichever dialed it.
+//
+// A locked vault means no connections: when the server's owner is in vault
+// mode, a pooled connection is only reused if ctx carries an unlock token
+// for them. Otherwise Acquire dials, which fails if the login needs the
+// vault.
+func Acquire(ctx context.Context, server *models.Server, opts *Options) (*Lease, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	key := poolKey{userID: opts.userID(server), serverID: server.ID}
+	locked := vaultLocked(ctx, server.UserID)
+
+	poolMu.Lock()
+	if p := pool[key]; p != nil && !locked {
+		p.leases++
+		p.lastUsed = time.Now()
+		reuses++
+		poolMu.Unlock()
+		return &Lease{Client: p.client, Reused: true, conn: p}, nil
+	}
+	poolMu.Unlock()
+
+	client, err := Dial(ctx, server, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pooled{
+		key:       key,
+		ownerID:   server.UserID,
+		client:    client,
+		createdAt: time.Now(),
+		done:      make(chan struct{}),
+		leases:    1,
+		lastUsed:  time.Now(),
+	}
+
+	poolMu.Lock()
+	dials++
+	if other := pool[key]; other != nil && !other.retired {
+		// Another caller dialed concurrently; keep theirs pooled
+		p.retired = true
+	} else {
+		pool[key] = p
+	}
+	poolMu.Unlock()
+
+	go p.keepalive()
+	return &Lease{Client: client, conn: p}, nil
+}
+
+// vaultLocked reports whether userID is in vault mode and ctx doesn't unlock
+// their vault.
+func vaultLocked(ctx context.Context, userID uint) bool {
+	enabled, err := passvault.Enabled(userID)
+	if err != nil {
+		log.Printf("Failed to check vault of user %d: %v", userID, err)
+		return true
+	}
+	if !enabled {
+		return false
+	}
+	_, unlocked := passvault.Unlocked(ctx, userID)
+	return !unlocked
+}
+
+// Release ends the lease. It is safe to call more than once.
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		poolMu.Lock()
+		defer poolMu.Unlock()
+		p := l.conn
+		p.leases--
+		p.lastUsed = time.Now()
+		if p.retired && p.leases == 0 {
+			closeLocked(p)
+		}
+	})
+}
+
+// Done is closed once the connection has ended, whether or not the lease
+// was released.
+func (l *Lease) Done() <-chan struct{} {
+	return l.conn.done
+}
+
+// Stale reports whether the connection has been evicted or has failed.
+// Callers that keep a lease across requests should then release it and
+// acquire a new one, which picks up the server's current settings.
+func (l *Lease) Stale() bool {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	return l.conn.retired
+}
+
+// Discard ends the lease and closes the connection once nobody else uses
+// it, for callers that found it broken.
+func (l *Lease) Discard() {
+	poolMu.Lock()
+	retireLocked(l.conn)
+	poolMu.Unlock()
+	l.Release()
+}
+
+// ForwardAgent serves agent channels the server opens on this connection
+// from keyring. A connection forwards at most one agent, so later calls
+// return the first call's result; keyring depends only on the server and
+// user, which all leases share.
+func (l *Lease) ForwardAgent(keyring agent.Agent) error {
+	p := l.conn
+	p.agentOnce.Do(func() {
+		p.agentErr = agent.ForwardToAgent(p.client, keyring)
+	})
+	return p.agentErr
+}
+
+// keepalive probes the connection until it closes, and drops it from the
+// pool once it fails.
+func (p *pooled) keepalive() {
+	go func() {
+		p.client.Wait()
+		close(p.done)
+	}()
+
+	var tick <-chan time.Time
+	if keepaliveInterval > 0 {
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-p.done:
+			p.drop()
+			return
+		case <-tick:
+			if _, _, err := p.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				log.Printf("SSH keepalive to server %d failed: %v", p.key.serverID, err)
+				p.client.Close()
+			}
+		}
+	}
+}
+
+// drop removes a connection that has closed.
+func (p *pooled) drop() {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if pool[p.key] == p {
+		delete(pool, p.key)
+	}
+	p.retired = true
+	p.closed = true
+}
+
+// retireLocked stops new leases on p and closes it if unused.
+func retireLocked(p *pooled) {
+	if pool[p.key] == p {
+		delete(pool, p.key)
+	}
+	p.retired = true
+	if p.leases == 0 {
+		closeLocked(p)
+	}
+}
+
+func closeLocked(p *pooled) {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	// Close waits on the network; don't hold the pool lock meanwhile
+	go p.client.Close()
+}
+
+// evictIdle closes connections nobody has used for idleTimeout.
+func evictIdle() {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	cutoff := time.Now().Add(-idleTimeout)
+	for _, p := range pool {
+		if p.leases == 0 && p.lastUsed.Before(cutoff) {
+			retireLocked(p)
+			evictions++
+		}
+	}
+}
+
+// EvictServer stops reusing connections to serverID and to the servers
+// reached through it as a jump host, as when its address, credentials or
+// host key change or it is deleted. Connections in use stay open until
+// released.
+func EvictServer(serverID uint) {
+	evictServers([]uint{serverID})
+}
+
+// EvictCredential stops reusing connections that authenticate with
+// credentialID or forward it as an agent key, directly or through a jump
+// host, as when the credential changes or a grant of it is revoked.
+func EvictCredential(credentialID uint) {
+	var serverIDs []uint
+	forwarded := db.DB.Model(&models.ForwardedKey{}).Select("server_id").Where("credential_id = ?", credentialID)
+	if err := db.DB.Model(&models.Server{}).
+		Where("credential_id = ? OR id IN (?)", credentialID, forwarded).
+		Pluck("id", &serverIDs).Error; err != nil {
+		log.Printf("Failed to find servers using credential %d: %v", credentialID, err)
+		return
+	}
+	evictServers(serverIDs)
+}
+
+// evictServers retires the connections to serverIDs and to every server
+// that uses one of them as a jump host.
+func evictServers(serverIDs []uint) {
+	if len(serverIDs) == 0 {
+		return
+	}
+	var dependents []uint
+	if err := db.DB.Model(&models.JumpHost{}).
+		Where("hop_server_id IN ?", serverIDs).
+		Pluck("server_id", &dependents).Error; err != nil {
+		// Still evict the servers themselves
+		log.Printf("Failed to find servers behind jump hosts %v: %v", serverIDs, err)
+	}
+	evict := append(append([]uint{}, serverIDs...), dependents...)
+
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	for _, p := range pool {
+		if slices.Contains(evict, p.key.serverID) {
+			retireLocked(p)
+			evictions++
+		}
+	}
+}
+
+// EvictOwner stops reusing connections to servers owned by userID, as when
+// their vault is locked and the secrets those connections used are no
+// longer available.
+func EvictOwner(userID uint) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	for _, p := range pool {
+		if p.ownerID == userID {
+			retireLocked(p)
+			evictions++
+		}
+	}
+}
+
+// PoolStats describes the connection pool for monitoring.
+type PoolStats struct {
+	Connections int `json:"connections"` // Pooled connections, in use or idle
+	InUse       int `json:"in_use"`      // Pooled connections with leases
+	Leases      int `json:"leases"`      // Leases on pooled connections
+	Dials       int `json:"dials"`       // Connections dialed since startup
+	Reuses      int `json:"reuses"`      // Leases served without dialing
+	Evictions   int `json:"evictions"`   // Connections retired for idleness or changes
+
+	IdleTimeout string           `json:"idle_timeout"`
+	Servers     []PoolConnection `json:"servers,omitempty"`
+}
+
+// PoolConnection is one pooled connection in PoolStats.
+type PoolConnection struct {
+	ServerID  uint      `json:"server_id"`
+	Leases    int       `json:"leases"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Stats returns pool-wide counters and the pooled connections made for
+// userID.
+func Stats(userID uint) PoolStats {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	stats := PoolStats{
+		Dials:       dials,
+		Reuses:      reuses,
+		Evictions:   evictions,
+		IdleTimeout: idleTimeout.String(),
+	}
+	for _, p := range pool {
+		stats.Connections++
+		stats.Leases += p.leases
+		if p.leases > 0 {
+			stats.InUse++
+		}
+		if p.key.userID == userID {
+			stats.Servers = append(stats.Servers, PoolConnection{
+				ServerID:  p.key.serverID,
+				Leases:    p.leases,
+				CreatedAt: p.createdAt,
+				LastUsed:  p.lastUsed,
+			})
+		}
+	}
+	sort.Slice(stats.Servers, func(i, j int) bool {
+		return stats.Servers[i].ServerID < stats.Servers[j].ServerID
+	})
+	return stats
+}
@@ -0,0 +1,115 @@
+package sshconn
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+)
+
+// pooledFor adds an in-use connection to serverID for userID to the pool
+// until t ends.
+func pooledFor(t *testing.T, userID, serverID uint) *pooled {
+	p := &pooled{key: poolKey{userID: userID, serverID: serverID}, leases: 1}
+	poolMu.Lock()
+	pool[p.key] = p
+	poolMu.Unlock()
+	t.Cleanup(func() {
+		poolMu.Lock()
+		delete(pool, p.key)
+		poolMu.Unlock()
+	})
+	return p
+}
+
+func TestEviction(t *testing.T) {
+	dbtest.Open(t)
+	cred := models.Credential{UserID: 1, Name: "deploy", Type: "key"}
+	dbtest.Create(t, &cred)
+
+	servers := make(map[string]*models.Server)
+	for _, name := range []string{"bastion", "behind", "forwarding", "other"} {
+		server := &models.Server{UserID: 1, Name: name, Host: name, Port: 22, Username: "root", AuthType: "password"}
+		if name == "bastion" {
+			server.AuthType, server.CredentialID = "credential", &cred.ID
+		}
+		dbtest.Create(t, server)
+		servers[name] = server
+	}
+	dbtest.Create(t, &models.JumpHost{ServerID: servers["behind"].ID, HopServerID: servers["bastion"].ID})
+	dbtest.Create(t, &models.ForwardedKey{ServerID: servers["forwarding"].ID, CredentialID: cred.ID})
+
+	tests := []struct {
+		name    string
+		evict   func()
+		retired []string
+	}{
+		{"server", func() { EvictServer(servers["forwarding"].ID) }, []string{"forwarding"}},
+		{"jump host", func() { EvictServer(servers["bastion"].ID) }, []string{"bastion", "behind"}},
+		{"credential", func() { EvictCredential(cred.ID) }, []string{"bastion", "behind", "forwarding"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conns := make(map[string]*pooled)
+			for name, server := range servers {
+				conns[name] = pooledFor(t, 1, server.ID)
+			}
+			tt.evict()
+
+			poolMu.Lock()
+			defer poolMu.Unlock()
+			for name, p := range conns {
+				if want := slices.Contains(tt.retired, name); p.retired != want {
+					t.Errorf("%s: retired = %v, want %v", name, p.retired, want)
+				}
+				if p.closed {
+					t.Errorf("%s: closed while leased", name)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireLockedVault(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	user := models.User{GoogleID: "g1", Email: "owner@example.com"}
+	dbtest.Create(t, &user)
+	token, _, err := passvault.Enable(user.ID, "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked := passvault.WithToken(context.Background(), token)
+
+	server := models.Server{UserID: user.ID, Name: "web", Host: "web.example", Port: 22, Username: "root", AuthType: "password"}
+	dbtest.Create(t, &server)
+	sealed, err := passvault.EncryptSecret(unlocked, "hunter2", crypto.Binding{UserID: user.ID, RecordID: server.ID, Field: crypto.FieldServerSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.EncryptedSecret = sealed
+	p := pooledFor(t, user.ID, server.ID)
+
+	lease, err := Acquire(unlocked, &server, nil)
+	if err != nil || !lease.Reused {
+		t.Fatalf("Acquire() with an unlock token = %v, %v; want the pooled connection", lease, err)
+	}
+	lease.Release()
+
+	passvault.Lock(user.ID)
+	for name, ctx := range map[string]context.Context{"no token": context.Background(), "locked token": unlocked} {
+		if _, err := Acquire(ctx, &server, nil); ErrorCode(err) != CodeCredentialsLocked {
+			t.Errorf("%s: Acquire() = %v, want %s", name, err, CodeCredentialsLocked)
+		}
+	}
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if p.leases != 1 {
+		t.Errorf("leases = %d, want the pooled connection untouched", p.leases)
+	}
+}
@@ -0,0 +1,415 @@
+package sshconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-ssh-backend/internal/access"
+	"web-ssh-backend/internal/audit"
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/egress"
+	"web-ssh-backend/internal/hostkey"
+	"web-ssh-backend/internal/keys"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/passvault"
+	"web-ssh-backend/internal/sshca"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrAgentRequired is returned for servers using "agent" authentication when
+// no agent is available, as for connections not made from the terminal.
+var ErrAgentRequired = errors.New("server authenticates with a browser-held key; connect from the terminal")
+
+// Connection settings; see Init.
+var (
+	// dialTimeout bounds each TCP connect and handshakeTimeout each SSH
+	// handshake, which is extended by PromptTimeout when a Prompter or
+	// Agent is set
+	dialTimeout      = 30 * time.Second
+	handshakeTimeout = 30 * time.Second
+
+	// hostKeyPolicy applies to servers without a pinned host key
+	hostKeyPolicy = hostkey.TrustOnFirstUse
+)
+
+// PromptTimeout bounds how long a user has to answer keyboard-interactive
+// prompts or agent requests; the handshake deadline is extended by it when a
+// Prompter or Agent is set.
+const PromptTimeout = 2 * time.Minute
+
+// Prompt is a single keyboard-interactive question.
+type Prompt struct {
+	Text string `json:"text"`
+	Echo bool   `json:"echo"` // Whether the answer may be shown while typed
+}
+
+// Prompter relays keyboard-interactive questions for server to the user and
+// returns one answer per prompt.
+type Prompter func(server *models.Server, name, instruction string, prompts []Prompt) ([]string, error)
+
+// Options say who a connection is for and how to answer authentication
+// questions. A nil *Options connects for the server's owner without either.
+type Options struct {
+	// Prompt answers keyboard-interactive questions the stored credentials
+	// can't, such as a TOTP code. Without it those questions fail
+	// authentication.
+	Prompt Prompter
+
+	// Agent signs for servers using "agent" authentication, whose keys are
+	// held by the browser rather than stored.
+	Agent agent.Agent
+
+	// UserID is the user the connection is made for, when not the server's
+	// owner. Certificates minted by a CA name and audit this user.
+	UserID uint
+}
+
+// userID returns the user a connection to server is made for.
+func (o *Options) userID(server *models.Server) uint {
+	if o.UserID != 0 {
+		return o.UserID
+	}
+	return server.UserID
+}
+
+// HopError reports which server in a jump host chain a connection failed at.
+type HopError struct {
+	Hop  int // 1-based position in the chain; the target is the last hop
+	Hops int
+	Name string
+	Addr string
+	Err  error
+}
+
+func (e *HopError) Error() string {
+	if e.Hops == 1 {
+		return e.Err.Error()
+	}
+	role := "jump host"
+	if e.Hop == e.Hops {
+		role = "target"
+	}
+	return fmt.Sprintf("hop %d/%d, %s %s (%s): %v", e.Hop, e.Hops, role, e.Name, e.Addr, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// Address returns the host:port to dial for server.
+func Address(server *models.Server) string {
+	return net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+}
+
+// JumpHosts returns the servers that server is reached through, in dialing
+// order. Hops are resolved on behalf of the server's owner.
+func JumpHosts(server *models.Server) ([]*models.Server, error) {
+	var links []models.JumpHost
+	if err := db.DB.Where("server_id = ?", server.ID).Order("position").Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	hops := make([]*models.Server, 0, len(links))
+	for _, link := range links {
+		hop, err := access.ResolveServer(server.UserID, link.HopServerID)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %d: %w", link.HopServerID, err)
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// Dial connects to server through its jump host chain, if any. Each hop
+// authenticates with its own stored credentials and verifies its own host
+// key. Closing the returned client also closes the jump host connections.
+func Dial(ctx context.Context, server *models.Server, opts *Options) (*ssh.Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	hops, err := JumpHosts(server)
+	if err != nil {
+		return nil, &Error{Code: CodeConfig, Err: err}
+	}
+	chain := append(append([]*models.Server{}, hops...), server)
+
+	var opened []*ssh.Client
+	closeAll := func() {
+		for i := len(opened) - 1; i >= 0; i-- {
+			opened[i].Close()
+		}
+	}
+
+	var via *ssh.Client
+	for i, hop := range chain {
+		client, err := dialHop(ctx, via, hop, opts)
+		if err != nil {
+			closeAll()
+			return nil, &HopError{Hop: i + 1, Hops: len(chain), Name: hop.Name, Addr: Address(hop), Err: err}
+		}
+		opened = append(opened, client)
+		via = client
+	}
+
+	if len(opened) > 1 {
+		target := opened[len(opened)-1]
+		bastions := opened[:len(opened)-1]
+		go func() {
+			target.Wait()
+			for i := len(bastions) - 1; i >= 0; i-- {
+				bastions[i].Close()
+			}
+		}()
+	}
+
+	return via, nil
+}
+
+// dialHop connects to server directly, or through via when it is not nil.
+func dialHop(ctx context.Context, via *ssh.Client, server *models.Server, opts *Options) (*ssh.Client, error) {
+	config, err := clientConfig(ctx, server, opts)
+	if err != nil {
+		return nil, configError(err)
+	}
+
+	addr := Address(server)
+	var conn net.Conn
+	if via == nil {
+		// Create TCP connection with keepalive enabled, to an address the
+		// egress policy allows. Hops behind a jump host are dialed from its
+		// network, not the gateway's, so the policy doesn't apply to them.
+		dialer := &net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 15 * time.Second,
+		}
+		conn, err = egress.Dial(ctx, dialer, server.Host, server.Port)
+		var denied *egress.DeniedError
+		if errors.As(err, &denied) {
+			recordDenied(server, opts, denied)
+		}
+	} else {
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		conn, err = via.DialContext(dialCtx, "tcp", addr)
+		cancel()
+	}
+	if err != nil {
+		return nil, dialError(err)
+	}
+
+	// Bound the handshake; channels through a jump host don't support
+	// deadlines, in which case the outer connection's keepalive applies
+	timeout := handshakeTimeout
+	if opts.Prompt != nil || opts.Agent != nil {
+		timeout += PromptTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, handshakeError(err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// recordDenied audits a connection to server refused by the egress policy.
+func recordDenied(server *models.Server, opts *Options, denied *egress.DeniedError) {
+	err := audit.Record(opts.userID(server), &server.ID, audit.ActionEgressDenied, map[string]interface{}{
+		"server":  server.Name,
+		"host":    denied.Host,
+		"port":    denied.Port,
+		"address": denied.Addr,
+		"rule":    denied.Rule,
+	})
+	if err != nil {
+		log.Printf("Failed to record denied connection to server %d: %v", server.ID, err)
+	}
+}
+
+// login is the authentication material for a server, taken from the server
+// itself or from the credential it references.
+type login struct {
+	authType    string
+	secret      string
+	passphrase  string
+	certificate string
+}
+
+// loadLogin decrypts the secrets server authenticates with. Secrets in the
+// owner's vault are decrypted with the unlock token carried by ctx.
+func loadLogin(ctx context.Context, server *models.Server) (*login, error) {
+	if server.CredentialID == nil {
+		l := &login{authType: server.AuthType}
+		var err error
+		l.secret, err = passvault.DecryptSecret(ctx, server.EncryptedSecret, crypto.Binding{UserID: server.UserID, RecordID: server.ID, Field: crypto.FieldServerSecret})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+		}
+		if server.AuthType == "key" && server.EncryptedPassphrase != "" {
+			l.passphrase, err = passvault.DecryptSecret(ctx, server.EncryptedPassphrase, crypto.Binding{UserID: server.UserID, RecordID: server.ID, Field: crypto.FieldServerPassphrase})
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt passphrase: %w", err)
+			}
+		}
+		return l, nil
+	}
+
+	// The server's owner must be able to use the credential, also when a
+	// grantee of the server connects
+	l, _, err := credentialLogin(ctx, server.UserID, *server.CredentialID)
+	return l, err
+}
+
+// credentialLogin decrypts the secrets of credential id, which userID owns
+// or has been granted.
+func credentialLogin(ctx context.Context, userID, id uint) (*login, *models.Credential, error) {
+	cred, err := access.ResolveCredential(userID, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("credential %d: %w", id, err)
+	}
+
+	l := &login{authType: cred.Type, certificate: cred.Certificate}
+	l.secret, err = passvault.DecryptSecret(ctx, cred.EncryptedSecret, crypto.Binding{UserID: cred.UserID, RecordID: cred.ID, Field: crypto.FieldCredentialSecret})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt credential %q: %w", cred.Name, err)
+	}
+	if cred.EncryptedPassphrase != "" {
+		l.passphrase, err = passvault.DecryptSecret(ctx, cred.EncryptedPassphrase, crypto.Binding{UserID: cred.UserID, RecordID: cred.ID, Field: crypto.FieldCredentialPassphrase})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt passphrase of credential %q: %w", cred.Name, err)
+		}
+	}
+	return l, cred, nil
+}
+
+// signer parses the key of a "key" or "certificate" login.
+func (l *login) signer() (ssh.Signer, error) {
+	switch l.authType {
+	case "key":
+		signer, err := keys.ParseSigner([]byte(l.secret), []byte(l.passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		return signer, nil
+	case "certificate":
+		return keys.ParseCertSigner([]byte(l.secret), []byte(l.passphrase), []byte(l.certificate))
+	default:
+		return nil, fmt.Errorf("%s login has no key", l.authType)
+	}
+}
+
+// authenticate returns the primary auth method for server, and the password
+// to answer keyboard-interactive password questions with, if any.
+func authenticate(ctx context.Context, server *models.Server, opts *Options) (ssh.AuthMethod, string, error) {
+	// Servers trusting a CA get a fresh certificate on every connection
+	if server.CredentialID == nil && server.AuthType == "certificate" {
+		signer, err := sshca.Issue(ctx, server, opts.userID(server))
+		if err != nil {
+			return nil, "", err
+		}
+		return ssh.PublicKeys(signer), "", nil
+	}
+	if server.CredentialID == nil && server.AuthType == "agent" {
+		if opts.Agent == nil {
+			return nil, "", ErrAgentRequired
+		}
+		return ssh.PublicKeysCallback(opts.Agent.Signers), "", nil
+	}
+
+	l, err := loadLogin(ctx, server)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch l.authType {
+	case "password":
+		return ssh.Password(l.secret), l.secret, nil
+	case "key", "certificate":
+		signer, err := l.signer()
+		if err != nil {
+			return nil, "", err
+		}
+		return ssh.PublicKeys(signer), "", nil
+	default:
+		return ssh.Password(l.secret), "", nil
+	}
+}
+
+// clientConfig builds the configuration for server.
+func clientConfig(ctx context.Context, server *models.Server, opts *Options) (*ssh.ClientConfig, error) {
+	authMethod, password, err := authenticate(ctx, server, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyboard-interactive comes second: servers that want a password and
+	// then a one-time code via PAM reject plain password auth and fall
+	// through to it, as do servers requiring a key plus a code
+	config := &ssh.ClientConfig{
+		User:    server.Username,
+		Auth:    []ssh.AuthMethod{authMethod, ssh.KeyboardInteractive(challenge(server, password, opts.Prompt))},
+		Timeout: dialTimeout,
+	}
+	algorithms, err := ServerAlgorithms(server)
+	if err != nil {
+		return nil, err
+	}
+	config.KeyExchanges = algorithms.KeyExchanges
+	config.Ciphers = algorithms.Ciphers
+	config.MACs = algorithms.MACs
+	config.HostKeyAlgorithms = algorithms.HostKeyAlgorithms
+	if err := hostkey.Apply(config, server, hostKeyPolicy); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// challenge answers password questions with the stored password, once, and
+// relays everything else through prompt.
+func challenge(server *models.Server, password string, prompt Prompter) ssh.KeyboardInteractiveChallenge {
+	passwordUsed := false
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		var relay []Prompt
+		var relayIdx []int
+		for i, q := range questions {
+			if password != "" && !passwordUsed && !echos[i] && strings.Contains(strings.ToLower(q), "password") {
+				answers[i] = password
+				passwordUsed = true
+				continue
+			}
+			relay = append(relay, Prompt{Text: q, Echo: echos[i]})
+			relayIdx = append(relayIdx, i)
+		}
+
+		if len(relay) == 0 {
+			return answers, nil
+		}
+		if prompt == nil {
+			return nil, errInteractive
+		}
+
+		replies, err := prompt(server, name, instruction, relay)
+		if err != nil {
+			return nil, err
+		}
+		if len(replies) != len(relay) {
+			return nil, fmt.Errorf("expected %d answers, got %d", len(relay), len(replies))
+		}
+		for i, idx := range relayIdx {
+			answers[idx] = replies[i]
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,306 @@
+package sshconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+	"web-ssh-backend/internal/sshtest"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// linkJumpHosts makes server reachable through hops, in order.
+func linkJumpHosts(t *testing.T, server *models.Server, hops ...*models.Server) {
+	t.Helper()
+	for i, hop := range hops {
+		dbtest.Create(t, &models.JumpHost{ServerID: server.ID, HopServerID: hop.ID, Position: i})
+	}
+}
+
+// chainServer stores a server named name that is up, "down" (refuses
+// connections) or has a "wrong password".
+func chainServer(t *testing.T, name, state string) *models.Server {
+	t.Helper()
+	server := sshtest.Start(t).Record(t, 1, name)
+	switch state {
+	case "down":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if err := db.DB.Model(server).Update("port", server.Port).Error; err != nil {
+			t.Fatal(err)
+		}
+	case "wrong password":
+		sealed, err := crypto.Encrypt("wrong", crypto.Binding{UserID: 1, RecordID: server.ID, Field: crypto.FieldServerSecret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.EncryptedSecret = sealed
+		if err := db.DB.Model(server).Update("encrypted_secret", sealed).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func TestDialThroughJumpHosts(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	bastion, inner, target := sshtest.Start(t), sshtest.Start(t), sshtest.Start(t)
+	target.Run = func(ch ssh.Channel, command string) {
+		io.WriteString(ch, "target")
+		sshtest.ExitStatus(ch, 0)
+	}
+	server := target.Record(t, 1, "target")
+	linkJumpHosts(t, server, bastion.Record(t, 1, "bastion"), inner.Record(t, 1, "inner"))
+
+	client, err := Dial(context.Background(), server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if out, err := session.Output("hostname"); err != nil || string(out) != "target" {
+		t.Fatalf("Output() = %q, %v; want the target's output", out, err)
+	}
+
+	if got, want := bastion.Forwards(), []string{inner.Addr()}; !slices.Equal(got, want) {
+		t.Errorf("bastion forwarded to %q, want %q", got, want)
+	}
+	if got, want := inner.Forwards(), []string{target.Addr()}; !slices.Equal(got, want) {
+		t.Errorf("inner jump host forwarded to %q, want %q", got, want)
+	}
+}
+
+func TestHopErrors(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+
+	tests := []struct {
+		name  string
+		chain []string // States of the jump hosts, then the target
+		hop   int
+		code  string
+	}{
+		{"direct", []string{"down"}, 1, CodeTCP},
+		{"jump host down", []string{"down", "up"}, 1, CodeTCP},
+		{"jump host wrong password", []string{"wrong password", "up"}, 1, CodeAuth},
+		{"target down behind jump host", []string{"up", "down"}, 2, CodeTCP},
+		{"target wrong password", []string{"up", "up", "wrong password"}, 3, CodeAuth},
+		{"second jump host wrong password", []string{"up", "wrong password", "up"}, 2, CodeAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chain []*models.Server
+			for i, state := range tt.chain {
+				name := fmt.Sprintf("hop%d", i+1)
+				if i == len(tt.chain)-1 {
+					name = "target"
+				}
+				chain = append(chain, chainServer(t, name, state))
+			}
+			server := chain[len(chain)-1]
+			linkJumpHosts(t, server, chain[:len(chain)-1]...)
+
+			client, err := Dial(context.Background(), server, nil)
+			if err == nil {
+				client.Close()
+				t.Fatal("Dial() succeeded")
+			}
+			var hopErr *HopError
+			if !errors.As(err, &hopErr) {
+				t.Fatalf("Dial() = %v, want a HopError", err)
+			}
+			failed := chain[tt.hop-1]
+			if hopErr.Hop != tt.hop || hopErr.Hops != len(chain) || hopErr.Name != failed.Name || hopErr.Addr != Address(failed) {
+				t.Errorf("HopError = hop %d/%d %s (%s), want hop %d/%d %s (%s)", hopErr.Hop, hopErr.Hops, hopErr.Name, hopErr.Addr, tt.hop, len(chain), failed.Name, Address(failed))
+			}
+			if code := ErrorCode(err); code != tt.code {
+				t.Errorf("ErrorCode() = %q, want %q (%v)", code, tt.code, err)
+			}
+
+			payload := ErrorPayload(err, "")
+			if len(chain) == 1 {
+				if strings.HasPrefix(err.Error(), "hop ") || payload["hop"] != nil {
+					t.Errorf("direct connection error names a hop: %v, %v", err, payload)
+				}
+				return
+			}
+			if payload["hop"] != tt.hop || payload["hops"] != len(chain) || payload["hop_name"] != failed.Name {
+				t.Errorf("payload = %v, want hop %d/%d %s", payload, tt.hop, len(chain), failed.Name)
+			}
+			if prefix := fmt.Sprintf("hop %d/%d, ", tt.hop, len(chain)); !strings.HasPrefix(err.Error(), prefix) {
+				t.Errorf("error = %q, want prefix %q", err, prefix)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	server := &models.Server{Name: "web"}
+	errCancelled := errors.New("cancelled")
+
+	tests := []struct {
+		name      string
+		password  string
+		questions []string
+		echos     []bool
+		replies   []string // Returned by the prompter; nil means no prompter
+		err       error
+		relayed   []Prompt
+		answers   []string
+	}{
+		{
+			name:      "stored password",
+			password:  "hunter2",
+			questions: []string{"Password: "},
+			echos:     []bool{false},
+			answers:   []string{"hunter2"},
+		},
+		{
+			name:      "password and code",
+			password:  "hunter2",
+			questions: []string{"Password: ", "Verification code: "},
+			echos:     []bool{false, true},
+			replies:   []string{"123456"},
+			relayed:   []Prompt{{Text: "Verification code: ", Echo: true}},
+			answers:   []string{"hunter2", "123456"},
+		},
+		{
+			name:      "echoed password question",
+			password:  "hunter2",
+			questions: []string{"Password hint: "},
+			echos:     []bool{true},
+			replies:   []string{"blue"},
+			relayed:   []Prompt{{Text: "Password hint: ", Echo: true}},
+			answers:   []string{"blue"},
+		},
+		{
+			name:      "no stored password",
+			questions: []string{"Password: "},
+			echos:     []bool{false},
+			replies:   []string{"typed"},
+			relayed:   []Prompt{{Text: "Password: ", Echo: false}},
+			answers:   []string{"typed"},
+		},
+		{
+			name:      "no prompter",
+			password:  "hunter2",
+			questions: []string{"Password: ", "Verification code: "},
+			echos:     []bool{false, true},
+			err:       errInteractive,
+		},
+		{
+			name:      "wrong number of answers",
+			questions: []string{"Verification code: "},
+			echos:     []bool{true},
+			replies:   []string{"1", "2"},
+			err:       errors.New("expected 1 answers, got 2"),
+		},
+		{
+			name:      "prompter fails",
+			questions: []string{"Verification code: "},
+			echos:     []bool{true},
+			replies:   []string{},
+			err:       errCancelled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prompt Prompter
+			var relayed []Prompt
+			if tt.replies != nil {
+				prompt = func(s *models.Server, name, instruction string, prompts []Prompt) ([]string, error) {
+					if s != server || name != "login" || instruction != "Two-factor" {
+						t.Errorf("prompt(%s, %q, %q), want the server, name and instruction", s.Name, name, instruction)
+					}
+					relayed = prompts
+					if tt.err == errCancelled {
+						return nil, errCancelled
+					}
+					return tt.replies, nil
+				}
+			}
+
+			answers, err := challenge(server, tt.password, prompt)("login", "Two-factor", tt.questions, tt.echos)
+			if tt.err != nil {
+				if err == nil || err.Error() != tt.err.Error() {
+					t.Fatalf("challenge() = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(answers, tt.answers) {
+				t.Errorf("answers = %q, want %q", answers, tt.answers)
+			}
+			if !slices.Equal(relayed, tt.relayed) {
+				t.Errorf("relayed = %+v, want %+v", relayed, tt.relayed)
+			}
+		})
+	}
+}
+
+func TestChallengeUsesPasswordOnce(t *testing.T) {
+	var relayed []Prompt
+	prompt := func(_ *models.Server, _, _ string, prompts []Prompt) ([]string, error) {
+		relayed = prompts
+		return []string{"typed"}, nil
+	}
+	answer := challenge(&models.Server{}, "hunter2", prompt)
+	if answers, err := answer("", "", []string{"Password: "}, []bool{false}); err != nil || answers[0] != "hunter2" {
+		t.Fatalf("first round = %q, %v; want the stored password", answers, err)
+	}
+	// A second password question means the stored one was wrong
+	if answers, err := answer("", "", []string{"Password: "}, []bool{false}); err != nil || answers[0] != "typed" || len(relayed) != 1 {
+		t.Fatalf("second round = %q, %v; want the question relayed", answers, err)
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	dbtest.Open(t)
+	t.Setenv("ENCRYPTION_KEY", "test secret")
+	crypto.Init()
+	srv := sshtest.Start(t)
+	srv.OTP = "123456"
+	server := srv.Record(t, 1, "web")
+
+	var relayed []Prompt
+	opts := &Options{Prompt: func(_ *models.Server, _, _ string, prompts []Prompt) ([]string, error) {
+		relayed = prompts
+		return []string{"123456"}, nil
+	}}
+	client, err := Dial(context.Background(), server, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if want := []Prompt{{Text: "Verification code: ", Echo: true}}; !slices.Equal(relayed, want) {
+		t.Errorf("relayed = %+v, want %+v", relayed, want)
+	}
+
+	// Without a prompter nobody can answer the code
+	if _, err := Dial(context.Background(), server, nil); ErrorCode(err) != CodeAuth || !errors.Is(err, errInteractive) {
+		t.Errorf("Dial() without a prompter = %v, want %s", err, CodeAuth)
+	}
+}
@@ -0,0 +1,298 @@
+// Package sshtest runs SSH servers in-process for tests.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"web-ssh-backend/internal/crypto"
+	"web-ssh-backend/internal/db"
+	"web-ssh-backend/internal/dbtest"
+	"web-ssh-backend/internal/models"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Password is the password every Server accepts, for any user.
+const Password = "secret"
+
+// Server is an SSH server listening on a loopback port. It runs shells and
+// commands with Run and forwards direct-tcpip channels, as a jump host does.
+type Server struct {
+	Host    string
+	Port    int
+	HostKey ssh.Signer
+
+	// Run serves a shell or, when command isn't empty, a command on ch,
+	// which is closed when Run returns. Nil echoes input until EOF and
+	// exits with status 0.
+	Run func(ch ssh.Channel, command string)
+
+	// Home, if set, is served over SFTP as the working directory, and keys
+	// in its .ssh/authorized_keys are accepted.
+	Home string
+
+	// OTP, if set, is asked for after Password by keyboard-interactive
+	// authentication, and password authentication is refused.
+	OTP string
+
+	mu       sync.Mutex
+	requests []string
+	forwards []string
+}
+
+// Start starts a Server that stops when t ends.
+func Start(t testing.TB) *Server {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	addr := l.Addr().(*net.TCPAddr)
+	s := &Server{Host: addr.IP.String(), Port: addr.Port, HostKey: hostKey}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.OTP != "" || string(password) != Password {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.Home != "" {
+				rest, _ := os.ReadFile(filepath.Join(s.Home, ".ssh", "authorized_keys"))
+				for len(rest) > 0 {
+					authorized, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+					if err != nil {
+						break
+					}
+					if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+						return nil, nil
+					}
+					rest = next
+				}
+			}
+			return nil, fmt.Errorf("unknown public key")
+		},
+		KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			questions, echos, want := []string{"Password: "}, []bool{false}, []string{Password}
+			if s.OTP != "" {
+				questions, echos, want = append(questions, "Verification code: "), append(echos, true), append(want, s.OTP)
+			}
+			answers, err := client("login", "Two-factor authentication", questions, echos)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Equal(answers, want) {
+				return nil, fmt.Errorf("wrong answers")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+// Addr returns the server's address as host:port.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Record stores a server named name for userID that logs in to s with
+// Password. Callers have opened a database with dbtest and initialized
+// crypto.
+func (s *Server) Record(t testing.TB, userID uint, name string) *models.Server {
+	t.Helper()
+	server := &models.Server{UserID: userID, Name: name, Host: s.Host, Port: s.Port, Username: "admin", AuthType: "password"}
+	dbtest.Create(t, server)
+	sealed, err := crypto.Encrypt(Password, crypto.Binding{UserID: userID, RecordID: server.ID, Field: crypto.FieldServerSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Model(server).Update("encrypted_secret", sealed).Error; err != nil {
+		t.Fatal(err)
+	}
+	server.EncryptedSecret = sealed
+	return server
+}
+
+// Requests returns the types of the session requests received so far, in
+// order, such as "pty-req", "shell" or "window-change".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Forwards returns the addresses of the direct-tcpip channels opened so
+// far, in order.
+func (s *Server) Forwards() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.forwards...)
+}
+
+// ExitStatus reports that the command on ch exited with status.
+func ExitStatus(ch ssh.Channel, status uint32) {
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// ExitSignal reports that the command on ch was killed by signal, without
+// the "SIG" prefix, with message msg.
+func ExitSignal(ch ssh.Channel, signal, msg string) {
+	ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Msg        string
+		Lang       string
+	}{signal, false, msg, ""}))
+}
+
+func (s *Server) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go s.session(ch, reqs)
+		case "direct-tcpip":
+			go s.forward(newCh)
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *Server) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	started := false
+	for req := range reqs {
+		s.mu.Lock()
+		s.requests = append(s.requests, req.Type)
+		s.mu.Unlock()
+
+		ok := true
+		switch req.Type {
+		case "pty-req", "window-change", "env":
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" || s.Home == "" || started {
+				ok = false
+				break
+			}
+			started = true
+			go func() {
+				defer ch.Close()
+				server, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(s.Home))
+				if err != nil {
+					return
+				}
+				server.Serve()
+			}()
+		case "shell", "exec":
+			var command string
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				command = payload.Command
+			}
+			if started {
+				ok = false
+				break
+			}
+			started = true
+			go func() {
+				defer ch.Close()
+				if s.Run == nil {
+					io.Copy(ch, ch)
+					ExitStatus(ch, 0)
+					return
+				}
+				s.Run(ch, command)
+			}()
+		default:
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// forward connects a direct-tcpip channel to the address it asks for.
+func (s *Server) forward(newCh ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &target); err != nil {
+		newCh.Reject(ssh.ConnectionFailed, "invalid request")
+		return
+	}
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	s.mu.Lock()
+	s.forwards = append(s.forwards, addr)
+	s.mu.Unlock()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+	ch.Close()
+}
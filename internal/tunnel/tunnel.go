@@ -0,0 +1,353 @@
+// Package tunnel multiplexes TCP streams over one WebSocket. The gateway's
+// /ws/tunnel endpoint and cmd/tunnel speak it in mux mode.
+//
+// Each binary WebSocket message is one frame: a type byte, a big-endian
+// uint32 stream ID and a payload. The client opens a stream with FrameOpen
+// carrying "host:port"; the gateway answers FrameOpened or FrameClose with
+// the reason. Either side ends a stream with FrameClose.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame types.
+const (
+	FrameOpen   byte = 1
+	FrameOpened byte = 2
+	FrameData   byte = 3
+	FrameClose  byte = 4
+)
+
+const (
+	headerSize   = 5
+	maxChunk     = 32 * 1024 // Largest payload written per frame
+	streamBuffer = 32        // Frames queued per stream before reads block the mux
+	openTimeout  = 30 * time.Second
+	writeWait    = 10 * time.Second
+)
+
+var (
+	ErrInvalidFrame = errors.New("invalid tunnel frame")
+	ErrMuxClosed    = errors.New("tunnel closed")
+)
+
+// Frame is one mux message.
+type Frame struct {
+	Type    byte
+	Stream  uint32
+	Payload []byte
+}
+
+// Marshal encodes f for a binary WebSocket message.
+func (f Frame) Marshal() []byte {
+	b := make([]byte, headerSize+len(f.Payload))
+	b[0] = f.Type
+	binary.BigEndian.PutUint32(b[1:headerSize], f.Stream)
+	copy(b[headerSize:], f.Payload)
+	return b
+}
+
+// ParseFrame decodes a binary WebSocket message.
+func ParseFrame(b []byte) (Frame, error) {
+	if len(b) < headerSize || b[0] < FrameOpen || b[0] > FrameClose {
+		return Frame{}, ErrInvalidFrame
+	}
+	return Frame{Type: b[0], Stream: binary.BigEndian.Uint32(b[1:headerSize]), Payload: b[headerSize:]}, nil
+}
+
+// Dialer connects a stream opened by the far end to target.
+type Dialer func(target string) (net.Conn, error)
+
+// Mux carries streams over a WebSocket. Serve must be running for streams
+// to receive data. A stream whose reader falls behind eventually stalls the
+// others, so readers should keep up.
+type Mux struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	closed  chan struct{}
+}
+
+// NewMux returns a Mux over ws.
+func NewMux(ws *websocket.Conn) *Mux {
+	return &Mux{
+		ws:      ws,
+		streams: make(map[uint32]*Stream),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Done is closed once the WebSocket has failed.
+func (m *Mux) Done() <-chan struct{} {
+	return m.closed
+}
+
+func (m *Mux) send(f Frame) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return m.ws.WriteMessage(websocket.BinaryMessage, f.Marshal())
+}
+
+// Open asks the far end to connect to target and returns the stream.
+func (m *Mux) Open(target string) (*Stream, error) {
+	m.mu.Lock()
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		return nil, ErrMuxClosed
+	default:
+	}
+	m.nextID++
+	s := m.newStream(m.nextID)
+	s.opened = make(chan error, 1)
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.send(Frame{Type: FrameOpen, Stream: s.id, Payload: []byte(target)}); err != nil {
+		m.remove(s.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-s.opened:
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	case <-time.After(openTimeout):
+		s.Close()
+		return nil, errors.New("timed out opening tunnel")
+	}
+}
+
+// Serve reads frames until the WebSocket fails. Streams the far end opens
+// are connected with dial in their own goroutine; a nil dial refuses them.
+func (m *Mux) Serve(dial Dialer) error {
+	defer m.shutdown()
+
+	for {
+		msgType, data, err := m.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		f, err := ParseFrame(data)
+		if err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case FrameOpen:
+			m.accept(f.Stream, string(f.Payload), dial)
+		case FrameOpened:
+			if s := m.lookup(f.Stream); s != nil && s.opened != nil {
+				select {
+				case s.opened <- nil:
+				default:
+				}
+			}
+		case FrameData:
+			if s := m.lookup(f.Stream); s != nil {
+				select {
+				case s.recv <- f.Payload:
+				case <-s.done:
+				}
+			}
+		case FrameClose:
+			if s := m.remove(f.Stream); s != nil {
+				s.closeRemote(string(f.Payload))
+			}
+		}
+	}
+}
+
+// accept handles a FrameOpen from the far end.
+func (m *Mux) accept(id uint32, target string, dial Dialer) {
+	m.mu.Lock()
+	if _, exists := m.streams[id]; exists || dial == nil {
+		m.mu.Unlock()
+		m.send(Frame{Type: FrameClose, Stream: id, Payload: []byte("stream refused")})
+		return
+	}
+	s := m.newStream(id)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	go func() {
+		conn, err := dial(target)
+		if err != nil {
+			m.remove(id)
+			m.send(Frame{Type: FrameClose, Stream: id, Payload: []byte(err.Error())})
+			return
+		}
+		if err := m.send(Frame{Type: FrameOpened, Stream: id}); err != nil {
+			conn.Close()
+			s.Close()
+			return
+		}
+		Relay(conn, s)
+	}()
+}
+
+func (m *Mux) lookup(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *Mux) remove(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.streams[id]
+	delete(m.streams, id)
+	return s
+}
+
+// shutdown ends every stream once the WebSocket is gone.
+func (m *Mux) shutdown() {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.closed)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.closeRemote(ErrMuxClosed.Error())
+	}
+}
+
+func (m *Mux) newStream(id uint32) *Stream {
+	return &Stream{
+		id:   id,
+		mux:  m,
+		recv: make(chan []byte, streamBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// Stream is one TCP connection carried by a Mux.
+type Stream struct {
+	id     uint32
+	mux    *Mux
+	opened chan error // Open's result, for streams opened locally
+
+	recv chan []byte // Closed by the Serve goroutine when the far end closes
+	buf  []byte
+
+	closeOnce  sync.Once
+	done       chan struct{} // Closed by Close
+	remoteOnce sync.Once
+	remoteDone bool
+	mu         sync.Mutex
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		select {
+		case b, ok := <-s.recv:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.buf = b
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.isClosed() {
+			return written, io.ErrClosedPipe
+		}
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err := s.mux.send(Frame{Type: FrameData, Stream: s.id, Payload: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the stream in both directions.
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.mux.remove(s.id) != nil {
+			s.mux.send(Frame{Type: FrameClose, Stream: s.id})
+		}
+	})
+	return nil
+}
+
+// closeRemote records that the far end closed the stream; buffered data can
+// still be read. It runs on the Serve goroutine, the only sender on recv.
+func (s *Stream) closeRemote(reason string) {
+	s.remoteOnce.Do(func() {
+		s.mu.Lock()
+		s.remoteDone = true
+		s.mu.Unlock()
+		if reason == "" {
+			reason = "stream closed"
+		}
+		if s.opened != nil {
+			select {
+			case s.opened <- errors.New(reason):
+			default:
+			}
+		}
+		close(s.recv)
+	})
+}
+
+func (s *Stream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return true
+	default:
+		return s.remoteDone
+	}
+}
+
+// Relay copies between a and b until either side ends, then closes both.
+func Relay(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
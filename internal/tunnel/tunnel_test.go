@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Frame{
+		{Type: FrameOpen, Stream: 1, Payload: []byte("localhost:5432")},
+		{Type: FrameOpened, Stream: 0xdeadbeef, Payload: []byte{}},
+		{Type: FrameData, Stream: 7, Payload: bytes.Repeat([]byte{0xff}, maxChunk)},
+		{Type: FrameClose, Stream: 2, Payload: []byte("connection refused")},
+	}
+	for _, f := range tests {
+		b := f.Marshal()
+		if len(b) != headerSize+len(f.Payload) || b[0] != f.Type {
+			t.Fatalf("Marshal(%d, %d) has header % x", f.Type, f.Stream, b[:headerSize])
+		}
+		got, err := ParseFrame(b)
+		if err != nil {
+			t.Fatalf("ParseFrame(%d, %d): %v", f.Type, f.Stream, err)
+		}
+		if got.Type != f.Type || got.Stream != f.Stream || !bytes.Equal(got.Payload, f.Payload) {
+			t.Errorf("ParseFrame(Marshal(%d, %d)) = %d, %d with %d bytes", f.Type, f.Stream, got.Type, got.Stream, len(got.Payload))
+		}
+	}
+
+	// The stream ID is big-endian
+	if b := (Frame{Type: FrameData, Stream: 0x01020304}).Marshal(); !bytes.Equal(b, []byte{FrameData, 1, 2, 3, 4}) {
+		t.Errorf("Marshal() = % x", b)
+	}
+}
+
+func TestParseFrameInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{FrameData, 0, 0, 0},         // Short header
+		{0, 0, 0, 0, 1},              // Type below FrameOpen
+		{FrameClose + 1, 0, 0, 0, 1}, // Type above FrameClose
+	} {
+		if _, err := ParseFrame(b); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("ParseFrame(% x) = %v, want ErrInvalidFrame", b, err)
+		}
+	}
+}
+
+// muxPair returns a client Mux connected over a WebSocket to a gateway Mux
+// serving streams with dial.
+func muxPair(t *testing.T, dial Dialer) *Mux {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		NewMux(ws).Serve(dial)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	client := NewMux(ws)
+	go client.Serve(nil)
+	return client
+}
+
+func TestMuxStreams(t *testing.T) {
+	client := muxPair(t, func(target string) (net.Conn, error) {
+		if target != "echo:7" {
+			return nil, errors.New("no route to " + target)
+		}
+		local, remote := net.Pipe()
+		go func() {
+			io.Copy(remote, remote)
+			remote.Close()
+		}()
+		return local, nil
+	})
+
+	if _, err := client.Open("db:5432"); err == nil || !strings.Contains(err.Error(), "no route to db:5432") {
+		t.Errorf("Open() of an unreachable target = %v, want the dial error", err)
+	}
+
+	// Two streams at once, each getting back only its own data
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		s, err := client.Open("echo:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		streams = append(streams, s)
+	}
+	for i, s := range streams {
+		msg := []byte(strings.Repeat(string(rune('a'+i)), maxChunk+10))
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("stream %d echoed different data", i)
+		}
+	}
+}
+
+func TestMuxRefusesWithoutDialer(t *testing.T) {
+	client := muxPair(t, nil)
+	if _, err := client.Open("localhost:22"); err == nil {
+		t.Error("Open() succeeded against a mux that accepts no streams")
+	}
+}